@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Bot answers the messages addressed to it, either by running a command or by asking OpenAI.
+type Bot struct {
+	cfg    *config.Config
+	rock   *rocket.RocketCon
+	hist   *History
+	router *CommandRouter
+	tools  *ToolRegistry
+
+	// Settings changed by commands, by room id.
+	rooms map[string]*RoomSettings
+	// The last message sent to OpenAI by history place, it is used by the retry command.
+	lastPrompts map[string]rocket.Message
+	roomsMutex  sync.Mutex
+
+	// ctx is canceled by Cancel, it stops the requests in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type RoomSettings struct {
+	Model   string
+	Persona string
+}
+
+func NewBot(cfg *config.Config, rock *rocket.RocketCon, hist *History) (*Bot, error) {
+	// The overrides may change the provider too, but the defaults have to work at least.
+	if _, err := openai.NewFromConfig(cfg); err != nil {
+		return nil, fmt.Errorf("invalid OpenAI configuration: %w", err)
+	}
+
+	b := &Bot{
+		cfg:         cfg,
+		rock:        rock,
+		hist:        hist,
+		tools:       NewToolRegistry(),
+		rooms:       make(map[string]*RoomSettings),
+		lastPrompts: make(map[string]rocket.Message),
+	}
+
+	registerBuiltinTools(b.tools, rock)
+	for _, name := range cfg.OpenAI.Tools {
+		if !b.tools.Has(name) {
+			return nil, fmt.Errorf("unknown tool: %s, available tools: %s", name, strings.Join(b.tools.Names(), ", "))
+		}
+	}
+
+	permissions := make(map[string]Permission)
+	for name, p := range cfg.Commands.Permissions {
+		permissions[name] = Permission(p)
+	}
+	b.router = NewCommandRouter(cfg.Commands.Prefix, cfg.Commands.Admins, permissions)
+	b.registerCommands()
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	return b, nil
+}
+
+// Cancel stops the requests to OpenAI in progress, the users get an error message instead of the answer.
+func (b *Bot) Cancel() {
+	b.cancel()
+}
+
+// HandleMessage responds to a message addressed to the bot, and tells the user if it has failed.
+func (b *Bot) HandleMessage(msg rocket.Message) {
+	handled, err := b.router.Route(msg)
+	if !handled {
+		b.roomsMutex.Lock()
+		b.lastPrompts[historyPlace(msg)] = msg
+		b.roomsMutex.Unlock()
+		var oa *openai.OpenAI
+		var hist *History
+		oa, hist, err = b.resolve(msg)
+		if err == nil {
+			b.seedHistory(msg, hist)
+			err = OpenAIResponse(b.ctx, msg, b.triggerPrefix(msg), oa, hist, b.tools)
+		}
+	}
+	if err != nil {
+		metrics.Errors.Inc(errorType(err))
+	}
+	if err != nil && b.ctx.Err() != nil {
+		log.WithError(err).Warn("Request canceled, the bot is shutting down.")
+		_, err = msg.Reply(fmt.Sprintf("@%s :x: Sorry, the bot is restarting and could not finish the answer. Please try again later. :x:", msg.UserName))
+		if err != nil {
+			log.WithError(err).Error("Cannot send reply about the shutdown to rocketchat.")
+		}
+	} else if err != nil {
+		log.WithError(err).Error("OpenAI request failed.")
+		_, err = msg.Reply(fmt.Sprintf("@%s :x: Sorry, something went wrong while processing your request. This could be due to a configuration issue, a problem with the OpenAI API, or a bug in the system. Please check your configuration settings or try again later. More details can be found in the logs. :x:", msg.UserName))
+		if err != nil {
+			log.WithError(err).Error("Cannot send reply about the error rocketchat.")
+		}
+	}
+}
+
+// errorType returns the type of the error for the metrics.
+func errorType(err error) string {
+	var ddpErr *rocket.DDPError
+	var restErr *rocket.RestError
+	switch {
+	case errors.Is(err, &openai.ErrorContextLengthExceeded{}):
+		return "context_length_exceeded"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &ddpErr), errors.As(err, &restErr):
+		return "rocketchat"
+	default:
+		return "other"
+	}
+}
+
+// Triggered returns true if the bot has to answer the message, according to the trigger of the room.
+func (b *Bot) Triggered(msg rocket.Message) bool {
+	if msg.IsMe {
+		return false
+	}
+	trigger := b.cfg.ResolveTrigger(msg.RoomName, msg.RoomId)
+	switch trigger.Mode {
+	case config.TriggerAll:
+		return true
+	case config.TriggerDirect:
+		return msg.IsDirect
+	case config.TriggerPrefix:
+		_, ok := cutTriggerPrefix(msg.Text, trigger.Prefix)
+		return msg.IsDirect || ok
+	default:
+		return msg.IsDirect || msg.IsMention
+	}
+}
+
+// triggerPrefix returns the prefix of the trigger of the room, which is not part of the prompt. It is empty if the
+// trigger is not a prefix.
+func (b *Bot) triggerPrefix(msg rocket.Message) string {
+	trigger := b.cfg.ResolveTrigger(msg.RoomName, msg.RoomId)
+	if trigger.Mode != config.TriggerPrefix {
+		return ""
+	}
+	return trigger.Prefix
+}
+
+// resolve returns the OpenAI client and the history with the settings of the message applied.
+func (b *Bot) resolve(msg rocket.Message) (*openai.OpenAI, *History, error) {
+	oaCfg := b.openAIConfig(msg)
+	oa, err := openai.New(oaCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create OpenAI client: %w", err)
+	}
+	return oa, b.hist.WithLimits(oaCfg), nil
+}
+
+// history returns the history with the limits that apply to the message.
+func (b *Bot) history(msg rocket.Message) *History {
+	return b.hist.WithLimits(b.openAIConfig(msg))
+}
+
+// openAIConfig returns the OpenAI settings of the room and the user of the message: the Rooms and Users overrides from
+// the configuration first, then the settings changed by commands.
+func (b *Bot) openAIConfig(msg rocket.Message) config.OpenAIConfig {
+	oaCfg, err := b.cfg.ResolveOpenAI(msg.RoomName, msg.RoomId, msg.UserName)
+	if err != nil {
+		// The overrides are validated when the configuration is loaded, so it is not expected to happen.
+		log.WithError(err).WithField("roomName", msg.RoomName).Error("Cannot resolve OpenAI settings, using the defaults.")
+		oaCfg = b.cfg.OpenAI
+	}
+
+	settings := b.room(msg.RoomId)
+	if settings.Model != "" {
+		oaCfg.Model = settings.Model
+	}
+	if settings.Persona != "" {
+		oaCfg.PrePrompt = b.cfg.Commands.Personas[settings.Persona]
+	}
+	return oaCfg
+}
+
+// seedHistory loads the recent messages of the conversation from Rocket.Chat into the history, if the bot does not
+// remember anything from it, e.g. because it is pinged in a thread for the first time.
+func (b *Bot) seedHistory(msg rocket.Message, hist *History) {
+	place := historyPlace(msg)
+	if hist.SeedSize <= 0 || len(hist.AsOpenAIMessages(place)) > 0 {
+		return
+	}
+
+	// One more, because the new message is among them.
+	var messages []rocket.Message
+	var err error
+	if msg.ThreadId != "" {
+		messages, err = b.rock.LoadThreadMessages(msg.ThreadId, hist.SeedSize+1)
+		if err == nil {
+			// The first message of the thread is not in the thread itself.
+			var first rocket.Message
+			first, err = b.rock.RequestMessage(msg.ThreadId)
+			messages = append([]rocket.Message{first}, messages...)
+		}
+	} else {
+		messages, err = b.rock.LoadHistory(msg.RoomId, hist.SeedSize+1)
+	}
+	if err != nil {
+		log.WithError(err).WithField("place", place).Warn("Cannot load the messages of the conversation from Rocket.Chat.")
+		return
+	}
+
+	seed := b.seedMessages(messages, msg)
+	if len(seed) > hist.SeedSize {
+		seed = seed[len(seed)-hist.SeedSize:]
+	}
+	if hist.Seed(place, seed) {
+		log.WithField("place", place).WithField("messages", len(seed)).Debug("History seeded from Rocket.Chat.")
+	}
+}
+
+// seedMessages converts the Rocket.Chat messages before msg to history messages. The messages of the bot are the
+// answers of the assistant, the others are prefixed with the name of the speaker, as there may be several of them.
+// Commands are left out.
+func (b *Bot) seedMessages(messages []rocket.Message, msg rocket.Message) []TimedMessage {
+	seen := make(map[string]bool)
+	seed := make([]TimedMessage, 0, len(messages))
+	for _, m := range messages {
+		if seen[m.Id] || m.Id == msg.Id || (!msg.Timestamp.IsZero() && m.Timestamp.After(msg.Timestamp)) {
+			continue
+		}
+		seen[m.Id] = true
+
+		text := strings.TrimSpace(m.Text)
+		if _, _, isCommand := b.router.parse(text, m.AmIPinged); isCommand || text == "" {
+			continue
+		}
+		if m.IsMe {
+			// The answers of the bot start with the mention of the user.
+			if strings.HasPrefix(text, "@") {
+				if i := strings.IndexAny(text, " \t\n"); i != -1 {
+					text = strings.TrimSpace(text[i:])
+				}
+			}
+			seed = append(seed, TimedMessage{
+				Message:   openai.Message{Role: "assistant", Content: text},
+				Timestamp: m.Timestamp,
+			})
+		} else {
+			seed = append(seed, TimedMessage{
+				Message:   openai.Message{Role: "user", Content: fmt.Sprintf("%s: %s", m.UserName, text)},
+				Timestamp: m.Timestamp,
+			})
+		}
+	}
+	return seed
+}
+
+// room returns a copy of the settings of the room.
+func (b *Bot) room(roomId string) RoomSettings {
+	b.roomsMutex.Lock()
+	defer b.roomsMutex.Unlock()
+	if s, ok := b.rooms[roomId]; ok {
+		return *s
+	}
+	return RoomSettings{}
+}
+
+func (b *Bot) updateRoom(roomId string, update func(s *RoomSettings)) {
+	b.roomsMutex.Lock()
+	defer b.roomsMutex.Unlock()
+	s, ok := b.rooms[roomId]
+	if !ok {
+		s = &RoomSettings{}
+		b.rooms[roomId] = s
+	}
+	update(s)
+}
+
+func (b *Bot) registerCommands() {
+	b.router.Register(&Command{
+		Name:        "help",
+		Description: "Lists the commands.",
+		MaxArgs:     0,
+		Permission:  PermissionEveryone,
+		Handler: func(cmd *CommandContext) error {
+			return cmd.Reply("Commands:\n" + b.router.Help(cmd.Msg.UserName))
+		},
+	})
+
+	b.router.Register(&Command{
+		Name:        "reset",
+		Description: "Forgets the conversation in this room or thread.",
+		MaxArgs:     0,
+		Permission:  PermissionEveryone,
+		Handler: func(cmd *CommandContext) error {
+			b.history(cmd.Msg).Clear(historyPlace(cmd.Msg))
+			return cmd.Reply(":wastebasket: The conversation has been reset.")
+		},
+	})
+
+	b.router.Register(&Command{
+		Name:        "history",
+		Description: "Shows what the bot remembers from the conversation in this room or thread.",
+		MaxArgs:     0,
+		Permission:  PermissionEveryone,
+		Handler: func(cmd *CommandContext) error {
+			messages := b.history(cmd.Msg).AsOpenAIMessages(historyPlace(cmd.Msg))
+			if len(messages) == 0 {
+				return cmd.Reply("The history is empty.")
+			}
+			lines := []string{fmt.Sprintf("The history contains %d messages:", len(messages))}
+			for _, m := range messages {
+				lines = append(lines, fmt.Sprintf("> *%s*: %s", m.Role, truncate(m.Content, 80)))
+			}
+			return cmd.Reply(strings.Join(lines, "\n"))
+		},
+	})
+
+	b.router.Register(&Command{
+		Name:        "model",
+		Usage:       "[<model>|default]",
+		Description: "Shows or changes the model used in this room.",
+		MaxArgs:     1,
+		Permission:  PermissionAdmin,
+		Handler: func(cmd *CommandContext) error {
+			if len(cmd.Args) == 0 {
+				return cmd.Reply(fmt.Sprintf("The model is %s.", b.model(cmd.Msg)))
+			}
+			model := cmd.Args[0]
+			if model == "default" {
+				model = ""
+			} else if len(b.cfg.Commands.Models) > 0 && !contains(b.cfg.Commands.Models, model) {
+				return cmd.Reply(fmt.Sprintf("Unknown model. Available models: %s", strings.Join(b.cfg.Commands.Models, ", ")))
+			}
+			b.updateRoom(cmd.Msg.RoomId, func(s *RoomSettings) {
+				s.Model = model
+			})
+			return cmd.Reply(fmt.Sprintf("The model is %s from now on.", b.model(cmd.Msg)))
+		},
+	})
+
+	b.router.Register(&Command{
+		Name:        "persona",
+		Usage:       "[<persona>|default]",
+		Description: "Lists the personas or changes the persona of the bot in this room.",
+		MaxArgs:     1,
+		Permission:  PermissionEveryone,
+		Handler: func(cmd *CommandContext) error {
+			if len(cmd.Args) == 0 {
+				names := make([]string, 0, len(b.cfg.Commands.Personas))
+				for name := range b.cfg.Commands.Personas {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				current := b.room(cmd.Msg.RoomId).Persona
+				if current == "" {
+					current = "default"
+				}
+				return cmd.Reply(fmt.Sprintf("The persona is %s. Available personas: default, %s", current, strings.Join(names, ", ")))
+			}
+			persona := strings.ToLower(cmd.Args[0])
+			if persona == "default" {
+				persona = ""
+			} else if _, ok := b.cfg.Commands.Personas[persona]; !ok {
+				return cmd.Reply(fmt.Sprintf("Unknown persona: %s", persona))
+			}
+			b.updateRoom(cmd.Msg.RoomId, func(s *RoomSettings) {
+				s.Persona = persona
+			})
+			// The earlier answers were given in a different character, they would confuse the model.
+			b.history(cmd.Msg).Clear(historyPlace(cmd.Msg))
+			return cmd.Reply(fmt.Sprintf("The persona has been changed to %s, and the conversation has been reset.", cmd.Args[0]))
+		},
+	})
+
+	b.router.Register(&Command{
+		Name:        "image",
+		Usage:       "<prompt>",
+		Description: "Generates an image from the prompt.",
+		MinArgs:     1,
+		MaxArgs:     -1,
+		Permission:  PermissionEveryone,
+		Handler: func(cmd *CommandContext) error {
+			oa, _, err := b.resolve(cmd.Msg)
+			if err != nil {
+				return err
+			}
+			return ImageResponse(b.ctx, cmd.Msg, oa, strings.Join(cmd.Args, " "))
+		},
+	})
+
+	b.router.Register(&Command{
+		Name:        "retry",
+		Description: "Asks again the last question in this room or thread, replacing the last answer in the history.",
+		MaxArgs:     0,
+		Permission:  PermissionEveryone,
+		Handler: func(cmd *CommandContext) error {
+			b.roomsMutex.Lock()
+			last, ok := b.lastPrompts[historyPlace(cmd.Msg)]
+			b.roomsMutex.Unlock()
+			if !ok {
+				return cmd.Reply("There is nothing to retry.")
+			}
+			oa, hist, err := b.resolve(last)
+			if err != nil {
+				return err
+			}
+			hist.DropLastTurn(historyPlace(last))
+			return OpenAIResponse(b.ctx, last, b.triggerPrefix(last), oa, hist, b.tools)
+		},
+	})
+}
+
+// model returns the model used for the message.
+func (b *Bot) model(msg rocket.Message) string {
+	return b.openAIConfig(msg).Model
+}
+
+func truncate(s string, length int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	r := []rune(s)
+	if len(r) <= length {
+		return s
+	}
+	return string(r[:length]) + "…"
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
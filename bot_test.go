@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeedMessages(t *testing.T) {
+	b := &Bot{router: NewCommandRouter("!", nil, nil)}
+	start := time.Now().Add(-time.Hour)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	msg := rocket.Message{Id: "5", UserName: "alice", Text: "@bot what do you think?", Timestamp: at(5)}
+	messages := []rocket.Message{
+		{Id: "1", UserName: "alice", Text: "Shall we use tabs or spaces?", Timestamp: at(1)},
+		{Id: "1", UserName: "alice", Text: "Shall we use tabs or spaces?", Timestamp: at(1)},
+		{Id: "2", UserName: "bob", Text: "Spaces, obviously.", Timestamp: at(2)},
+		{Id: "3", UserName: "bob", Text: "@bot !reset", IsMention: true, AmIPinged: true, Timestamp: at(3)},
+		{Id: "4", UserName: "bot", IsMe: true, Text: "@bob Tabs.", Timestamp: at(4)},
+		msg,
+		{Id: "6", UserName: "bob", Text: "Too late.", Timestamp: at(6)},
+	}
+
+	assert.Equal(t, []TimedMessage{
+		{Message: openai.Message{Role: "user", Content: "alice: Shall we use tabs or spaces?"}, Timestamp: at(1)},
+		{Message: openai.Message{Role: "user", Content: "bob: Spaces, obviously."}, Timestamp: at(2)},
+		{Message: openai.Message{Role: "assistant", Content: "Tabs."}, Timestamp: at(4)},
+	}, b.seedMessages(messages, msg))
+}
+
+func TestTriggered(t *testing.T) {
+	var cfg config.Config
+	cfg.Rooms = []config.Override{
+		{Match: "random", Trigger: &config.Trigger{Mode: config.TriggerAll}},
+		{Match: "dm-only", Trigger: &config.Trigger{Mode: config.TriggerDirect}},
+		{Match: "prefixed", Trigger: &config.Trigger{Mode: config.TriggerPrefix, Prefix: "Bot,"}},
+	}
+	b := &Bot{cfg: &cfg}
+
+	assert.True(t, b.Triggered(rocket.Message{RoomName: "general", IsMention: true}))
+	assert.True(t, b.Triggered(rocket.Message{RoomName: "alice", IsDirect: true}))
+	assert.False(t, b.Triggered(rocket.Message{RoomName: "general", Text: "hello"}))
+	assert.False(t, b.Triggered(rocket.Message{RoomName: "general", IsMention: true, IsMe: true}))
+
+	assert.True(t, b.Triggered(rocket.Message{RoomName: "random", Text: "hello"}))
+	assert.False(t, b.Triggered(rocket.Message{RoomName: "dm-only", IsMention: true}))
+
+	assert.True(t, b.Triggered(rocket.Message{RoomName: "prefixed", Text: " bot, hello"}))
+	assert.False(t, b.Triggered(rocket.Message{RoomName: "prefixed", Text: "hello bot,", IsMention: true}))
+}
+
+func TestErrorType(t *testing.T) {
+	wrap := func(err error) error { return fmt.Errorf("cannot perform completion request: %w", err) }
+	assert.Equal(t, "context_length_exceeded", errorType(wrap(openai.NewErrorContextLengthExceeded("too long"))))
+	assert.Equal(t, "canceled", errorType(wrap(context.Canceled)))
+	assert.Equal(t, "timeout", errorType(wrap(context.DeadlineExceeded)))
+	assert.Equal(t, "rocketchat", errorType(wrap(&rocket.RestError{StatusCode: 403})))
+	assert.Equal(t, "rocketchat", errorType(wrap(&rocket.DDPError{Reason: "Invalid room"})))
+	assert.Equal(t, "other", errorType(errors.New("something else")))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Calculate evaluates an arithmetic expression, e.g. "2 * (3 + sqrt(16)) ^ 2". It supports + - * / % ^, parentheses,
+// the constants pi and e, and some functions of one argument.
+func Calculate(expression string) (float64, error) {
+	p := &calcParser{input: []rune(expression)}
+	v, err := p.expression()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("the result is not a finite number")
+	}
+	return v, nil
+}
+
+var calcFunctions = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"sqrt":  math.Sqrt,
+	"cbrt":  math.Cbrt,
+	"exp":   math.Exp,
+	"ln":    math.Log,
+	"log":   math.Log10,
+	"log2":  math.Log2,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"asin":  math.Asin,
+	"acos":  math.Acos,
+	"atan":  math.Atan,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"round": math.Round,
+}
+
+var calcConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// calcParser is a recursive descent parser, one method per precedence level.
+type calcParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *calcParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// accept consumes the next non-space character if it is one of the chars.
+func (p *calcParser) accept(chars string) (rune, bool) {
+	p.skipSpace()
+	if p.pos < len(p.input) && strings.ContainsRune(chars, p.input[p.pos]) {
+		p.pos++
+		return p.input[p.pos-1], true
+	}
+	return 0, false
+}
+
+func (p *calcParser) expression() (float64, error) {
+	v, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, ok := p.accept("+-")
+		if !ok {
+			return v, nil
+		}
+		w, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			v += w
+		} else {
+			v -= w
+		}
+	}
+}
+
+func (p *calcParser) term() (float64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, ok := p.accept("*/%")
+		if !ok {
+			return v, nil
+		}
+		w, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			v *= w
+		case '/':
+			if w == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			v /= w
+		case '%':
+			if w == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			v = math.Mod(v, w)
+		}
+	}
+}
+
+func (p *calcParser) unary() (float64, error) {
+	if op, ok := p.accept("+-"); ok {
+		v, err := p.unary()
+		if op == '-' {
+			v = -v
+		}
+		return v, err
+	}
+	return p.power()
+}
+
+// power is right associative, and binds stronger than the unary minus on its left, so -2^2 is -4.
+func (p *calcParser) power() (float64, error) {
+	v, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := p.accept("^"); ok {
+		w, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		v = math.Pow(v, w)
+	}
+	return v, nil
+}
+
+func (p *calcParser) primary() (float64, error) {
+	if _, ok := p.accept("("); ok {
+		v, err := p.expression()
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		return v, nil
+	}
+
+	p.skipSpace()
+	start := p.pos
+	if p.pos < len(p.input) && unicode.IsLetter(p.input[p.pos]) {
+		for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos])) {
+			p.pos++
+		}
+		name := strings.ToLower(string(p.input[start:p.pos]))
+		if c, ok := calcConstants[name]; ok {
+			return c, nil
+		}
+		f, ok := calcFunctions[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown function or constant: %s", name)
+		}
+		if _, ok := p.accept("("); !ok {
+			return 0, fmt.Errorf("missing parenthesis after %s", name)
+		}
+		v, err := p.expression()
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		return f(v), nil
+	}
+
+	for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	// Exponent, e.g. 1.5e3
+	if p.pos > start && p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+		end := p.pos + 1
+		if end < len(p.input) && (p.input[end] == '+' || p.input[end] == '-') {
+			end++
+		}
+		if end < len(p.input) && unicode.IsDigit(p.input[end]) {
+			for end < len(p.input) && unicode.IsDigit(p.input[end]) {
+				end++
+			}
+			p.pos = end
+		}
+	}
+	if p.pos == start {
+		if p.pos >= len(p.input) {
+			return 0, fmt.Errorf("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	v, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number: %s", string(p.input[start:p.pos]))
+	}
+	return v, nil
+}
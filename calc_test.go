@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculate(t *testing.T) {
+	for expression, expected := range map[string]float64{
+		"1 + 2 * 3":           7,
+		"(1 + 2) * 3":         9,
+		"10 / 4":              2.5,
+		"10 % 4":              2,
+		"2 ^ 3 ^ 2":           512,
+		"-2^2":                -4,
+		"2 * -3":              -6,
+		"sqrt(16) + abs(-2)":  6,
+		"1.5e3 / 3":           500,
+		"round(pi * 100)":     314,
+		"log(1000) + ln(e)":   4,
+		" 2 * ( 3 + 4 ) - 1 ": 13,
+	} {
+		v, err := Calculate(expression)
+		assert.NoError(t, err, expression)
+		assert.InDelta(t, expected, v, 1e-9, expression)
+	}
+
+	for _, expression := range []string{"", "1 +", "(1 + 2", "1 / 0", "foo(1)", "2 3", "sqrt(-1)", "1 $ 2"} {
+		_, err := Calculate(expression)
+		assert.Error(t, err, expression)
+	}
+
+	v, err := Calculate("2 ^ 0.5")
+	assert.NoError(t, err)
+	assert.InDelta(t, math.Sqrt2, v, 1e-9)
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mimrock/rocketchat_openai_bot/openai"
 	"github.com/mimrock/rocketchat_openai_bot/rocket"
@@ -30,37 +35,62 @@ func DemoResponse(msg rocket.Message) {
 	msg.React(":grinning:")
 }
 
-func OpenAIResponse(rocketmsg rocket.Message, oa *openai.OpenAI, hist *History) error {
+// historyPlace returns the key of the history the message belongs to. Each thread has its own history, separate from
+// the history of the main channel of the room. The key is built from the room id, since the names of rooms are not
+// unique, e.g. a direct message room is named after the user.
+func historyPlace(msg rocket.Message) string {
+	if thread := msg.ReplyThreadId(); thread != "" {
+		return msg.RoomId + "/" + thread
+	}
+	return msg.RoomId
+}
+
+// OpenAIResponse answers the message with the help of OpenAI. The triggerPrefix is removed from the prompt, see
+// extractPrompt. The model may call the tools enabled in oa.Tools, tools can be nil if no tools are available. The requests to OpenAI and the replies to Rocket.Chat are canceled when ctx is done.
+func OpenAIResponse(ctx context.Context, rocketmsg rocket.Message, triggerPrefix string, oa *openai.OpenAI, hist *History, tools *ToolRegistry) error {
 	msg := openai.Message{
 		Role:    "user",
-		Content: rocketmsg.GetNotAddressedText(),
+		Content: promptText(rocketmsg, triggerPrefix),
 	}
 	rocketmsg.SetIsTyping(true)
 	defer func() {
 		rocketmsg.SetIsTyping(false)
 	}()
 
-	place := rocketmsg.RoomName
+	var transcript string
+	if oa.Transcription.Enabled {
+		var err error
+		transcript, err = transcribe(ctx, rocketmsg, oa)
+		if err != nil {
+			return fmt.Errorf("cannot transcribe audio: %w", err)
+		}
+		if transcript != "" {
+			if strings.TrimSpace(msg.Content) == "" {
+				msg.Content = transcript
+			} else {
+				msg.Content += "\n\n" + transcript
+			}
+		}
+	}
 
-	if oa.InputModeration {
-		// Send the input to the OpenAI moderation endpoint, and if it is flagged, return an error instead of sending anything to the completion endpoint.
-		mresp, err := oa.Moderation(&openai.ModerationRequest{
-			Input: rocketmsg.GetNotAddressedText(),
-		})
+	if oa.Vision {
+		parts, err := imageParts(ctx, rocketmsg, oa)
 		if err != nil {
-			return fmt.Errorf("cannot perform perliminary request to the moderation endpoint: %w", err)
+			return fmt.Errorf("cannot attach images: %w", err)
 		}
+		msg.Parts = parts
+	}
 
-		log.WithField("moderationResponse", mresp).Debug("Preliminary (input) moderation response.")
+	place := historyPlace(rocketmsg)
 
-		if mresp.IsFlagged() {
-			// @todo configurable message?
-			_, err = rocketmsg.Reply(fmt.Sprintf("@%s :triangular_flag_on_post: Our bot uses OpenAI's moderation system, which flagged your message as inappropriate. Please try rephrasing your message to avoid any offensive or inappropriate content. REASON: %s :triangular_flag_on_post:",
-				rocketmsg.UserName, mresp.FlaggedReason()))
-			if err != nil {
-				return fmt.Errorf("cannot send reply to rocketchat: %w", err)
-			}
-			return nil
+	if flagged, err := moderateInput(ctx, rocketmsg, oa, msg.Content); err != nil || flagged {
+		return err
+	}
+
+	// The transcript is only quoted once it has passed the moderation.
+	if transcript != "" && oa.Transcription.Echo {
+		if _, err := rocketmsg.ReplyContext(ctx, fmt.Sprintf("@%s :studio_microphone: %s", rocketmsg.UserName, quote(transcript))); err != nil {
+			return fmt.Errorf("cannot send reply to rocketchat: %w", err)
 		}
 	}
 
@@ -74,7 +104,10 @@ func OpenAIResponse(rocketmsg rocket.Message, oa *openai.OpenAI, hist *History)
 	if len(oa.PrePrompt) > 0 {
 		messages = append(messages, systemMessage)
 	}
-	messages = append(messages, hist.AsOpenAIMessages(place)...)
+
+	// The history gets whatever is left from the context window after the preprompt, the new message and the answer.
+	budget := oa.HistoryBudget(append(messages, msg))
+	messages = append(messages, hist.AsOpenAIMessagesWithin(place, oa.Model, budget)...)
 
 	messages = append(messages, msg)
 
@@ -82,27 +115,53 @@ func OpenAIResponse(rocketmsg rocket.Message, oa *openai.OpenAI, hist *History)
 	if oa.SendUserId {
 		OAUserid = rocketmsg.UserId
 	}
-	cresp, err := oa.Completion(oa.NewCompletionRequest(messages, OAUserid))
-	if err != nil {
-		if errors.Is(err, &openai.ErrorContextLengthExceeded{}) {
-			// If the reason for the error is context_length_exceeded, we clear history, so it does not happen on the next comment.
-			hist.Clear(place)
-			log.Debug("To prevent context_length_exceeded error to happen repeatedly, the history has been cleared.")
-		}
-		return fmt.Errorf("cannot perform completion request: %w", err)
+	cReq := oa.NewCompletionRequest(messages, OAUserid)
+	if tools != nil {
+		cReq.Tools = tools.Definitions(oa.Tools)
 	}
 
-	if len(cresp.Choices) == 0 {
-		return fmt.Errorf("no choices returned")
-	}
+	// The model may call tools several times, each time the results are sent back to it, until it gives an answer.
+	var choice openai.Choice
+	var err error
+	var reply *rocket.Message
+	for i := 0; ; i++ {
+		if len(cReq.Tools) > 0 && i >= oa.MaxToolIterations {
+			// The model had enough chances to call tools, now it has to answer.
+			cReq.ToolChoice = "none"
+		}
+		// A streamed answer would be shown before the output moderation could check it.
+		if oa.Stream && !oa.OutputModeration {
+			choice, reply, err = streamCompletion(ctx, rocketmsg, oa, cReq, reply)
+		} else {
+			choice, err = completion(ctx, oa, cReq)
+		}
+		if err != nil {
+			if errors.Is(err, &openai.ErrorContextLengthExceeded{}) {
+				// If the reason for the error is context_length_exceeded, we clear history, so it does not happen on the next comment.
+				hist.Clear(place)
+				log.Debug("To prevent context_length_exceeded error to happen repeatedly, the history has been cleared.")
+			}
+			return fmt.Errorf("cannot perform completion request: %w", err)
+		}
+		if len(choice.Message.ToolCalls) == 0 || len(cReq.Tools) == 0 || cReq.ToolChoice == "none" {
+			break
+		}
 
-	log.WithField("completionResponse", cresp).Trace("Completion response.")
+		cReq.Messages = append(cReq.Messages, choice.Message)
+		for _, call := range choice.Message.ToolCalls {
+			cReq.Messages = append(cReq.Messages, tools.Call(rocketmsg, oa.Tools, call))
+		}
+	}
+	content := choice.Message.Content
+	if choice.FinishReason == openai.FinishReasonLength {
+		content = continueAnswer(ctx, oa, cReq, content)
+	}
 
 	var response string
 	var mresp *openai.ModerationResponse
 	if oa.OutputModeration {
-		mresp, err = oa.Moderation(&openai.ModerationRequest{
-			Input: cresp.Choices[0].Message.Content,
+		mresp, err = oa.ModerationContext(ctx, &openai.ModerationRequest{
+			Input: content,
 		})
 		if err != nil {
 			return fmt.Errorf("cannot perform follow-up request to the moderation endpoint (output check): %w", err)
@@ -117,21 +176,359 @@ func OpenAIResponse(rocketmsg rocket.Message, oa *openai.OpenAI, hist *History)
 
 	}
 
-	response += cresp.Choices[0].Message.Content
+	response += content
 
-	// @todo further calls if finishReason indicates that the response is not completed.
-	_, err = rocketmsg.Reply(fmt.Sprintf("@%s %s", rocketmsg.UserName, response))
+	text := fmt.Sprintf("@%s %s", rocketmsg.UserName, response)
+	if reply != nil {
+		// A long answer is sent in several messages, the streamed reply becomes the first one.
+		parts := rocket.SplitText(text, rocketmsg.MaxMessageSize())
+		err = reply.EditTextContext(ctx, parts[0])
+		for _, part := range parts[1:] {
+			if err != nil {
+				break
+			}
+			_, err = rocketmsg.ReplyContext(ctx, part)
+		}
+	} else {
+		_, err = rocketmsg.ReplyContext(ctx, text)
+	}
 	if err != nil {
 		return fmt.Errorf("cannot send reply to rocketchat: %w", err)
 	}
 
 	if mresp == nil || !mresp.IsFlagged() {
-		hist.Add(place, msg)
+		// The images are not kept, they would be sent again with every request.
+		hist.Add(place, openai.Message{
+			Role:    msg.Role,
+			Content: msg.Content,
+		})
 		hist.Add(place, openai.Message{
 			Role:    "assistant",
-			Content: cresp.Choices[0].Message.Content,
+			Content: content,
 		})
 	}
 
 	return nil
 }
+
+// ImageResponse generates an image from the prompt, and uploads it as a reply to the message. The requests are canceled
+// when ctx is done.
+func ImageResponse(ctx context.Context, rocketmsg rocket.Message, oa *openai.OpenAI, prompt string) error {
+	rocketmsg.SetIsTyping(true)
+	defer func() {
+		rocketmsg.SetIsTyping(false)
+	}()
+
+	if flagged, err := moderateInput(ctx, rocketmsg, oa, prompt); err != nil || flagged {
+		return err
+	}
+
+	OAUserid := ""
+	if oa.SendUserId {
+		OAUserid = rocketmsg.UserId
+	}
+	iresp, err := oa.ImageGenerationContext(ctx, oa.NewImageGenerationRequest(prompt, OAUserid))
+	if err != nil {
+		return fmt.Errorf("cannot perform image generation request: %w", err)
+	}
+	image := iresp.Data[0]
+	data, err := image.Decode()
+	if err != nil {
+		return fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	description := fmt.Sprintf("@%s %s", rocketmsg.UserName, prompt)
+	if image.RevisedPrompt != "" && image.RevisedPrompt != prompt {
+		description += quote(image.RevisedPrompt)
+	}
+	_, err = rocketmsg.ReplyFileContext(ctx, imageFileName(data), data, description)
+	if err != nil {
+		return fmt.Errorf("cannot upload image to rocketchat: %w", err)
+	}
+	return nil
+}
+
+// imageFileName returns a file name with the extension of the image format.
+func imageFileName(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return "image.jpg"
+	case "image/webp":
+		return "image.webp"
+	case "image/gif":
+		return "image.gif"
+	default:
+		return "image.png"
+	}
+}
+
+// moderateInput sends the input to the OpenAI moderation endpoint if InputModeration is enabled. If the input is
+// flagged, the user is told so, and true is returned, so nothing is sent to the other endpoints.
+func moderateInput(ctx context.Context, rocketmsg rocket.Message, oa *openai.OpenAI, input string) (bool, error) {
+	if !oa.InputModeration {
+		return false, nil
+	}
+
+	mresp, err := oa.ModerationContext(ctx, &openai.ModerationRequest{
+		Input: input,
+	})
+	if err != nil {
+		return false, fmt.Errorf("cannot perform perliminary request to the moderation endpoint: %w", err)
+	}
+
+	log.WithField("moderationResponse", mresp).Debug("Preliminary (input) moderation response.")
+
+	if !mresp.IsFlagged() {
+		return false, nil
+	}
+	// @todo configurable message?
+	_, err = rocketmsg.ReplyContext(ctx, fmt.Sprintf("@%s :triangular_flag_on_post: Our bot uses OpenAI's moderation system, which flagged your message as inappropriate. Please try rephrasing your message to avoid any offensive or inappropriate content. REASON: %s :triangular_flag_on_post:",
+		rocketmsg.UserName, mresp.FlaggedReason()))
+	if err != nil {
+		return true, fmt.Errorf("cannot send reply to rocketchat: %w", err)
+	}
+	return true, nil
+}
+
+// supportedImageTypes are the image formats accepted by OpenAI.
+var supportedImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// imageParts downloads the images attached to the message, and returns them as content parts. Images that are too
+// large, of an unsupported format or cannot be downloaded are left out.
+func imageParts(ctx context.Context, rocketmsg rocket.Message, oa *openai.OpenAI) ([]openai.ContentPart, error) {
+	var parts []openai.ContentPart
+	for _, a := range rocketmsg.Attachments {
+		if !a.IsImage() {
+			continue
+		}
+		logger := log.WithField("image", a.ImageURL)
+		if a.ImageType != "" && !contains(supportedImageTypes, a.ImageType) {
+			logger.WithField("type", a.ImageType).Info("Unsupported image type, it is not sent to OpenAI.")
+			continue
+		}
+		if a.ImageSize > oa.MaxImageSize {
+			logger.WithField("size", a.ImageSize).Info("The image is too large, it is not sent to OpenAI.")
+			continue
+		}
+
+		data, contentType, err := rocketmsg.DownloadFileContext(ctx, a.ImageURL, oa.MaxImageSize)
+		if errors.Is(err, rocket.ErrFileTooLarge) {
+			logger.Info("The image is too large, it is not sent to OpenAI.")
+			continue
+		}
+		if err != nil {
+			// E.g. the image of a link preview is not on the server, the rest of the message can be answered anyway.
+			logger.WithError(err).Warn("Cannot download the image, it is not sent to OpenAI.")
+			continue
+		}
+		if a.ImageType != "" {
+			contentType = a.ImageType
+		}
+		contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+		if !contains(supportedImageTypes, contentType) {
+			logger.WithField("type", contentType).Info("Unsupported image type, it is not sent to OpenAI.")
+			continue
+		}
+		parts = append(parts, openai.NewImagePart(contentType, data, oa.ImageDetail))
+	}
+	return parts, nil
+}
+
+// audioExtensions are the file extensions of the audio types, OpenAI recognises the format by the extension.
+var audioExtensions = map[string]string{
+	"audio/mpeg":   ".mp3",
+	"audio/mp3":    ".mp3",
+	"audio/mp4":    ".m4a",
+	"audio/m4a":    ".m4a",
+	"audio/x-m4a":  ".m4a",
+	"audio/wav":    ".wav",
+	"audio/x-wav":  ".wav",
+	"audio/wave":   ".wav",
+	"audio/webm":   ".webm",
+	"audio/ogg":    ".ogg",
+	"audio/flac":   ".flac",
+	"audio/x-flac": ".flac",
+}
+
+// transcribe downloads the audio files attached to the message and converts them to text. Files that are too large, of
+// a type which is not allowed or cannot be downloaded are left out.
+func transcribe(ctx context.Context, rocketmsg rocket.Message, oa *openai.OpenAI) (string, error) {
+	var transcripts []string
+	for _, a := range rocketmsg.Attachments {
+		if !a.IsAudio() {
+			continue
+		}
+		logger := log.WithField("audio", a.AudioURL)
+		if !contains(oa.Transcription.Types, a.AudioType) {
+			logger.WithField("type", a.AudioType).Info("The type of the audio is not allowed, it is not transcribed.")
+			continue
+		}
+		if a.AudioSize > oa.Transcription.MaxSize {
+			logger.WithField("size", a.AudioSize).Info("The audio is too large, it is not transcribed.")
+			continue
+		}
+
+		data, _, err := rocketmsg.DownloadFileContext(ctx, a.AudioURL, oa.Transcription.MaxSize)
+		if errors.Is(err, rocket.ErrFileTooLarge) {
+			logger.Info("The audio is too large, it is not transcribed.")
+			continue
+		}
+		if err != nil {
+			logger.WithError(err).Warn("Cannot download the audio, it is not transcribed.")
+			continue
+		}
+
+		fileName := a.Title
+		if ext := audioExtensions[a.AudioType]; ext != "" && !strings.HasSuffix(strings.ToLower(fileName), ext) {
+			fileName = "audio" + ext
+		}
+		tresp, err := oa.TranscribeContext(ctx, &openai.TranscriptionRequest{
+			FileName: fileName,
+			File:     data,
+			Model:    oa.Transcription.Model,
+			Language: oa.Transcription.Language,
+		})
+		if err != nil {
+			return "", err
+		}
+		logger.WithField("transcript", tresp.Text).Debug("Audio transcribed.")
+		if text := strings.TrimSpace(tresp.Text); text != "" {
+			transcripts = append(transcripts, text)
+		}
+	}
+	return strings.Join(transcripts, "\n\n"), nil
+}
+
+// quote formats the text as a quote in Rocket.Chat.
+func quote(text string) string {
+	return "\n> " + strings.ReplaceAll(text, "\n", "\n> ")
+}
+
+// completion performs a completion request and returns the first choice.
+func completion(ctx context.Context, oa *openai.OpenAI, cReq *openai.CompletionRequest) (openai.Choice, error) {
+	cresp, err := oa.CompletionContext(ctx, cReq)
+	if err != nil {
+		return openai.Choice{}, err
+	}
+
+	if len(cresp.Choices) == 0 {
+		return openai.Choice{}, fmt.Errorf("no choices returned")
+	}
+
+	log.WithField("completionResponse", cresp).Trace("Completion response.")
+	return cresp.Choices[0], nil
+}
+
+// continuePrompt asks the model to continue an answer that was cut off.
+const continuePrompt = "Your answer was cut off. Continue it exactly where it ended, without repeating anything."
+
+// continueAnswer asks the model to continue the answer that was cut off at the token limit, at most
+// oa.MaxContinuations times, or until the answer reaches oa.MaxAnswerTokens. It returns the parts stitched together.
+// If a continuation fails, the answer is returned as far as it got.
+func continueAnswer(ctx context.Context, oa *openai.OpenAI, cReq *openai.CompletionRequest, content string) string {
+	req := *cReq
+	req.Stream = false
+	req.StreamOptions = nil
+	if len(req.Tools) > 0 {
+		req.ToolChoice = "none"
+	}
+	for i := 0; i < oa.MaxContinuations; i++ {
+		if oa.MaxAnswerTokens > 0 && openai.CountTokens(oa.Model, content) >= oa.MaxAnswerTokens {
+			log.WithField("maxAnswerTokens", oa.MaxAnswerTokens).Info("The answer is cut off, it reached MaxAnswerTokens.")
+			return content
+		}
+		req.Messages = append(append([]openai.Message(nil), cReq.Messages...),
+			openai.Message{Role: "assistant", Content: content},
+			openai.Message{Role: "user", Content: continuePrompt},
+		)
+		choice, err := completion(ctx, oa, &req)
+		if err != nil {
+			log.WithError(err).Warn("Cannot continue the answer, it is sent as it is.")
+			return content
+		}
+		content += choice.Message.Content
+		if choice.FinishReason != openai.FinishReasonLength {
+			return content
+		}
+		log.WithField("continuation", i+1).Debug("The continuation of the answer is cut off too.")
+	}
+	return content
+}
+
+// streamCompletion performs a streamed completion request. The answer is posted as a reply as soon as the first delta
+// arrives, then the reply is edited while the rest of the answer comes in, at most once every oa.StreamInterval. The
+// reply is returned, so it can be updated with the final text once the stream ends. If reply is not nil, it is edited
+// instead of posting a new one.
+func streamCompletion(ctx context.Context, rocketmsg rocket.Message, oa *openai.OpenAI, cReq *openai.CompletionRequest, reply *rocket.Message) (openai.Choice, *rocket.Message, error) {
+	stream, err := oa.CompletionStreamContext(ctx, cReq)
+	if err != nil {
+		return openai.Choice{}, reply, err
+	}
+	defer stream.Close()
+
+	var answer openai.Choice
+	var lastEdit time.Time
+	var shown int // The length of the content when the reply was last updated.
+	var preview string
+	var hasChoices bool
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return answer, reply, fmt.Errorf("cannot read completion stream: %w", err)
+		}
+		log.WithField("completionChunk", chunk).Trace("Completion chunk.")
+
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		hasChoices = true
+		answer.Message.AppendDelta(chunk.Choices[0].Delta)
+		if chunk.Choices[0].FinishReason != "" {
+			answer.FinishReason = chunk.Choices[0].FinishReason
+		}
+
+		if len(answer.Message.Content) == shown || time.Since(lastEdit) < oa.StreamInterval {
+			continue
+		}
+		text := streamPreview(fmt.Sprintf("@%s %s", rocketmsg.UserName, answer.Message.Content), rocketmsg.MaxMessageSize())
+		shown = len(answer.Message.Content)
+		if text == preview {
+			// The preview is already truncated, the rest is sent when the stream ends.
+			continue
+		}
+		if reply == nil {
+			r, err := rocketmsg.ReplyContext(ctx, text)
+			if err != nil {
+				return answer, nil, fmt.Errorf("cannot send reply to rocketchat: %w", err)
+			}
+			reply = &r
+		} else if err := reply.EditTextContext(ctx, text); err != nil {
+			// The next update or the final text may still succeed, so it is not worth to give up here.
+			log.WithError(err).Warn("Cannot update the streamed reply.")
+		}
+		lastEdit = time.Now()
+		preview = text
+	}
+
+	if !hasChoices {
+		return answer, reply, fmt.Errorf("no choices returned")
+	}
+	return answer, reply, nil
+}
+
+// streamPreviewMarker is appended to the reply while the answer is streamed.
+const streamPreviewMarker = " …"
+
+// streamPreview returns the text of the reply while the answer is streamed. It is truncated to maxSize characters, since
+// Rocket.Chat rejects longer messages. The whole answer is split into several messages when the stream ends.
+func streamPreview(text string, maxSize int) string {
+	limit := maxSize - utf8.RuneCountInString(streamPreviewMarker)
+	if limit > 0 && utf8.RuneCountInString(text) > limit {
+		runes := []rune(text)
+		text = string(runes[:limit])
+	}
+	return text + streamPreviewMarker
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryPlace(t *testing.T) {
+	assert.Equal(t, "r1", historyPlace(rocket.Message{Id: "m1", RoomId: "r1", RoomName: "general"}))
+	assert.Equal(t, "r1/m0", historyPlace(rocket.Message{Id: "m1", RoomId: "r1", RoomName: "general", ThreadId: "m0"}))
+	// Rooms with the same name have separate histories.
+	assert.NotEqual(t, historyPlace(rocket.Message{RoomId: "r1", RoomName: "alice"}), historyPlace(rocket.Message{RoomId: "r2", RoomName: "alice"}))
+}
+
+func TestStreamPreview(t *testing.T) {
+	assert.Equal(t, "@alice Hello …", streamPreview("@alice Hello", 50))
+	// A long answer is truncated, so the reply can still be edited.
+	preview := streamPreview("@alice "+strings.Repeat("á", 100), 50)
+	assert.Equal(t, 50, utf8.RuneCountInString(preview))
+	assert.True(t, strings.HasSuffix(preview, "áá …"))
+}
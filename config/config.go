@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -17,22 +18,152 @@ type Config struct {
 		HostName  string `yaml:"HostName"`
 		SSL       bool   `yaml:"SSL"`
 		Port      uint16 `yaml:"Port"`
+		// AlwaysThread makes the bot answer in a thread started from the message, instead of the main channel.
+		AlwaysThread bool `yaml:"AlwaysThread"`
 	} `yaml:"RocketChat"`
-	OpenAI struct {
-		HostName           string         `yaml:"HostName"`
-		ApiToken           string         `yaml:"ApiToken"`
-		CompletionEndpoint string         `yaml:"CompletionEndpoint"`
-		ModerationEndpoint string         `yaml:"ModerationEndpoint"`
-		Model              string         `yaml:"Model"`
-		HistorySize        int            `yaml:"HistorySize"`
-		HistoryMaxLength   int            `yaml:"HistoryMaxLength"`
-		MessageRetention   *time.Duration `yaml:"MessageRetention,omitempty"`
-		PrePrompt          string         `yaml:"PrePrompt"`
-		InputModeration    bool           `yaml:"InputModeration"`
-		OutputModeration   bool           `yaml:"OutputModeration"`
-		SendUserId         bool           `yaml:"SendUserId"`
-		ModelParams        ModelParams    `yaml:"ModelParams,omitempty"`
-	} `yaml:"OpenAI"`
+	OpenAI OpenAIConfig `yaml:"OpenAI"`
+	// Rooms and Users override the OpenAI settings in the matching rooms and for the matching users.
+	Rooms        []Override `yaml:"Rooms"`
+	Users        []Override `yaml:"Users"`
+	HistoryStore struct {
+		Type string `yaml:"Type"`
+		Path string `yaml:"Path"`
+	} `yaml:"HistoryStore"`
+	Commands struct {
+		Prefix string   `yaml:"Prefix"`
+		Admins []string `yaml:"Admins"`
+		// Permissions by command name: everyone, admin or disabled.
+		Permissions map[string]string `yaml:"Permissions"`
+		// Models that can be selected with the model command. If empty, any model can be selected.
+		Models []string `yaml:"Models"`
+		// Personas by name, the value is used as the preprompt.
+		Personas map[string]string `yaml:"Personas"`
+	} `yaml:"Commands"`
+	// Trigger decides which messages the bot answers, it can be overridden by room in Rooms.
+	Trigger    Trigger `yaml:"Trigger"`
+	Dispatcher struct {
+		Workers     int `yaml:"Workers"`
+		QueueSize   int `yaml:"QueueSize"`
+		NoticeAfter int `yaml:"NoticeAfter"`
+		// ShutdownTimeout is how long the answers in progress may take when the bot is stopped, before they are
+		// canceled.
+		ShutdownTimeout time.Duration `yaml:"ShutdownTimeout"`
+	} `yaml:"Dispatcher"`
+	Metrics struct {
+		// Listen is the address of the HTTP listener of the metrics, e.g. :9090. If empty, the metrics are not served.
+		Listen string `yaml:"Listen"`
+	} `yaml:"Metrics"`
+	Tokenizer struct {
+		// Dir is the directory of the BPE ranks, cl100k_base.tiktoken and o200k_base.tiktoken. If empty, the tokens
+		// are estimated.
+		Dir string `yaml:"Dir"`
+	} `yaml:"Tokenizer"`
+	openAIRaw interface{}
+}
+
+type OpenAIConfig struct {
+	// Provider is openai, azure or compatible.
+	Provider           string            `yaml:"Provider"`
+	HostName           string            `yaml:"HostName"`
+	ApiToken           string            `yaml:"ApiToken"`
+	BaseURL            string            `yaml:"BaseURL"`
+	Scheme             string            `yaml:"Scheme"`
+	AuthHeader         string            `yaml:"AuthHeader"`
+	AuthPrefix         string            `yaml:"AuthPrefix"`
+	ApiVersion         string            `yaml:"ApiVersion"`
+	Deployments        map[string]string `yaml:"Deployments"`
+	CompletionEndpoint string            `yaml:"CompletionEndpoint"`
+	ModerationEndpoint string            `yaml:"ModerationEndpoint"`
+	Model              string            `yaml:"Model"`
+	HistorySize        int               `yaml:"HistorySize"`
+	HistoryMaxLength   int               `yaml:"HistoryMaxLength"`
+	SeedHistory        int               `yaml:"SeedHistory"`
+	ContextWindow      int               `yaml:"ContextWindow"`
+	MessageRetention   *time.Duration    `yaml:"MessageRetention,omitempty"`
+	PrePrompt          string            `yaml:"PrePrompt"`
+	InputModeration    bool              `yaml:"InputModeration"`
+	OutputModeration   bool              `yaml:"OutputModeration"`
+	SendUserId         bool              `yaml:"SendUserId"`
+	Stream             bool              `yaml:"Stream"`
+	StreamInterval     *time.Duration    `yaml:"StreamInterval,omitempty"`
+	Vision             bool              `yaml:"Vision"`
+	ImageDetail        string            `yaml:"ImageDetail"`
+	MaxImageSize       int64             `yaml:"MaxImageSize"`
+	Transcription      Transcription     `yaml:"Transcription,omitempty"`
+	Images             Images            `yaml:"Images,omitempty"`
+	Tools              []string          `yaml:"Tools"` // The names of the tools the model may call.
+	MaxToolIterations  *int              `yaml:"MaxToolIterations,omitempty"`
+	MaxContinuations   *int              `yaml:"MaxContinuations,omitempty"` // Follow-up requests if an answer is cut off.
+	MaxAnswerTokens    int               `yaml:"MaxAnswerTokens"`            // The limit of an answer with its continuations.
+	ModelParams        ModelParams       `yaml:"ModelParams,omitempty"`
+	Retry              Retry             `yaml:"Retry,omitempty"`
+	HTTP               HTTP              `yaml:"HTTP,omitempty"`
+}
+
+// Override contains any of the OpenAI settings, which are applied on top of the global OpenAI section if Match matches
+// the name or the id of the room, or the name of the user. Match can be a glob, e.g. "support-*".
+type Override struct {
+	Match  string      `yaml:"Match"`
+	OpenAI interface{} `yaml:"OpenAI"`
+	// Trigger replaces the global Trigger in the matching rooms. It is ignored in Users.
+	Trigger *Trigger `yaml:"Trigger"`
+}
+
+// The trigger modes.
+const (
+	// TriggerMention answers the messages that mention the bot, and the direct messages.
+	TriggerMention = "mention"
+	// TriggerDirect answers the direct messages only.
+	TriggerDirect = "direct"
+	// TriggerPrefix answers the messages that start with the Prefix of the trigger, and the direct messages.
+	TriggerPrefix = "prefix"
+	// TriggerAll answers every message.
+	TriggerAll = "all"
+)
+
+type Trigger struct {
+	// Mode is one of the trigger modes, mention by default.
+	Mode string `yaml:"Mode"`
+	// Prefix is the keyword of the prefix mode, e.g. "bot,". It is not case-sensitive.
+	Prefix string `yaml:"Prefix"`
+}
+
+func (t Trigger) validate() error {
+	switch t.Mode {
+	case "", TriggerMention, TriggerDirect, TriggerAll:
+	case TriggerPrefix:
+		if t.Prefix == "" {
+			return fmt.Errorf("the prefix trigger needs a Prefix")
+		}
+	default:
+		return fmt.Errorf("unknown trigger mode: %s", t.Mode)
+	}
+	return nil
+}
+
+// Transcription configures the conversion of audio attachments (e.g. voice messages) to text, which is then used as
+// the prompt.
+type Transcription struct {
+	Enabled  bool   `yaml:"Enabled"`
+	Endpoint string `yaml:"Endpoint,omitempty"`
+	Model    string `yaml:"Model,omitempty"`
+	// Language is the ISO-639-1 code of the language of the audio, it is detected if empty.
+	Language string `yaml:"Language,omitempty"`
+	// MaxSize is the maximum size of an audio file in bytes.
+	MaxSize int64 `yaml:"MaxSize,omitempty"`
+	// Types are the allowed MIME types.
+	Types []string `yaml:"Types,omitempty"`
+	// Echo sends the transcript back in a quote before the answer.
+	Echo bool `yaml:"Echo"`
+}
+
+// Images configures the image generation of the image command.
+type Images struct {
+	Endpoint string `yaml:"Endpoint,omitempty"`
+	Model    string `yaml:"Model,omitempty"`
+	// Size and Quality depend on the model, the defaults of the model are used if they are empty.
+	Size    string `yaml:"Size,omitempty"`
+	Quality string `yaml:"Quality,omitempty"`
 }
 
 type ModelParams struct {
@@ -43,6 +174,32 @@ type ModelParams struct {
 	MaxTokens        *int     `yaml:"MaxTokens,omitempty"`
 }
 
+// HTTP configures the connections to OpenAI and the time limits of the requests.
+type HTTP struct {
+	// Proxy is the url of the proxy. By default, the HTTPS_PROXY and HTTP_PROXY environment variables are used.
+	Proxy string `yaml:"Proxy"`
+	// CABundle is a PEM file with the certificates trusted besides the ones of the system.
+	CABundle            string         `yaml:"CABundle"`
+	DialTimeout         *time.Duration `yaml:"DialTimeout,omitempty"`
+	IdleConnTimeout     *time.Duration `yaml:"IdleConnTimeout,omitempty"`
+	MaxIdleConnsPerHost *int           `yaml:"MaxIdleConnsPerHost,omitempty"`
+	// CompletionTimeout and ModerationTimeout limit a request with all of its retries, Timeout limits the other
+	// requests, e.g. the transcriptions. A streamed completion has to end within the CompletionTimeout too.
+	Timeout           *time.Duration `yaml:"Timeout,omitempty"`
+	CompletionTimeout *time.Duration `yaml:"CompletionTimeout,omitempty"`
+	ModerationTimeout *time.Duration `yaml:"ModerationTimeout,omitempty"`
+}
+
+type Retry struct {
+	MaxAttempts   *int           `yaml:"MaxAttempts,omitempty"`
+	BaseDelay     *time.Duration `yaml:"BaseDelay,omitempty"`
+	MaxDelay      *time.Duration `yaml:"MaxDelay,omitempty"`
+	Jitter        *float64       `yaml:"Jitter,omitempty"`
+	Deadline      *time.Duration `yaml:"Deadline,omitempty"`
+	StatusCodes   []int          `yaml:"StatusCodes,omitempty"`
+	NetworkErrors *bool          `yaml:"NetworkErrors,omitempty"`
+}
+
 func NewConfig(path string) (*Config, error) {
 	//log.WithField("message", "Method").Debug("Config")
 	file, err := os.ReadFile(path)
@@ -55,11 +212,127 @@ func NewConfig(path string) (*Config, error) {
 
 	// Default values
 	config.RocketChat.SSL = true
+	config.Commands.Prefix = "!"
+	config.Dispatcher.Workers = 4
+	config.Dispatcher.QueueSize = 50
+	config.Dispatcher.NoticeAfter = 1
+	config.Dispatcher.ShutdownTimeout = 30 * time.Second
 
 	err = yaml.Unmarshal(file, &config)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse configfile %w", err)
 	}
 
+	// The overrides are applied on the original YAML of the OpenAI section, so only the fields that are set in them
+	// are overridden.
+	var raw struct {
+		OpenAI interface{} `yaml:"OpenAI"`
+	}
+	err = yaml.Unmarshal(file, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse configfile %w", err)
+	}
+	config.openAIRaw = raw.OpenAI
+
+	if err := config.Trigger.validate(); err != nil {
+		return nil, fmt.Errorf("invalid Trigger: %w", err)
+	}
+	for _, o := range config.Rooms {
+		if o.Trigger != nil {
+			if err := o.Trigger.validate(); err != nil {
+				return nil, fmt.Errorf("invalid Trigger for %q: %w", o.Match, err)
+			}
+		}
+	}
+
+	for _, o := range append(config.Rooms, config.Users...) {
+		if _, err := filepath.Match(o.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid Match %q: %w", o.Match, err)
+		}
+		if _, err := config.resolve([]interface{}{o.OpenAI}); err != nil {
+			return nil, fmt.Errorf("invalid OpenAI override for %q: %w", o.Match, err)
+		}
+	}
+
 	return &config, nil
 }
+
+// ResolveTrigger returns the trigger of the room: the one of the last matching Rooms override that has a trigger, or
+// the global one.
+func (c *Config) ResolveTrigger(roomName string, roomId string) Trigger {
+	trigger := c.Trigger
+	for _, o := range c.Rooms {
+		if o.Trigger != nil && (o.matches(roomName) || o.matches(roomId)) {
+			trigger = *o.Trigger
+		}
+	}
+	if trigger.Mode == "" {
+		trigger.Mode = TriggerMention
+	}
+	return trigger
+}
+
+// ResolveOpenAI returns the OpenAI settings for a message in the room sent by the user. The matching Rooms overrides
+// are applied in order, then the matching Users overrides, so the overrides of the user win.
+func (c *Config) ResolveOpenAI(roomName string, roomId string, userName string) (OpenAIConfig, error) {
+	var overrides []interface{}
+	for _, o := range c.Rooms {
+		if o.matches(roomName) || o.matches(roomId) {
+			overrides = append(overrides, o.OpenAI)
+		}
+	}
+	for _, o := range c.Users {
+		if o.matches(userName) {
+			overrides = append(overrides, o.OpenAI)
+		}
+	}
+	if len(overrides) == 0 {
+		return c.OpenAI, nil
+	}
+	return c.resolve(overrides)
+}
+
+// MaxMessageRetention returns the longest MessageRetention of the OpenAI section and of the overrides, e.g. to decide
+// which messages can be dropped before the room is known. It returns nil if any of them keeps the messages forever.
+func (c *Config) MaxMessageRetention() *time.Duration {
+	longest := c.OpenAI.MessageRetention
+	for _, o := range append(c.Rooms, c.Users...) {
+		if longest == nil {
+			break
+		}
+		resolved, err := c.resolve([]interface{}{o.OpenAI})
+		if err != nil {
+			// The overrides have been checked by NewConfig, this does not happen.
+			return nil
+		}
+		if resolved.MessageRetention == nil || *resolved.MessageRetention > *longest {
+			longest = resolved.MessageRetention
+		}
+	}
+	return longest
+}
+
+// resolve decodes the OpenAI section and the overrides into a new struct, so the pointers in it are not shared with
+// c.OpenAI.
+func (c *Config) resolve(overrides []interface{}) (OpenAIConfig, error) {
+	var resolved OpenAIConfig
+	for _, layer := range append([]interface{}{c.openAIRaw}, overrides...) {
+		raw, err := yaml.Marshal(layer)
+		if err != nil {
+			return resolved, err
+		}
+		err = yaml.Unmarshal(raw, &resolved)
+		if err != nil {
+			return resolved, err
+		}
+	}
+	return resolved, nil
+}
+
+func (o *Override) matches(s string) bool {
+	if s == "" {
+		return false
+	}
+	ok, _ := filepath.Match(o.Match, s)
+	return ok
+}
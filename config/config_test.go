@@ -0,0 +1,125 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const overridesConfig = `
+OpenAI:
+  Model: gpt-3.5-turbo
+  PrePrompt: "You are a cowboy."
+  HistorySize: 6
+  ModelParams:
+    Temperature: 0.9
+    MaxTokens: 1024
+Rooms:
+  - Match: support
+    OpenAI:
+      Model: gpt-4o
+      PrePrompt: "You are a formal assistant."
+      ModelParams:
+        Temperature: 0.1
+  - Match: "random-*"
+    OpenAI:
+      HistorySize: 2
+Users:
+  - Match: boss
+    OpenAI:
+      Model: gpt-4
+`
+
+func TestResolveOpenAI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(overridesConfig), 0600))
+	cfg, err := NewConfig(path)
+	assert.NoError(t, err)
+
+	// No override matches.
+	oa, err := cfg.ResolveOpenAI("general", "GENERAL", "joe")
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.OpenAI, oa)
+
+	// Matching by room name. The fields that are not overridden are kept, even within ModelParams.
+	oa, err = cfg.ResolveOpenAI("support", "r1", "joe")
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4o", oa.Model)
+	assert.Equal(t, "You are a formal assistant.", oa.PrePrompt)
+	assert.Equal(t, 6, oa.HistorySize)
+	assert.Equal(t, 0.1, *oa.ModelParams.Temperature)
+	assert.Equal(t, 1024, *oa.ModelParams.MaxTokens)
+	// The global settings are not modified.
+	assert.Equal(t, 0.9, *cfg.OpenAI.ModelParams.Temperature)
+
+	// Matching by glob, and the user overrides win.
+	oa, err = cfg.ResolveOpenAI("random-chat", "r2", "boss")
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4", oa.Model)
+	assert.Equal(t, 2, oa.HistorySize)
+	assert.Equal(t, "You are a cowboy.", oa.PrePrompt)
+
+	// Matching by room id.
+	cfg.Rooms[0].Match = "r3"
+	oa, err = cfg.ResolveOpenAI("", "r3", "joe")
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4o", oa.Model)
+}
+
+const triggerConfig = `
+Trigger:
+  Mode: prefix
+  Prefix: "bot,"
+Rooms:
+  - Match: random
+    Trigger:
+      Mode: all
+  - Match: "support-*"
+    OpenAI:
+      Model: gpt-4o
+`
+
+func TestResolveTrigger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(triggerConfig), 0600))
+	cfg, err := NewConfig(path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, Trigger{Mode: TriggerPrefix, Prefix: "bot,"}, cfg.ResolveTrigger("general", "r1"))
+	assert.Equal(t, Trigger{Mode: TriggerAll}, cfg.ResolveTrigger("random", "r2"))
+	// Overrides without a trigger do not change it.
+	assert.Equal(t, TriggerPrefix, cfg.ResolveTrigger("support-1", "r3").Mode)
+
+	// Mention is the default.
+	assert.Equal(t, TriggerMention, (&Config{}).ResolveTrigger("general", "r1").Mode)
+
+	for _, invalid := range []string{"Trigger:\n  Mode: sometimes\n", "Trigger:\n  Mode: prefix\n", "Rooms:\n  - Match: x\n    Trigger:\n      Mode: never\n"} {
+		assert.NoError(t, os.WriteFile(path, []byte(invalid), 0600))
+		_, err = NewConfig(path)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMaxMessageRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) *Config {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		cfg, err := NewConfig(path)
+		assert.NoError(t, err)
+		return cfg
+	}
+
+	cfg := write("OpenAI:\n  MessageRetention: 1h\nRooms:\n  - Match: archive\n    OpenAI:\n      MessageRetention: 24h\n  - Match: random\n    OpenAI:\n      MessageRetention: 5m\n")
+	assert.Equal(t, 24*time.Hour, *cfg.MaxMessageRetention())
+
+	// An override without a retention keeps the global one.
+	cfg = write("OpenAI:\n  MessageRetention: 1h\nUsers:\n  - Match: boss\n    OpenAI:\n      Model: gpt-4\n")
+	assert.Equal(t, time.Hour, *cfg.MaxMessageRetention())
+
+	// The messages of the rooms without a retention are kept forever.
+	cfg = write("Rooms:\n  - Match: random\n    OpenAI:\n      MessageRetention: 5m\n")
+	assert.Nil(t, cfg.MaxMessageRetention())
+}
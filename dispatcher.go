@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"sync"
+
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrQueueFull = errors.New("the queue is full")
+
+// Dispatcher runs the handler for incoming messages concurrently, but at most Workers handlers at a time. Messages
+// with the same key (e.g. from the same room) are handled one after the other in the order they were submitted, so
+// the history stays coherent.
+type Dispatcher struct {
+	Workers   int
+	QueueSize int
+	handler   func(rocket.Message)
+	slots     chan struct{}
+	mutex     sync.Mutex
+	queues    map[string][]rocket.Message
+	// pending is the number of submitted messages that are not handled yet.
+	pending int
+	active  int
+	wg      sync.WaitGroup
+}
+
+func NewDispatcher(workers int, queueSize int, handler func(rocket.Message)) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Dispatcher{
+		Workers:   workers,
+		QueueSize: queueSize,
+		handler:   handler,
+		slots:     make(chan struct{}, workers),
+		queues:    make(map[string][]rocket.Message),
+	}
+}
+
+// Submit queues the message for handling. It returns the position of the message in the queue of the key, which is 0
+// if the handling can start right away, and 1 if the message is the next one of the key. If QueueSize messages are
+// already waiting, ErrQueueFull is returned.
+func (d *Dispatcher) Submit(key string, msg rocket.Message) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.QueueSize > 0 && d.pending >= d.QueueSize {
+		return 0, ErrQueueFull
+	}
+
+	queue, running := d.queues[key]
+	d.queues[key] = append(queue, msg)
+	d.pending++
+	metrics.QueueDepth.Set(float64(d.pending))
+
+	if !running {
+		d.wg.Add(1)
+		go d.drain(key)
+	}
+
+	if !running && d.active+d.pending <= d.Workers {
+		return 0, nil
+	}
+	return len(d.queues[key]), nil
+}
+
+// Pending returns the number of messages that are waiting or being handled.
+func (d *Dispatcher) Pending() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.pending + d.active
+}
+
+// Wait blocks until all submitted messages are handled.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// WaitContext is like Wait, but it returns the error of ctx if it is done before all messages are handled.
+func (d *Dispatcher) WaitContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain handles the messages of the key until its queue is empty.
+func (d *Dispatcher) drain(key string) {
+	defer d.wg.Done()
+	for {
+		d.mutex.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.mutex.Unlock()
+			return
+		}
+		msg := queue[0]
+		d.mutex.Unlock()
+
+		d.slots <- struct{}{}
+		d.mutex.Lock()
+		d.queues[key] = d.queues[key][1:]
+		d.pending--
+		metrics.QueueDepth.Set(float64(d.pending))
+		d.active++
+		d.mutex.Unlock()
+
+		d.handle(msg)
+
+		d.mutex.Lock()
+		d.active--
+		d.mutex.Unlock()
+		<-d.slots
+	}
+}
+
+// handle runs the handler for the message. A panic is logged, so the other messages are still handled.
+func (d *Dispatcher) handle(msg rocket.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("panic", r).WithField("message", msg.Id).WithField("stack", string(debug.Stack())).Error("The handling of the message has panicked.")
+			metrics.Errors.Inc("panic")
+		}
+	}()
+	d.handler(msg)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcher(t *testing.T) {
+	var mutex sync.Mutex
+	handled := make(map[string][]string)
+	var active, maxActive int
+	release := make(chan struct{})
+
+	d := NewDispatcher(2, 5, func(msg rocket.Message) {
+		mutex.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mutex.Unlock()
+
+		<-release
+
+		mutex.Lock()
+		active--
+		handled[msg.RoomId] = append(handled[msg.RoomId], msg.Id)
+		mutex.Unlock()
+	})
+
+	position, err := d.Submit("room1", rocket.Message{RoomId: "room1", Id: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, position)
+	position, err = d.Submit("room2", rocket.Message{RoomId: "room2", Id: "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, position)
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return active == 2
+	}, time.Second, time.Millisecond)
+
+	// Both workers are busy, and room1 is busy anyway.
+	position, err = d.Submit("room1", rocket.Message{RoomId: "room1", Id: "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, position)
+
+	for i, id := range []string{"3", "4"} {
+		position, err = d.Submit("room1", rocket.Message{RoomId: "room1", Id: id})
+		assert.NoError(t, err)
+		assert.Equal(t, i+2, position)
+	}
+	// The position is counted in the queue of the room, the messages of the other rooms do not matter.
+	position, err = d.Submit("room3", rocket.Message{RoomId: "room3", Id: "x"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, position)
+	position, err = d.Submit("room3", rocket.Message{RoomId: "room3", Id: "y"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, position)
+
+	// 5 messages are waiting.
+	_, err = d.Submit("room4", rocket.Message{RoomId: "room4", Id: "z"})
+	assert.ErrorIs(t, err, ErrQueueFull)
+	assert.Equal(t, 7, d.Pending())
+
+	close(release)
+	d.Wait()
+	assert.Equal(t, 0, d.Pending())
+	assert.Equal(t, []string{"1", "2", "3", "4"}, handled["room1"])
+	assert.Equal(t, []string{"x", "y"}, handled["room3"])
+	assert.Equal(t, 2, maxActive)
+}
+
+func TestDispatcherWaitContext(t *testing.T) {
+	release := make(chan struct{})
+	d := NewDispatcher(1, 10, func(msg rocket.Message) {
+		<-release
+	})
+	_, err := d.Submit("room1", rocket.Message{RoomId: "room1", Id: "1"})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, d.WaitContext(ctx), context.DeadlineExceeded)
+
+	close(release)
+	assert.NoError(t, d.WaitContext(context.Background()))
+}
+
+func TestDispatcherPanic(t *testing.T) {
+	var mutex sync.Mutex
+	var handled []string
+	d := NewDispatcher(1, 10, func(msg rocket.Message) {
+		if msg.Id == "bad" {
+			panic("malformed message")
+		}
+		mutex.Lock()
+		handled = append(handled, msg.Id)
+		mutex.Unlock()
+	})
+
+	for _, id := range []string{"1", "bad", "2"} {
+		_, err := d.Submit("room1", rocket.Message{RoomId: "room1", Id: id})
+		assert.NoError(t, err)
+	}
+	d.Wait()
+	assert.Equal(t, []string{"1", "2"}, handled)
+	assert.Equal(t, 0, d.Pending())
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
+	"github.com/mimrock/rocketchat_openai_bot/openai/openaitest"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/mimrock/rocketchat_openai_bot/rocket/rockettest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const e2eTimeout = 10 * time.Second
+
+// e2e is a bot connected to a fake Rocket.Chat and a fake OpenAI.
+type e2e struct {
+	rc    *rockettest.Server
+	oa    *openaitest.Server
+	cfg   *config.Config
+	alice rockettest.User
+	room  rockettest.Room
+}
+
+// newE2E starts the fake servers. The configuration can be changed before start.
+func newE2E(t *testing.T) *e2e {
+	rc := rockettest.NewServer()
+	t.Cleanup(rc.Close)
+	oa := openaitest.NewServer()
+	t.Cleanup(oa.Close)
+
+	var cfg config.Config
+	cfg.RocketChat.HostName, cfg.RocketChat.Port = rc.HostPort()
+	cfg.RocketChat.User = rc.Bot.Username
+	cfg.RocketChat.Password = rc.Password
+	cfg.OpenAI = oa.Config()
+	cfg.OpenAI.HistorySize = 10
+	cfg.Commands.Prefix = "!"
+	cfg.Dispatcher.Workers = 2
+	cfg.Dispatcher.QueueSize = 10
+	cfg.Dispatcher.NoticeAfter = 5
+
+	e := &e2e{rc: rc, oa: oa, cfg: &cfg}
+	e.alice = rc.AddUser("alice", "Alice")
+	e.room = rc.AddRoom("general", "c", e.alice)
+	return e
+}
+
+// start connects the bot, and runs it until the end of the test.
+func (e *e2e) start(t *testing.T) {
+	rock, err := rocket.NewConnectionFromConfig(e.cfg)
+	require.NoError(t, err)
+	bot, err := NewBot(e.cfg, rock, NewHistory().WithLimits(e.cfg.OpenAI))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		serve(context.Background(), e.cfg, rock, bot)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		rock.Close()
+		<-done
+	})
+	require.NoError(t, e.rc.WaitSubscribed(e.room.Id, e2eTimeout))
+}
+
+// ask posts the text as alice, and returns the final answer of the bot.
+func (e *e2e) ask(t *testing.T, text string) string {
+	e.rc.Post(e.room, e.alice, text)
+	reply, err := e.rc.WaitBotMessage(e2eTimeout, func(m rockettest.Message) bool {
+		return m.RoomId == e.room.Id && !strings.Contains(m.Text, ":hourglass:")
+	})
+	require.NoError(t, err)
+	return reply.Text
+}
+
+func TestE2EAnswer(t *testing.T) {
+	e := newE2E(t)
+	e.oa.Enqueue(openaitest.Reply{Content: "Hello Alice!"}, openaitest.Reply{Content: "You said hello."})
+	e.start(t)
+
+	assert.Equal(t, "@alice Hello Alice!", e.ask(t, "@bot hello"))
+	assert.Equal(t, "@alice You said hello.", e.ask(t, "@bot what did I say?"))
+
+	// The second request contains the first question and answer as history.
+	requests := e.oa.Requests()
+	require.Len(t, requests, 2)
+	var contents []string
+	for _, m := range requests[1].Messages {
+		contents = append(contents, m.Role+": "+m.Content)
+	}
+	assert.Equal(t, []string{"user: hello", "assistant: Hello Alice!", "user: what did I say?"}, contents)
+}
+
+func TestE2EQuote(t *testing.T) {
+	e := newE2E(t)
+	bob := e.rc.AddUser("bob", "Bob")
+	e.start(t)
+
+	quoted := e.rc.Post(e.room, bob, "The answer is `42`.")
+	link := fmt.Sprintf("[ ](%s/channel/general?msg=%s)", e.rc.URL, quoted.Id)
+	e.ask(t, link+" @bot Is @bob right?")
+
+	requests := e.oa.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "> bob: The answer is `42`.\n\nIs Bob right?", requests[0].LastMessage())
+}
+
+func TestE2EImageAttachments(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.OpenAI.Vision = true
+	e.rc.AddFile("/file-upload/f1/cat.png", []byte("\x89PNG\r\n\x1a\n"))
+	e.start(t)
+
+	// The image of a link preview is not on the server, it is left out, the rest of the message is answered.
+	e.rc.Send(rockettest.Message{RoomId: e.room.Id, UserId: e.alice.Id, Text: "@bot look", Attachments: []rockettest.Attachment{
+		{Title: "preview", ImageURL: "https://example.com/preview.png", ImageType: "image/png"},
+		{Title: "cat.png", ImageURL: "/file-upload/f1/cat.png", ImageType: "image/png"},
+	}})
+	_, err := e.rc.WaitBotMessage(e2eTimeout, nil)
+	require.NoError(t, err)
+
+	requests := e.oa.Requests()
+	require.Len(t, requests, 1)
+	last := requests[0].Messages[len(requests[0].Messages)-1]
+	assert.Equal(t, "look", last.Content)
+	assert.Equal(t, 1, last.Images)
+}
+
+func TestE2EAudioAttachments(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.OpenAI.Transcription = config.Transcription{Enabled: true, MaxSize: 1024, Types: []string{"audio/ogg"}}
+	e.start(t)
+
+	e.rc.Send(rockettest.Message{RoomId: e.room.Id, UserId: e.alice.Id, Text: "@bot listen", Attachments: []rockettest.Attachment{
+		{Title: "voice.ogg", AudioURL: "https://example.com/voice.ogg", AudioType: "audio/ogg"},
+	}})
+	reply, err := e.rc.WaitBotMessage(e2eTimeout, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "@alice Echo: listen", reply.Text)
+}
+
+func TestE2ETranscriptModeration(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.OpenAI.InputModeration = true
+	e.cfg.OpenAI.Transcription = config.Transcription{Enabled: true, Echo: true, MaxSize: 1024, Types: []string{"audio/ogg"}}
+	e.rc.AddFile("/file-upload/f1/voice.ogg", []byte("OggS"))
+	e.oa.Transcript("an insult")
+	e.oa.Flag("insult")
+	e.start(t)
+
+	e.rc.Send(rockettest.Message{RoomId: e.room.Id, UserId: e.alice.Id, Text: "@bot", Attachments: []rockettest.Attachment{
+		{Title: "voice.ogg", AudioURL: "/file-upload/f1/voice.ogg", AudioType: "audio/ogg"},
+	}})
+	reply, err := e.rc.WaitBotMessage(e2eTimeout, nil)
+	require.NoError(t, err)
+	// The flagged transcript is not quoted in the room.
+	assert.Contains(t, reply.Text, ":triangular_flag_on_post:")
+	assert.Equal(t, []string{"an insult"}, e.oa.ModerationInputs())
+	assert.Len(t, e.rc.Messages(e.room.Id), 2)
+	assert.Empty(t, e.oa.Requests())
+}
+
+func TestE2EStream(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.OpenAI.Stream = true
+	interval := time.Millisecond
+	e.cfg.OpenAI.StreamInterval = &interval
+	e.oa.Enqueue(openaitest.Reply{Content: "A long streamed answer."})
+	e.start(t)
+
+	e.rc.Post(e.room, e.alice, "@bot tell me something")
+	_, err := e.rc.WaitBotMessage(e2eTimeout, func(m rockettest.Message) bool {
+		return m.Text == "@alice A long streamed answer."
+	})
+	assert.NoError(t, err)
+}
+
+func TestE2EStreamOutputModeration(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.OpenAI.Stream = true
+	e.cfg.OpenAI.OutputModeration = true
+	e.oa.Flag("insult")
+	e.oa.Enqueue(openaitest.Reply{Content: "An insult."})
+	e.start(t)
+
+	// The answer is not streamed, so it is not shown before it is moderated.
+	answer := e.ask(t, "@bot say something")
+	assert.Contains(t, answer, "output flagged")
+	requests := e.oa.Requests()
+	require.Len(t, requests, 1)
+	assert.False(t, requests[0].Stream)
+	assert.Len(t, e.rc.Messages(e.room.Id), 2)
+}
+
+func TestE2EContinuation(t *testing.T) {
+	e := newE2E(t)
+	e.rc.MaxMessageSize = 50
+	e.oa.Enqueue(
+		openaitest.Reply{Content: "The first part of a long answer", FinishReason: "length"},
+		openaitest.Reply{Content: " and the end of it."},
+	)
+	e.start(t)
+
+	e.rc.Post(e.room, e.alice, "@bot tell me a long story")
+	first, err := e.rc.WaitBotMessage(e2eTimeout, nil)
+	require.NoError(t, err)
+	second, err := e.rc.WaitBotMessage(e2eTimeout, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "@alice The first part of a\n(1/2)", first.Text)
+	assert.Equal(t, "long answer and the end of it.\n(2/2)", second.Text)
+
+	requests := e.oa.Requests()
+	require.Len(t, requests, 2)
+	continuation := requests[1].Messages
+	require.Len(t, continuation, 3)
+	assert.Equal(t, "The first part of a long answer", continuation[1].Content)
+	assert.Equal(t, continuePrompt, continuation[2].Content)
+}
+
+func TestE2EModeration(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.OpenAI.InputModeration = true
+	e.oa.Flag("insult")
+	e.start(t)
+
+	answer := e.ask(t, "@bot an insult")
+	assert.Contains(t, answer, ":triangular_flag_on_post:")
+	assert.Contains(t, answer, "Harassment")
+	assert.Empty(t, e.oa.Requests())
+	assert.Equal(t, []string{"an insult"}, e.oa.ModerationInputs())
+}
+
+func TestE2EContextLengthExceeded(t *testing.T) {
+	e := newE2E(t)
+	e.oa.Enqueue(openaitest.Reply{Content: "First answer."}, openaitest.ContextLengthExceeded())
+	e.start(t)
+
+	e.ask(t, "@bot first")
+	assert.Contains(t, e.ask(t, "@bot second"), ":x: Sorry")
+
+	// The history has been cleared, the next request starts from scratch.
+	e.ask(t, "@bot third")
+	requests := e.oa.Requests()
+	require.Len(t, requests, 3)
+	assert.Len(t, requests[1].Messages, 3)
+	assert.Len(t, requests[2].Messages, 1)
+}
+
+func TestE2EMetrics(t *testing.T) {
+	t.Run("answer", func(t *testing.T) {
+		e := newE2E(t)
+		e.cfg.OpenAI.InputModeration = true
+		e.oa.Flag("insult")
+		e.oa.Enqueue(openaitest.Reply{Content: "Hi."}, openaitest.ContextLengthExceeded())
+		e.start(t)
+
+		// The metrics are global, so only the changes made by this test are checked.
+		received := metrics.MessagesReceived.Value("general")
+		replies := metrics.RepliesSent.Value("general")
+		completions := metrics.OpenAILatency.Count("completion", e.cfg.OpenAI.Model)
+		flags := metrics.ModerationFlags.Value("Harassment")
+		contextErrors := metrics.Errors.Value("context_length_exceeded")
+
+		e.ask(t, "@bot hello")
+		e.ask(t, "@bot an insult")
+		e.ask(t, "@bot too long")
+
+		assert.Equal(t, received+3, metrics.MessagesReceived.Value("general"))
+		// A reply is counted when Rocket.Chat confirms it, which can be after the message shows up.
+		assert.Eventually(t, func() bool { return metrics.RepliesSent.Value("general") == replies+3 }, e2eTimeout, 10*time.Millisecond)
+		assert.Equal(t, completions+2, metrics.OpenAILatency.Count("completion", e.cfg.OpenAI.Model))
+		assert.Equal(t, flags+1, metrics.ModerationFlags.Value("Harassment"))
+		assert.Equal(t, contextErrors+1, metrics.Errors.Value("context_length_exceeded"))
+
+		rec := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body, err := io.ReadAll(rec.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), `bartender_messages_received_total{room="general"}`)
+		assert.Contains(t, string(body), "# TYPE bartender_openai_request_duration_seconds histogram")
+		assert.Contains(t, string(body), "bartender_queue_depth ")
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		e := newE2E(t)
+		e.cfg.OpenAI.Stream = true
+		interval := time.Millisecond
+		e.cfg.OpenAI.StreamInterval = &interval
+		e.oa.Enqueue(openaitest.Reply{Content: "A streamed answer."})
+		e.start(t)
+
+		model := e.cfg.OpenAI.Model
+		prompt := metrics.TokensUsed.Value(model, "prompt")
+		completion := metrics.TokensUsed.Value(model, "completion")
+		completions := metrics.OpenAILatency.Count("completion", model)
+
+		e.rc.Post(e.room, e.alice, "@bot stream please")
+		_, err := e.rc.WaitBotMessage(e2eTimeout, func(m rockettest.Message) bool {
+			return m.Text == "@alice A streamed answer."
+		})
+		require.NoError(t, err)
+
+		// The usage comes in the last chunk, and the duration is recorded when the stream is closed.
+		requests := e.oa.Requests()
+		require.Len(t, requests, 1)
+		require.NotNil(t, requests[0].StreamOptions)
+		assert.True(t, requests[0].StreamOptions.IncludeUsage)
+		assert.Eventually(t, func() bool { return metrics.OpenAILatency.Count("completion", model) == completions+1 }, e2eTimeout, 10*time.Millisecond)
+		assert.Equal(t, prompt+2, metrics.TokensUsed.Value(model, "prompt"))
+		assert.Equal(t, completion+3, metrics.TokensUsed.Value(model, "completion"))
+	})
+}
+
+func TestE2EToolCall(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.OpenAI.Tools = []string{"calculate"}
+	e.oa.Enqueue(openaitest.ToolCall("call-1", "calculate", `{"expression":"6 * 7"}`), openaitest.Reply{Content: "It is 42."})
+	e.start(t)
+
+	assert.Equal(t, "@alice It is 42.", e.ask(t, "@bot what is 6 times 7?"))
+	requests := e.oa.Requests()
+	require.Len(t, requests, 2)
+	last := requests[1].Messages[len(requests[1].Messages)-1]
+	assert.Equal(t, "tool", last.Role)
+	assert.Equal(t, "call-1", last.ToolCallId)
+	assert.Equal(t, "42", last.Content)
+}
+
+func TestE2EListMembersOfPrivateGroup(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.OpenAI.Tools = []string{"list_room_members"}
+	group := e.rc.AddRoom("team", "p", e.alice)
+	e.oa.Enqueue(openaitest.ToolCall("call-1", "list_room_members", `{}`), openaitest.Reply{Content: "Alice is here."})
+	e.start(t)
+	require.NoError(t, e.rc.WaitSubscribed(group.Id, e2eTimeout))
+
+	e.rc.Post(group, e.alice, "@bot who is here?")
+	reply, err := e.rc.WaitBotMessage(e2eTimeout, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "@alice Alice is here.", reply.Text)
+	requests := e.oa.Requests()
+	require.Len(t, requests, 2)
+	last := requests[1].Messages[len(requests[1].Messages)-1]
+	assert.Equal(t, "tool", last.Role)
+	assert.Equal(t, "bot, alice", last.Content)
+}
+
+func TestE2EReconnect(t *testing.T) {
+	e := newE2E(t)
+	e.start(t)
+	assert.Equal(t, "@alice Echo: before", e.ask(t, "@bot before"))
+
+	e.rc.Disconnect()
+	// The new connection subscribes to the room again.
+	require.NoError(t, e.rc.WaitSubscribed(e.room.Id, e2eTimeout))
+	assert.Equal(t, "@alice Echo: after", e.ask(t, "@bot after"))
+}
+
+func TestE2ETrigger(t *testing.T) {
+	e := newE2E(t)
+	dm := e.rc.AddDirectRoom(e.alice)
+	e.start(t)
+	require.NoError(t, e.rc.WaitSubscribed(dm.Id, e2eTimeout))
+
+	// The bot is not mentioned in the channel, so only the direct message is answered.
+	e.rc.Post(e.room, e.alice, "hello everyone")
+	e.rc.Post(dm, e.alice, "hello bot")
+	reply, err := e.rc.WaitBotMessage(e2eTimeout, nil)
+	require.NoError(t, err)
+	assert.Equal(t, dm.Id, reply.RoomId)
+	assert.Equal(t, "@alice Echo: hello bot", reply.Text)
+	require.Len(t, e.oa.Requests(), 1)
+}
+
+func TestE2ETriggerPrefix(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.Trigger = config.Trigger{Mode: config.TriggerPrefix, Prefix: "bot,"}
+	e.start(t)
+
+	// The prefix is not sent to OpenAI, and it is not kept in the history.
+	assert.Equal(t, "@alice Echo: hello", e.ask(t, "Bot, hello"))
+	requests := e.oa.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "hello", requests[0].Messages[len(requests[0].Messages)-1].Content)
+}
+
+func TestE2EShutdown(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.Dispatcher.ShutdownTimeout = 100 * time.Millisecond
+	e.oa.Enqueue(openaitest.Reply{Content: "Too late.", Delay: time.Minute})
+	rock, err := rocket.NewConnectionFromConfig(e.cfg)
+	require.NoError(t, err)
+	bot, err := NewBot(e.cfg, rock, NewHistory())
+	require.NoError(t, err)
+	require.NoError(t, e.rc.WaitSubscribed(e.room.Id, e2eTimeout))
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serve(ctx, e.cfg, rock, bot)
+		close(done)
+	}()
+	e.rc.Post(e.room, e.alice, "@bot answer slowly")
+	require.Eventually(t, func() bool { return len(e.oa.Requests()) == 1 }, e2eTimeout, 10*time.Millisecond)
+
+	// The answer in progress is canceled after the timeout, and the user is told about it.
+	stop()
+	select {
+	case <-done:
+	case <-time.After(e2eTimeout):
+		t.Fatal("serve has not returned")
+	}
+	reply, err := e.rc.WaitBotMessage(e2eTimeout, nil)
+	require.NoError(t, err)
+	assert.Contains(t, reply.Text, "restarting")
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+	defer cancel()
+	assert.NoError(t, rock.Shutdown(closeCtx))
+	assert.Equal(t, "offline", e.rc.Status())
+	assert.Eventually(t, func() bool { return e.rc.Connections() == 0 }, e2eTimeout, 10*time.Millisecond)
+}
+
+func TestE2EShutdownHungReply(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.Dispatcher.ShutdownTimeout = 100 * time.Millisecond
+	e.oa.Enqueue(openaitest.Reply{Content: "Stuck."})
+	rock, err := rocket.NewConnectionFromConfig(e.cfg)
+	require.NoError(t, err)
+	defer rock.Close()
+	bot, err := NewBot(e.cfg, rock, NewHistory())
+	require.NoError(t, err)
+	require.NoError(t, e.rc.WaitSubscribed(e.room.Id, e2eTimeout))
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serve(ctx, e.cfg, rock, bot)
+		close(done)
+	}()
+	// Rocket.Chat does not answer the reply, the shutdown does not wait for it longer than the timeout.
+	called := e.rc.DelayMethod("sendMessage", time.Minute)
+	e.rc.Post(e.room, e.alice, "@bot answer")
+	select {
+	case <-called:
+	case <-time.After(e2eTimeout):
+		t.Fatal("the reply has not been sent")
+	}
+
+	stop()
+	select {
+	case <-done:
+	case <-time.After(e2eTimeout):
+		t.Fatal("serve has not returned")
+	}
+	reply, err := e.rc.WaitBotMessage(e2eTimeout, nil)
+	require.NoError(t, err)
+	assert.Contains(t, reply.Text, "restarting")
+}
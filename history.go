@@ -3,10 +3,13 @@ package main
 import (
 	"fmt"
 	"github.com/mimrock/rocketchat_openai_bot/config"
+	"math"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mimrock/rocketchat_openai_bot/openai"
+	log "github.com/sirupsen/logrus"
 )
 
 type TimedMessage struct {
@@ -15,92 +18,208 @@ type TimedMessage struct {
 }
 
 type History struct {
-	Messages   map[string][]TimedMessage
-	Size       int
+	Store HistoryStore
+	Size  int
+	// MaxLength is the maximum number of tokens in the history of a place. 0 means no limit.
 	MaxLength  int
+	Model      string
 	Expiration time.Duration
+	// SeedSize is the number of Rocket.Chat messages loaded into the history of a place when it is empty, 0 means none.
+	SeedSize int
+	// The mutex is shared with the histories returned by WithLimits.
+	mutex *sync.Mutex
 }
 
+// noExpiration is the retention of the messages if MessageRetention is not set.
+const noExpiration = 100 * 8765 * time.Hour // 100 years
+
 func NewHistory() *History {
 	h := new(History)
-	h.Messages = make(map[string][]TimedMessage)
+	h.Store = NewMemoryHistoryStore()
+	h.mutex = new(sync.Mutex)
 	return h
 }
 
-func NewHistoryFromConfig(cfg *config.Config) *History {
-	h := new(History)
-	h.Messages = make(map[string][]TimedMessage)
-	h.Size = cfg.OpenAI.HistorySize
-	h.MaxLength = cfg.OpenAI.HistoryMaxLength
-	if cfg.OpenAI.MessageRetention != nil {
-		h.Expiration = *cfg.OpenAI.MessageRetention
+func NewHistoryFromConfig(cfg *config.Config) (*History, error) {
+	h := NewHistory().WithLimits(cfg.OpenAI)
+
+	switch cfg.HistoryStore.Type {
+	case "", "memory":
+		h.Store = NewMemoryHistoryStore()
+	case "file":
+		// The store does not know the rooms of the places, so it only drops the messages that have expired in every room.
+		expiration := noExpiration
+		if retention := cfg.MaxMessageRetention(); retention != nil {
+			expiration = *retention
+		}
+		store, err := NewFileHistoryStore(cfg.HistoryStore.Path, expiration)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open history store: %w", err)
+		}
+		h.Store = store
+	default:
+		return nil, fmt.Errorf("unknown history store type: %s", cfg.HistoryStore.Type)
+	}
+	return h, nil
+}
+
+// WithLimits returns a history that shares the messages with h, but the size, length and retention limits and the
+// model are taken from cfg, e.g. from the OpenAI settings of a room.
+func (h *History) WithLimits(cfg config.OpenAIConfig) *History {
+	limited := &History{
+		Store:     h.Store,
+		Size:      cfg.HistorySize,
+		MaxLength: cfg.HistoryMaxLength,
+		Model:     cfg.Model,
+		SeedSize:  cfg.SeedHistory,
+		mutex:     h.mutex,
+	}
+	if cfg.MessageRetention != nil {
+		limited.Expiration = *cfg.MessageRetention
 	} else {
-		h.Expiration = 100 * 8765 * time.Hour // 100 years
+		limited.Expiration = noExpiration
 	}
-	return h
+	return limited
 }
 
 func (h *History) GetAsString(place string) string {
 	var ret string
-	if messages, ok := h.Messages[place]; ok {
-		for _, m := range messages {
-			ret += fmt.Sprintf("\n%s", m.Content)
-		}
+	for _, m := range h.AsOpenAIMessages(place) {
+		ret += fmt.Sprintf("\n%s", m.Content)
 	}
-	// @todo cut so it won't be longer than maxLength
 	return strings.TrimSpace(ret)
 }
 
 func (h *History) AsOpenAIMessages(place string) []openai.Message {
-	now := time.Now()
-	h.Messages[place] = h.clearExpired(place, now)
+	return h.AsOpenAIMessagesWithin(place, h.Model, math.MaxInt)
+}
 
-	if messages, ok := h.Messages[place]; ok {
-		openaiMessages := make([]openai.Message, len(messages))
-		for i, m := range messages {
-			openaiMessages[i] = m.Message
-		}
+// AsOpenAIMessagesWithin returns the history of the place, but the oldest turns are dropped until the messages fit in
+// budget tokens (and in MaxLength if set), counted for the model. A turn is a user message and the answers to it.
+func (h *History) AsOpenAIMessagesWithin(place string, model string, budget int) []openai.Message {
+	h.mutex.Lock()
+	messages := h.messages(place, time.Now())
+	h.mutex.Unlock()
+
+	if h.MaxLength > 0 && h.MaxLength < budget {
+		budget = h.MaxLength
+	}
+
+	openaiMessages := make([]openai.Message, len(messages))
+	for i, m := range messages {
+		openaiMessages[i] = m.Message
+	}
+
+	if budget == math.MaxInt {
 		return openaiMessages
 	}
-	// @todo cut so it won't be longer than maxLength
-	return []openai.Message{}
+
+	// The reply priming is not part of the history, it is counted once for the whole request.
+	for len(openaiMessages) > 0 && openai.CountMessageTokens(model, openaiMessages)-openai.CountMessageTokens(model, nil) > budget {
+		openaiMessages = dropOldestTurn(openaiMessages)
+	}
+	return openaiMessages
+}
+
+// dropOldestTurn removes the first message and the answers that follow it.
+func dropOldestTurn(messages []openai.Message) []openai.Message {
+	i := 1
+	for i < len(messages) && messages[i].Role != "user" {
+		i++
+	}
+	return messages[i:]
 }
 
 func (h *History) Add(place string, message openai.Message) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
 	// Remove any expired messages
 	now := time.Now()
-	h.Messages[place] = h.clearExpired(place, now)
+	messages := h.messages(place, now)
 
-	timedMessage := TimedMessage{
+	messages = append(messages, TimedMessage{
 		Message:   message,
 		Timestamp: now,
+	})
+	if len(messages) > h.Size {
+		messages = messages[len(messages)-h.Size:]
 	}
+	h.set(place, messages)
+}
 
-	if messages, ok := h.Messages[place]; ok {
-		messages = append(messages, timedMessage)
-		if len(messages) > h.Size {
-			messages = messages[len(messages)-h.Size:]
-		}
-		h.Messages[place] = messages
-		return
+// Seed sets the messages as the history of the place if it is empty, e.g. with the messages the bot has not seen
+// itself. The messages keep their timestamps, so they expire as if the bot had seen them. It returns false if the
+// history was not empty.
+func (h *History) Seed(place string, messages []TimedMessage) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	if len(h.messages(place, now)) > 0 {
+		return false
+	}
+	messages = h.clearExpired(messages, now)
+	if len(messages) > h.Size {
+		messages = messages[len(messages)-h.Size:]
 	}
-	h.Messages[place] = []TimedMessage{timedMessage}
+	h.set(place, messages)
+	return true
 }
 
 func (h *History) Clear(place string) {
-	h.Messages[place] = []TimedMessage{}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.set(place, []TimedMessage{})
+}
+
+// DropLastTurn removes the last user message and the answers to it. The history is not changed if it has no user
+// message, e.g. if it has been seeded with answers only.
+func (h *History) DropLastTurn(place string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	messages := h.messages(place, time.Now())
+	i := len(messages) - 1
+	for i >= 0 && messages[i].Role != "user" {
+		i--
+	}
+	if i < 0 {
+		return
+	}
+	h.set(place, messages[:i])
+}
+
+// messages returns the messages of the place that are not expired yet.
+func (h *History) messages(place string, now time.Time) []TimedMessage {
+	messages, err := h.Store.Get(place)
+	if err != nil {
+		log.WithError(err).WithField("place", place).Error("Cannot read history.")
+		return []TimedMessage{}
+	}
+
+	validMessages := h.clearExpired(messages, now)
+	if len(validMessages) != len(messages) {
+		h.set(place, validMessages)
+	}
+	return validMessages
+}
+
+func (h *History) set(place string, messages []TimedMessage) {
+	err := h.Store.Set(place, messages)
+	if err != nil {
+		// The history still works in memory, only persisting it has failed.
+		log.WithError(err).WithField("place", place).Error("Cannot save history.")
+	}
 }
 
 // clearExpired removes any expired messages from the history.
-func (h *History) clearExpired(place string, now time.Time) []TimedMessage {
-	if messages, ok := h.Messages[place]; ok {
-		var validMessages []TimedMessage
-		for _, message := range messages {
-			if now.Sub(message.Timestamp) <= h.Expiration {
-				validMessages = append(validMessages, message)
-			}
+func (h *History) clearExpired(messages []TimedMessage, now time.Time) []TimedMessage {
+	validMessages := []TimedMessage{}
+	for _, message := range messages {
+		if now.Sub(message.Timestamp) <= h.Expiration {
+			validMessages = append(validMessages, message)
 		}
-		return validMessages
 	}
-	return []TimedMessage{}
+	return validMessages
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HistoryStore keeps the messages of every place. History takes care of the size limit and the expiration.
+type HistoryStore interface {
+	// Get returns the messages of the place in chronological order. The caller may modify the returned slice.
+	Get(place string) ([]TimedMessage, error)
+	// Set replaces the messages of the place.
+	Set(place string, messages []TimedMessage) error
+	Close() error
+}
+
+type MemoryHistoryStore struct {
+	messages map[string][]TimedMessage
+	mutex    sync.RWMutex
+}
+
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{
+		messages: make(map[string][]TimedMessage),
+	}
+}
+
+func (s *MemoryHistoryStore) Get(place string) ([]TimedMessage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]TimedMessage{}, s.messages[place]...), nil
+}
+
+func (s *MemoryHistoryStore) Set(place string, messages []TimedMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(messages) == 0 {
+		delete(s.messages, place)
+		return nil
+	}
+	s.messages[place] = append([]TimedMessage{}, messages...)
+	return nil
+}
+
+func (s *MemoryHistoryStore) Close() error {
+	return nil
+}
+
+// FileHistoryStore keeps the history in memory, and appends every change to a file as a JSON line, so it survives
+// restarts. The file is compacted (rewritten with only the current state) when it is opened, and when it has grown
+// much bigger than the current state.
+type FileHistoryStore struct {
+	mem        *MemoryHistoryStore
+	path       string
+	expiration time.Duration
+	file       *os.File
+	// records is the number of lines in the file, it is compared to the number of places to decide when to compact.
+	records int
+	mutex   sync.Mutex
+}
+
+type historyRecord struct {
+	Place    string         `json:"place"`
+	Messages []TimedMessage `json:"messages"`
+}
+
+// compactMinRecords prevents compacting a small file over and over.
+const compactMinRecords = 1000
+
+// NewFileHistoryStore opens the store at path, creating the file if it does not exist. Messages that have expired
+// while the bot was not running are dropped.
+func NewFileHistoryStore(path string, expiration time.Duration) (*FileHistoryStore, error) {
+	if path == "" {
+		return nil, errors.New("path of the history file is not set")
+	}
+
+	s := &FileHistoryStore{
+		mem:        NewMemoryHistoryStore(),
+		path:       path,
+		expiration: expiration,
+	}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the records of the file. The last record of a place contains its current state.
+func (s *FileHistoryStore) load() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open history file: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		raw, err := reader.ReadBytes('\n')
+		if len(raw) > 0 {
+			var record historyRecord
+			if jsonErr := json.Unmarshal(raw, &record); jsonErr != nil {
+				if errors.Is(err, io.EOF) {
+					// The last line has only been written partially when the bot was stopped. The previous record of
+					// the place is still valid.
+					log.WithError(jsonErr).WithField("path", s.path).Warn("Ignoring the incomplete last line of the history file.")
+					break
+				}
+				return fmt.Errorf("cannot parse line %d of the history file: %w", line, jsonErr)
+			}
+			s.mem.Set(record.Place, record.Messages)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read history file: %w", err)
+		}
+	}
+
+	now := time.Now()
+	for place, messages := range s.mem.messages {
+		var validMessages []TimedMessage
+		for _, message := range messages {
+			if now.Sub(message.Timestamp) <= s.expiration {
+				validMessages = append(validMessages, message)
+			}
+		}
+		s.mem.Set(place, validMessages)
+	}
+	return nil
+}
+
+func (s *FileHistoryStore) Get(place string) ([]TimedMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.mem.Get(place)
+}
+
+func (s *FileHistoryStore) Set(place string, messages []TimedMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.mem.Set(place, messages)
+	if s.file == nil {
+		return errors.New("history store is closed")
+	}
+
+	raw, err := json.Marshal(historyRecord{Place: place, Messages: messages})
+	if err != nil {
+		return fmt.Errorf("cannot marshal history record: %w", err)
+	}
+	_, err = s.file.Write(append(raw, '\n'))
+	if err != nil {
+		return fmt.Errorf("cannot write history file: %w", err)
+	}
+	s.records++
+
+	if s.records > compactMinRecords && s.records > 2*len(s.mem.messages) {
+		return s.compact()
+	}
+	return nil
+}
+
+// Compact rewrites the file, so it contains only one record per place.
+func (s *FileHistoryStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.compact()
+}
+
+func (s *FileHistoryStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create temporary history file: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for place, messages := range s.mem.messages {
+		err = encoder.Encode(historyRecord{Place: place, Messages: messages})
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("cannot write temporary history file: %w", err)
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write temporary history file: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("cannot close temporary history file: %w", err)
+	}
+
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		return fmt.Errorf("cannot replace history file: %w", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open history file: %w", err)
+	}
+	s.records = len(s.mem.messages)
+	return nil
+}
+
+// Close compacts the file, so the next start loads it quickly, then closes it.
+func (s *FileHistoryStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	if err := s.compact(); err != nil {
+		log.WithError(err).Warn("Cannot compact the history file.")
+		if s.file == nil {
+			return err
+		}
+	}
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
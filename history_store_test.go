@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileHistoryStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	store, err := NewFileHistoryStore(path, time.Hour)
+	assert.NoError(t, err)
+
+	history := NewHistory()
+	history.Store = store
+	history.Expiration = time.Hour
+	history.Size = 4
+
+	history.Add("chat1", openai.Message{Role: "user", Content: "Hello"})
+	history.Add("chat1", openai.Message{Role: "assistant", Content: "Hi"})
+	history.Add("chat2", openai.Message{Role: "user", Content: "Other room"})
+	history.Clear("chat2")
+	// A message that is already older than the retention when the bot restarts.
+	store.Set("chat3", []TimedMessage{{
+		Message:   openai.Message{Role: "user", Content: "Old"},
+		Timestamp: time.Now().Add(-2 * time.Hour),
+	}})
+	assert.NoError(t, store.Close())
+
+	// Simulate a crash during writing the last line.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	f.WriteString(`{"place":"chat1","messages":[{"ro`)
+	f.Close()
+
+	store, err = NewFileHistoryStore(path, time.Hour)
+	assert.NoError(t, err)
+	history.Store = store
+
+	// The timestamps are kept, so the retention still applies.
+	messages, _ := store.Get("chat1")
+	assert.Equal(t, 2, len(messages))
+	assert.Less(t, time.Since(messages[0].Timestamp), time.Minute)
+	assert.Equal(t, "Hello\nHi", history.GetAsString("chat1"))
+	assert.Equal(t, "", history.GetAsString("chat2"))
+	assert.Equal(t, "", history.GetAsString("chat3"))
+
+	// The file is compacted when it is opened, only chat1 is left.
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(raw), "\n"))
+
+	history.Add("chat1", openai.Message{Role: "user", Content: "Again"})
+	assert.NoError(t, store.Close())
+
+	store, err = NewFileHistoryStore(path, time.Hour)
+	assert.NoError(t, err)
+	history.Store = store
+	assert.Equal(t, "Hello\nHi\nAgain", history.GetAsString("chat1"))
+	assert.NoError(t, store.Close())
+}
+
+func TestFileHistoryStoreRoomRetention(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history.jsonl")
+	store, err := NewFileHistoryStore(path, time.Hour)
+	assert.NoError(t, err)
+	store.Set("archive", []TimedMessage{{
+		Message:   openai.Message{Role: "user", Content: "Yesterday"},
+		Timestamp: time.Now().Add(-2 * time.Hour),
+	}})
+	assert.NoError(t, store.Close())
+
+	// The global retention has passed, but the room keeps its messages for a day.
+	cfgPath := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(cfgPath, []byte("OpenAI:\n  MessageRetention: 1h\nRooms:\n  - Match: archive\n    OpenAI:\n      MessageRetention: 24h\nHistoryStore:\n  Type: file\n  Path: "+path+"\n"), 0600))
+	cfg, err := config.NewConfig(cfgPath)
+	assert.NoError(t, err)
+	history, err := NewHistoryFromConfig(cfg)
+	assert.NoError(t, err)
+
+	oa, err := cfg.ResolveOpenAI("archive", "r1", "joe")
+	assert.NoError(t, err)
+	assert.Equal(t, "Yesterday", history.WithLimits(oa).GetAsString("archive"))
+	assert.Equal(t, "", history.GetAsString("archive"))
+	assert.NoError(t, history.Store.Close())
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mimrock/rocketchat_openai_bot/config"
 	"github.com/mimrock/rocketchat_openai_bot/openai"
 	"github.com/stretchr/testify/assert"
 )
@@ -56,3 +57,81 @@ func TestHistory(t *testing.T) {
 	// message2 should be removed from the history because of size limit.
 	assert.Equal(t, "m3\nm4\nm5\nm6", history.GetAsString("chat1"))
 }
+
+func TestHistoryTokenBudget(t *testing.T) {
+	history := NewHistory()
+	history.Expiration = time.Hour
+	history.Size = 10
+	history.Model = "gpt-3.5-turbo"
+
+	history.Add("chat1", openai.Message{Role: "user", Content: "first question"})
+	history.Add("chat1", openai.Message{Role: "assistant", Content: "first answer"})
+	history.Add("chat1", openai.Message{Role: "user", Content: "second question"})
+	history.Add("chat1", openai.Message{Role: "assistant", Content: "second answer"})
+
+	all := history.AsOpenAIMessages("chat1")
+	assert.Equal(t, 4, len(all))
+	full := openai.CountMessageTokens("gpt-3.5-turbo", all) - openai.CountMessageTokens("gpt-3.5-turbo", nil)
+
+	// Everything fits.
+	assert.Equal(t, 4, len(history.AsOpenAIMessagesWithin("chat1", "gpt-3.5-turbo", full)))
+
+	// The oldest turn is dropped as a whole, so the history never starts with an answer.
+	messages := history.AsOpenAIMessagesWithin("chat1", "gpt-3.5-turbo", full-1)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "second question", messages[0].Content)
+
+	assert.Equal(t, 0, len(history.AsOpenAIMessagesWithin("chat1", "gpt-3.5-turbo", 0)))
+
+	// MaxLength limits the history even if the budget is bigger.
+	history.MaxLength = full - 1
+	assert.Equal(t, 2, len(history.AsOpenAIMessages("chat1")))
+	assert.Equal(t, "second question\nsecond answer", history.GetAsString("chat1"))
+}
+
+func TestHistorySeed(t *testing.T) {
+	h := NewHistory().WithLimits(config.OpenAIConfig{HistorySize: 2})
+	old := TimedMessage{Message: openai.Message{Role: "user", Content: "old"}, Timestamp: time.Now().Add(-time.Hour)}
+	seed := []TimedMessage{
+		old,
+		{Message: openai.Message{Role: "user", Content: "a: hi"}, Timestamp: time.Now()},
+		{Message: openai.Message{Role: "assistant", Content: "hello"}, Timestamp: time.Now()},
+	}
+
+	assert.True(t, h.Seed("room", seed))
+	assert.Equal(t, []openai.Message{
+		{Role: "user", Content: "a: hi"},
+		{Role: "assistant", Content: "hello"},
+	}, h.AsOpenAIMessages("room"))
+
+	// Only an empty history is seeded.
+	assert.False(t, h.Seed("room", []TimedMessage{old}))
+	assert.Len(t, h.AsOpenAIMessages("room"), 2)
+
+	// Expired messages are not seeded.
+	expiration := time.Minute
+	h = NewHistory().WithLimits(config.OpenAIConfig{HistorySize: 2, MessageRetention: &expiration})
+	h.Seed("room", []TimedMessage{old})
+	assert.Empty(t, h.AsOpenAIMessages("room"))
+}
+
+func TestHistoryDropLastTurn(t *testing.T) {
+	history := NewHistory()
+	history.Expiration = time.Hour
+	history.Size = 10
+
+	history.Add("chat1", openai.Message{Role: "user", Content: "Hello"})
+	history.Add("chat1", openai.Message{Role: "assistant", Content: "Hi"})
+	history.Add("chat1", openai.Message{Role: "user", Content: "How are you?"})
+	history.Add("chat1", openai.Message{Role: "assistant", Content: "Fine."})
+	history.DropLastTurn("chat1")
+	assert.Equal(t, "Hello\nHi", history.GetAsString("chat1"))
+	history.DropLastTurn("chat1")
+	assert.Equal(t, "", history.GetAsString("chat1"))
+
+	// A seeded history may start with answers, they are kept if there is no user message after them.
+	history.Add("chat2", openai.Message{Role: "assistant", Content: "Welcome!"})
+	history.Add("chat2", openai.Message{Role: "assistant", Content: "Ask me anything."})
+	history.DropLastTurn("chat2")
+	assert.Equal(t, "Welcome!\nAsk me anything.", history.GetAsString("chat2"))
+}
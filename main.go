@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/mimrock/rocketchat_openai_bot/openai"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
 	"github.com/mimrock/rocketchat_openai_bot/rocket"
 
 	log "github.com/sirupsen/logrus"
@@ -27,6 +33,12 @@ func main() {
 	}
 
 	setLogLevel(cfg.LogLevel)
+
+	if cfg.Tokenizer.Dir != "" {
+		if err := openai.LoadEncodings(cfg.Tokenizer.Dir); err != nil {
+			log.Fatal("Cannot load the tokenizer:", err.Error())
+		}
+	}
 	log.WithField("message", "Before Connection").Debug("NewConnectionFromConfig")
 	rock, err := rocket.NewConnectionFromConfig(cfg)
 
@@ -41,21 +53,65 @@ func main() {
 		WithField("hostSSL", rock.HostSSL).
 		WithField("userName", rock.UserName).
 		Debug("Connection to rocketchat established.")
-	
+
 	err = rock.UserTemporaryStatus(rocket.STATUS_ONLINE)
 	if err != nil {
 		log.WithError(err).Error("Cannot set temporary status to online.")
 	}
 	//rock.UserDefaultStatus(rocket.STATUS_ONLINE)
-log.WithField("message", "Before Connection").Debug("OPenai")
-	oa := openai.NewFromConfig(cfg)
 
-	hist := NewHistoryFromConfig(cfg)
+	hist, err := NewHistoryFromConfig(cfg)
+	if err != nil {
+		log.Fatal("Cannot initialize history:", err.Error())
+	}
+
+	bot, err := NewBot(cfg, rock, hist)
+	if err != nil {
+		log.Fatal("Cannot initialize the bot:", err.Error())
+	}
+
+	if cfg.Metrics.Listen != "" {
+		metricsServer, err := metrics.Listen(cfg.Metrics.Listen)
+		if err != nil {
+			log.Fatal("Cannot start the metrics listener:", err.Error())
+		}
+		log.WithField("address", cfg.Metrics.Listen).Info("Serving the metrics on /metrics.")
+		defer metricsServer.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	serve(ctx, cfg, rock, bot)
+	// A second signal kills the bot right away.
+	stop()
+
+	log.Info("Closing the connection to Rocket.Chat.")
+	closeCtx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	if err := rock.Shutdown(closeCtx); err != nil {
+		log.WithError(err).Warn("Cannot close the connection to Rocket.Chat cleanly.")
+	}
+	if err := hist.Store.Close(); err != nil {
+		log.WithError(err).Error("Cannot close the history store.")
+	}
+	log.Info("Bartender stopped.")
+}
+
+// closeTimeout is how long the bot waits for Rocket.Chat while it closes the connection.
+const closeTimeout = 10 * time.Second
+
+// serve hands the messages addressed to the bot over to the workers, until ctx is done or the connection is closed.
+// Then it waits for the messages in progress, at most for the ShutdownTimeout of the dispatcher, before it cancels
+// them.
+func serve(ctx context.Context, cfg *config.Config, rock *rocket.RocketCon, bot *Bot) {
+	dispatcher := NewDispatcher(cfg.Dispatcher.Workers, cfg.Dispatcher.QueueSize, bot.HandleMessage)
 
 	for {
-			log.WithField("message", "Before").Debug("Get messages")
 		// Wait for a new message to come in
-		msg, err := rock.GetNewMessage()
+		msg, err := rock.GetNewMessageContext(ctx)
+		if ctx.Err() != nil {
+			log.Info("Shutting down, no more messages are accepted.")
+			break
+		}
 
 		// If error, quit because that means the connection probably quit
 		if err != nil {
@@ -63,22 +119,33 @@ log.WithField("message", "Before Connection").Debug("OPenai")
 			break
 		}
 
-		// If begins with '@Username ' or is in private chat
-		// @todo robot must be pinged in a private room
-		if msg.AmIPinged || msg.IsDirect {
-		        log.WithField("message", "MAIN").Debug("I am in MAIN")
+		if bot.Triggered(msg) {
 			log.WithField("message", msg).Debug("Incoming message for the bot.")
-			err = OpenAIResponse(msg, oa, hist)
-			if err != nil {
-				log.WithError(err).Error("OpenAI request failed.")
-				_, err = msg.Reply(fmt.Sprintf("@%s :x: Sorry, something went wrong while processing your request. This could be due to a configuration issue, a problem with the OpenAI API, or a bug in the system. Please check your configuration settings or try again later. More details can be found in the logs. :x:", msg.UserName))
+			// The messages of a conversation are handled in order, the conversations in parallel.
+			position, err := dispatcher.Submit(historyPlace(msg), msg)
+			if errors.Is(err, ErrQueueFull) {
+				log.WithField("pending", dispatcher.Pending()).Warn("The queue is full, message dropped.")
+				metrics.Errors.Inc("queue_full")
+				_, err = msg.Reply(fmt.Sprintf("@%s :hourglass: Sorry, the bot is too busy right now. Please try again later.", msg.UserName))
 				if err != nil {
-					log.WithError(err).Error("Cannot send reply about the error rocketchat.")
+					log.WithError(err).Error("Cannot send reply about the full queue to rocketchat.")
+				}
+			} else if position > 0 && position >= cfg.Dispatcher.NoticeAfter {
+				_, err = msg.Reply(fmt.Sprintf("@%s :hourglass: The bot is busy, your request is queued (#%d).", msg.UserName, position))
+				if err != nil {
+					log.WithError(err).Error("Cannot send reply about the queue position to rocketchat.")
 				}
-
 			}
 		}
 	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), cfg.Dispatcher.ShutdownTimeout)
+	defer cancel()
+	if err := dispatcher.WaitContext(waitCtx); err != nil {
+		log.WithField("pending", dispatcher.Pending()).Warn("The answers in progress have not finished in time, canceling them.")
+		bot.Cancel()
+		dispatcher.Wait()
+	}
 }
 
 func setLogLevel(logLevel string) {
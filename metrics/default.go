@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default is the registry of the metrics of the bot, served on /metrics.
+var Default = NewRegistry()
+
+var (
+	MessagesReceived = Default.NewCounter("bartender_messages_received_total",
+		"Messages received from other users, by room.", "room")
+	RepliesSent = Default.NewCounter("bartender_replies_sent_total",
+		"Messages sent by the bot, by room, including the notices. Each part of a split reply is counted.", "room")
+	OpenAILatency = Default.NewHistogram("bartender_openai_request_duration_seconds",
+		"Duration of the OpenAI requests, by endpoint and model. For streams, until the end of the stream.",
+		DefaultBuckets, "endpoint", "model")
+	TokensUsed = Default.NewCounter("bartender_openai_tokens_total",
+		"Tokens used by the completions, by model and type (prompt or completion).", "model", "type")
+	ModerationFlags = Default.NewCounter("bartender_moderation_flags_total",
+		"Flags of the moderation endpoint, by category.", "category")
+	Errors = Default.NewCounter("bartender_errors_total",
+		"Messages that could not be answered, by error type.", "type")
+	Reconnects = Default.NewCounter("bartender_websocket_reconnects_total",
+		"Reconnections to the Rocket.Chat websocket.")
+	QueueDepth = Default.NewGauge("bartender_queue_depth",
+		"Messages waiting for a worker.")
+)
+
+// Handler serves the metrics of the Default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Listen serves the metrics of the Default registry on /metrics at the address, in the background. The returned server
+// is shut down to stop it.
+func Listen(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Error("The metrics listener has stopped.")
+		}
+	}()
+	return srv, nil
+}
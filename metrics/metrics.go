@@ -0,0 +1,298 @@
+// Package metrics collects counters, gauges and histograms, and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets in seconds, for requests that take up to a few minutes.
+var DefaultBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// metric is a family of series with the same name, one for each combination of label values.
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds the metrics exposed together.
+type Registry struct {
+	mutex   sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds the metric to the registry. The names are fixed in the code, so a duplicate is a bug.
+func (r *Registry) register(name string, m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %s is registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// NewCounter registers a counter with the label names.
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{}
+	c.init(name, help, labels)
+	r.register(name, c)
+	return c
+}
+
+// NewGauge registers a gauge with the label names.
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{}
+	g.init(name, help, labels)
+	r.register(name, g)
+	return g
+}
+
+// NewHistogram registers a histogram with the upper bounds of the buckets, in increasing order, and the label names.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets}
+	h.init(name, help, labels)
+	r.register(name, h)
+	return h
+}
+
+// Write writes all metrics in the Prometheus text format, in the order they were registered.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns an HTTP handler that serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.Write(w)
+	})
+}
+
+// family is the common part of the metric types: the name, the help, and the values by label values.
+type family struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+// series is a set of label values and the value of the metric for them.
+type series struct {
+	labels string
+	value  float64
+	// counts are the number of observations by bucket, only for histograms.
+	counts []uint64
+	count  uint64
+}
+
+// init sets up the family. A metric without labels has a single series, which is exposed from the start.
+func (f *family) init(name string, help string, labels []string) {
+	f.name, f.help, f.labels = name, help, labels
+	f.series = make(map[string]*series)
+	if len(labels) == 0 {
+		f.get(nil)
+	}
+}
+
+// get returns the series of the label values, it must be called with the mutex held.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		pairs := make([]string, len(values))
+		for i, value := range values {
+			pairs[i] = f.labels[i] + `="` + escapeLabel(value) + `"`
+		}
+		s = &series{labels: strings.Join(pairs, ",")}
+		f.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series ordered by label values, so the output is stable. It must be called with the mutex held.
+func (f *family) sorted() []*series {
+	list := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].labels < list[j].labels })
+	return list
+}
+
+func (f *family) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, kind)
+}
+
+// Counter is a value that only goes up, e.g. the number of messages.
+type Counter struct {
+	family
+}
+
+// Inc adds one to the counter of the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter of the label values. Negative values are ignored.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.get(values).value += v
+}
+
+// Value returns the value of the counter of the label values.
+func (c *Counter) Value(values ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.get(values).value
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeHeader(w, "counter")
+	for _, s := range c.sorted() {
+		writeSample(w, c.name, s.labels, s.value)
+	}
+}
+
+// Gauge is a value that can go up and down, e.g. the length of a queue.
+type Gauge struct {
+	family
+}
+
+// Set sets the gauge of the label values.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.get(values).value = v
+}
+
+// Value returns the value of the gauge of the label values.
+func (g *Gauge) Value(values ...string) float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.get(values).value
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.writeHeader(w, "gauge")
+	for _, s := range g.sorted() {
+		writeSample(w, g.name, s.labels, s.value)
+	}
+}
+
+// Histogram counts observations, e.g. durations, in buckets.
+type Histogram struct {
+	family
+	buckets []float64
+}
+
+// Observe adds an observation to the histogram of the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.get(values)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// Count returns the number of observations of the label values.
+func (h *Histogram) Count(values ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.get(values).count
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, s := range h.sorted() {
+		sep := ""
+		if s.labels != "" {
+			sep = ","
+		}
+		for i, bound := range h.buckets {
+			var count uint64
+			if s.counts != nil {
+				count = s.counts[i]
+			}
+			writeSample(w, h.name+"_bucket", s.labels+sep+`le="`+formatFloat(bound)+`"`, float64(count))
+		}
+		writeSample(w, h.name+"_bucket", s.labels+sep+`le="+Inf"`, float64(s.count))
+		writeSample(w, h.name+"_sum", s.labels, s.value)
+		writeSample(w, h.name+"_count", s.labels, float64(s.count))
+	}
+}
+
+func writeSample(w io.Writer, name string, labels string, value float64) {
+	if labels != "" {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(value))
+	} else {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
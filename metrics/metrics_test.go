@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	messages := r.NewCounter("messages_total", "Messages by room.", "room")
+	reconnects := r.NewCounter("reconnects_total", "Reconnects.")
+	depth := r.NewGauge("queue_depth", "Queue depth.")
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{0.5, 1}, "endpoint")
+
+	messages.Inc("random")
+	messages.Inc(`say "hi"`)
+	messages.Add(2, "random")
+	messages.Add(-1, "random")
+	depth.Set(3)
+	latency.Observe(0.25, "completion")
+	latency.Observe(2, "completion")
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP messages_total Messages by room.
+# TYPE messages_total counter
+messages_total{room="random"} 3
+messages_total{room="say \"hi\""} 1
+# HELP reconnects_total Reconnects.
+# TYPE reconnects_total counter
+reconnects_total 0
+# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="completion",le="0.5"} 1
+latency_seconds_bucket{endpoint="completion",le="1"} 1
+latency_seconds_bucket{endpoint="completion",le="+Inf"} 2
+latency_seconds_sum{endpoint="completion"} 2.25
+latency_seconds_count{endpoint="completion"} 2
+`, b.String())
+	assert.Equal(t, float64(0), reconnects.Value())
+	assert.Equal(t, uint64(2), latency.Count("completion"))
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("total", "Total.", "room")
+	assert.Panics(t, func() { r.NewGauge("total", "Total again.") })
+	assert.Panics(t, func() { c.Inc() })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("total", "Total.").Inc()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "\ntotal 1\n")
+}
@@ -0,0 +1,191 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bpe is a byte pair encoding with the ranks of a tiktoken file, see
+// https://github.com/openai/tiktoken/blob/main/src/lib.rs
+type bpe struct {
+	// ranks are the ranks of the tokens by their bytes. A lower rank is merged first.
+	ranks map[string]int
+	// pattern is the pre-tokenizer pattern without the \s+(?!\S) alternative, see split.
+	pattern *regexp.Regexp
+}
+
+// The pre-tokenizer patterns of the encodings. Go does not support lookaheads, so the \s+(?!\S) alternative is left
+// out and emulated by split. \s is replaced by the Unicode whitespace, like in tiktoken.
+const (
+	ws = `\s\x0b\x{85}\p{Z}`
+
+	cl100kPattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^` + ws + `\p{L}\p{N}]+[\r\n]*|[` + ws + `]*[\r\n]+|[` + ws + `]+`
+
+	o200kPattern = `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}| ?[^` + ws + `\p{L}\p{N}]+[\r\n/]*|[` + ws + `]*[\r\n]+|[` + ws + `]+`
+)
+
+// loadBPE reads the ranks of a tiktoken file: a token in base64 and its rank on each line.
+func loadBPE(r io.Reader, pattern string) (*bpe, error) {
+	b := &bpe{ranks: make(map[string]int), pattern: regexp.MustCompile(pattern)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %d", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(string(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid token on line %d: %w", line, err)
+		}
+		rank, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rank on line %d: %w", line, err)
+		}
+		b.ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(b.ranks) == 0 {
+		return nil, errors.New("no tokens")
+	}
+	return b, nil
+}
+
+// count returns the number of tokens of the text.
+func (b *bpe) count(text string) int {
+	n := 0
+	for _, piece := range b.split(text) {
+		n += b.pieceTokens(piece)
+	}
+	return n
+}
+
+// split splits the text into pieces like the pre-tokenizer of the encoding. The whitespace before a word or a symbol
+// is a piece without its last character, which is part of the next piece instead, as \s+(?!\S) would match it.
+func (b *bpe) split(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := b.pattern.FindStringIndex(text)
+		if loc == nil || loc[1] == 0 {
+			// Every character is matched by one of the alternatives, this does not happen.
+			pieces = append(pieces, text)
+			break
+		}
+		end := loc[1]
+		piece := text[:end]
+		if end < len(text) && isSpaces(piece) {
+			if last, size := utf8.DecodeLastRuneInString(piece); size < len(piece) && last != '\r' && last != '\n' {
+				end -= size
+				piece = text[:end]
+			}
+		}
+		pieces = append(pieces, piece)
+		text = text[end:]
+	}
+	return pieces
+}
+
+// isSpaces returns true if the piece has whitespace only, but no line breaks.
+func isSpaces(piece string) bool {
+	for _, r := range piece {
+		if r == '\r' || r == '\n' || !(unicode.IsSpace(r) || unicode.Is(unicode.Z, r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// pieceTokens returns the number of tokens of a piece by merging the pairs of bytes with the lowest rank until no
+// pair can be merged.
+func (b *bpe) pieceTokens(piece string) int {
+	if _, ok := b.ranks[piece]; ok {
+		return 1
+	}
+
+	// parts are the start offsets of the tokens, and the end of the piece.
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+	rank := func(i int) int {
+		if i+2 >= len(parts) {
+			return math.MaxInt
+		}
+		if r, ok := b.ranks[piece[parts[i]:parts[i+2]]]; ok {
+			return r
+		}
+		return math.MaxInt
+	}
+	ranks := make([]int, len(parts)-1)
+	for i := range ranks {
+		ranks[i] = rank(i)
+	}
+
+	for len(parts) > 2 {
+		min, at := math.MaxInt, -1
+		for i, r := range ranks {
+			if r < min {
+				min, at = r, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		parts = append(parts[:at+1], parts[at+2:]...)
+		ranks = append(ranks[:at], ranks[at+1:]...)
+		ranks[at] = rank(at)
+		if at > 0 {
+			ranks[at-1] = rank(at - 1)
+		}
+	}
+	return len(parts) - 1
+}
+
+// encodingFiles are the names of the tiktoken files of the encodings, as they are published by OpenAI.
+var encodingFiles = map[*encoding]string{
+	cl100k: "cl100k_base.tiktoken",
+	o200k:  "o200k_base.tiktoken",
+}
+
+// LoadEncodings loads the BPE ranks of the encodings from the tiktoken files in dir, cl100k_base.tiktoken and
+// o200k_base.tiktoken, so the tokens are counted exactly. The tokens of an encoding without a file are estimated. It
+// must be called before the tokens are counted, e.g. at startup.
+func LoadEncodings(dir string) error {
+	for enc, name := range encodingFiles {
+		path := filepath.Join(dir, name)
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			log.WithField("path", path).Warn("The BPE ranks are missing, the tokens are estimated.")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot open the BPE ranks: %w", err)
+		}
+		b, err := loadBPE(f, enc.pattern)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("cannot load the BPE ranks from %s: %w", path, err)
+		}
+		enc.bpe = b
+	}
+	return nil
+}
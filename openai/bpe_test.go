@@ -0,0 +1,86 @@
+package openai
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRanks is a tiktoken file with every byte, and a few merges that make "hello" two tokens: "hell" and "o".
+func testRanks() string {
+	var b strings.Builder
+	for i, token := range []string{"ll", "he", "hell"} {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), i)
+	}
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), 1000+i)
+	}
+	return b.String()
+}
+
+func TestBPESplit(t *testing.T) {
+	cl, err := loadBPE(strings.NewReader(testRanks()), cl100kPattern)
+	require.NoError(t, err)
+	o, err := loadBPE(strings.NewReader(testRanks()), o200kPattern)
+	require.NoError(t, err)
+
+	// The pieces of tiktoken.
+	for text, pieces := range map[string][]string{
+		"Hello world":   {"Hello", " world"},
+		"I'm here":      {"I", "'m", " here"},
+		"don't":         {"don", "'t"},
+		"1234567":       {"123", "456", "7"},
+		"a   b":         {"a", "  ", " b"},
+		"x = 1":         {"x", " =", " ", "1"},
+		"foo\n\n  bar":  {"foo", "\n\n", " ", " bar"},
+		"end  ":         {"end", "  "},
+		"getUserName()": {"getUserName", "()"},
+	} {
+		assert.Equal(t, pieces, cl.split(text), text)
+	}
+	for text, pieces := range map[string][]string{
+		"don't":         {"don't"},
+		"getUserName()": {"get", "User", "Name", "()"},
+		"a   b":         {"a", "  ", " b"},
+	} {
+		assert.Equal(t, pieces, o.split(text), text)
+	}
+}
+
+func TestBPECount(t *testing.T) {
+	b, err := loadBPE(strings.NewReader(testRanks()), cl100kPattern)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, b.pieceTokens("hello"))
+	assert.Equal(t, 1, b.pieceTokens("hell"))
+	assert.Equal(t, 3, b.pieceTokens(" hello"))
+	assert.Equal(t, 3, b.pieceTokens("xyz"))
+	assert.Equal(t, 0, b.count(""))
+	assert.Equal(t, 5, b.count("hello hello"))
+
+	_, err = loadBPE(strings.NewReader("aGVsbG8=\n"), cl100kPattern)
+	assert.Error(t, err)
+	_, err = loadBPE(strings.NewReader("not-base64! 1\n"), cl100kPattern)
+	assert.Error(t, err)
+}
+
+func TestLoadEncodings(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cl100k_base.tiktoken"), []byte(testRanks()), 0600))
+	estimate := CountTokens("gpt-4o", "hello hello")
+	t.Cleanup(func() { cl100k.bpe, o200k.bpe = nil, nil })
+
+	require.NoError(t, LoadEncodings(dir))
+	assert.Equal(t, 5, CountTokens("gpt-4", "hello hello"))
+	// There are no ranks of o200k, it is still estimated.
+	assert.Equal(t, estimate, CountTokens("gpt-4o", "hello hello"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "o200k_base.tiktoken"), []byte("invalid\n"), 0600))
+	assert.Error(t, LoadEncodings(dir))
+}
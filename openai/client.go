@@ -0,0 +1,124 @@
+package openai
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+)
+
+// The defaults of the HTTP settings.
+const (
+	defaultTimeout             = 2 * time.Minute
+	defaultCompletionTimeout   = 5 * time.Minute
+	defaultModerationTimeout   = 30 * time.Second
+	defaultDialTimeout         = 30 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConnsPerHost = 10
+)
+
+// clientSettings are the settings of the transport of a client. The clients with the same settings are shared, so
+// the connections are reused across the rooms and the messages.
+type clientSettings struct {
+	Proxy               string
+	CABundle            string
+	DialTimeout         time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+}
+
+var (
+	clients      = make(map[clientSettings]*http.Client)
+	clientsMutex sync.Mutex
+)
+
+// NewClientFromConfig returns the HTTP client for the settings. The same client is returned for the same settings.
+func NewClientFromConfig(cfg config.HTTP) (*http.Client, error) {
+	settings := clientSettings{
+		Proxy:               cfg.Proxy,
+		CABundle:            cfg.CABundle,
+		DialTimeout:         defaultDialTimeout,
+		IdleConnTimeout:     defaultIdleConnTimeout,
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+	}
+	if cfg.DialTimeout != nil {
+		settings.DialTimeout = *cfg.DialTimeout
+	}
+	if cfg.IdleConnTimeout != nil {
+		settings.IdleConnTimeout = *cfg.IdleConnTimeout
+	}
+	if cfg.MaxIdleConnsPerHost != nil {
+		settings.MaxIdleConnsPerHost = *cfg.MaxIdleConnsPerHost
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	if client, ok := clients[settings]; ok {
+		return client, nil
+	}
+	client, err := newClient(settings)
+	if err != nil {
+		return nil, err
+	}
+	clients[settings] = client
+	return client, nil
+}
+
+func newClient(settings clientSettings) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   settings.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.IdleConnTimeout = settings.IdleConnTimeout
+	transport.MaxIdleConnsPerHost = settings.MaxIdleConnsPerHost
+
+	if settings.Proxy != "" {
+		proxy, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if settings.CABundle != "" {
+		pem, err := os.ReadFile(settings.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", settings.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// withTimeout returns a context that is canceled after the timeout, or never if the timeout is not positive.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// httpClient returns the client of the OpenAI settings, or the default client if there is none, e.g. in tests.
+func (o *OpenAI) httpClient() *http.Client {
+	if o.Client == nil {
+		return http.DefaultClient
+	}
+	return o.Client
+}
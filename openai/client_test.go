@@ -0,0 +1,78 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClientFromConfig(t *testing.T) {
+	a, err := NewClientFromConfig(config.HTTP{})
+	require.NoError(t, err)
+	b, err := NewClientFromConfig(config.HTTP{})
+	require.NoError(t, err)
+	assert.Same(t, a, b)
+
+	proxy, err := NewClientFromConfig(config.HTTP{Proxy: "http://proxy.example.com:3128"})
+	require.NoError(t, err)
+	assert.NotSame(t, a, proxy)
+	req, _ := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", nil)
+	proxyURL, err := proxy.Transport.(*http.Transport).Proxy(req)
+	require.NoError(t, err)
+	assert.Equal(t, "proxy.example.com:3128", proxyURL.Host)
+
+	_, err = NewClientFromConfig(config.HTTP{CABundle: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(empty, []byte("no certificates"), 0600))
+	_, err = NewClientFromConfig(config.HTTP{CABundle: empty})
+	assert.Error(t, err)
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The cancellation of the request is noticed once the body is read.
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(time.Minute):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	short := 20 * time.Millisecond
+	maxAttempts := 1
+	oa, err := New(config.OpenAIConfig{
+		Provider:           "compatible",
+		BaseURL:            server.URL,
+		CompletionEndpoint: "v1/chat/completions",
+		ModerationEndpoint: "v1/moderations",
+		Retry:              config.Retry{MaxAttempts: &maxAttempts},
+		HTTP:               config.HTTP{CompletionTimeout: &short, ModerationTimeout: &short},
+	})
+	require.NoError(t, err)
+
+	_, err = oa.Completion(&CompletionRequest{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	_, err = oa.CompletionStream(&CompletionRequest{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	_, err = oa.Moderation(&ModerationRequest{Input: "hello"})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	// The context of the caller cancels the request too.
+	oa.CompletionTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = oa.CompletionContext(ctx, &CompletionRequest{})
+	assert.True(t, errors.Is(err, context.Canceled), err)
+}
@@ -1,5 +1,10 @@
 package openai
 
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
 // https://openai.com/blog/introducing-chatgpt-and-whisper-apis
 
 type CompletionResponse struct {
@@ -21,13 +26,160 @@ type CompletionRequest struct {
 	PresencePenalty  *float64  `json:"presence_penalty,omitempty"`
 	FrequencyPenalty *float64  `json:"frequency_penalty,omitempty"`
 	User             *string   `json:"user,omitempty"`
+	Stream           bool      `json:"stream,omitempty"`
+	// StreamOptions is only sent with Stream.
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Tools         []Tool         `json:"tools,omitempty"`
+	// ToolChoice is "none", "auto", "required" or a specific tool, see:
+	// https://platform.openai.com/docs/api-reference/chat/create#chat-create-tool_choice
+	ToolChoice interface{} `json:"tool_choice,omitempty"`
 }
 
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Parts are sent after the Content, e.g. images for vision-capable models. They are not part of the JSON form of
+	// the message, so they are not saved with the history either, only sent in requests.
+	Parts []ContentPart `json:"-"`
+	// ToolCalls are the tools the assistant wants to call before it answers.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallId is the call the message with the "tool" role is the result of.
+	ToolCallId string `json:"tool_call_id,omitempty"`
+}
+
+// https://platform.openai.com/docs/guides/vision
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+	// Detail is "low", "high" or "auto".
+	Detail string `json:"detail,omitempty"`
+}
+
+// NewImagePart returns a content part with the image embedded as a data URI.
+func NewImagePart(mimeType string, data []byte, detail string) ContentPart {
+	return ContentPart{
+		Type: "image_url",
+		ImageURL: &ImageURL{
+			URL:    "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data),
+			Detail: detail,
+		},
+	}
+}
+
+// wireMessage is a Message as it is sent to the API: the content is either a string, or a list of parts.
+type wireMessage struct {
+	Role       string      `json:"role"`
+	Content    interface{} `json:"content"`
+	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
+	ToolCallId string      `json:"tool_call_id,omitempty"`
+}
+
+func (r CompletionRequest) MarshalJSON() ([]byte, error) {
+	messages := make([]wireMessage, len(r.Messages))
+	for i, m := range r.Messages {
+		messages[i] = wireMessage{
+			Role:       m.Role,
+			Content:    m.Content,
+			ToolCalls:  m.ToolCalls,
+			ToolCallId: m.ToolCallId,
+		}
+		if len(m.Parts) > 0 {
+			parts := make([]ContentPart, 0, len(m.Parts)+1)
+			if m.Content != "" {
+				parts = append(parts, ContentPart{Type: "text", Text: m.Content})
+			}
+			messages[i].Content = append(parts, m.Parts...)
+		}
+	}
+
+	// The Messages of the embedded request are shadowed by the wire messages.
+	type request CompletionRequest
+	return json.Marshal(struct {
+		request
+		Messages []wireMessage `json:"messages"`
+	}{request(r), messages})
+}
+
+type StreamOptions struct {
+	// IncludeUsage asks for a last chunk with the usage of the whole request, and no choices.
+	IncludeUsage bool `json:"include_usage"`
 }
 
+// https://platform.openai.com/docs/guides/function-calling
+
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type FunctionDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Parameters is the JSON schema of the arguments.
+	Parameters interface{} `json:"parameters,omitempty"`
+}
+
+type ToolCall struct {
+	// Index is only set in the deltas of a stream, where a call is sent in several pieces.
+	Index    *int         `json:"index,omitempty"`
+	Id       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name string `json:"name,omitempty"`
+	// Arguments is a JSON object, as generated by the model, so it may not be valid.
+	Arguments string `json:"arguments"`
+}
+
+// NewFunctionTool returns a tool that calls a function with the arguments described by the JSON schema.
+func NewFunctionTool(name string, description string, parameters interface{}) Tool {
+	return Tool{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        name,
+			Description: description,
+			Parameters:  parameters,
+		},
+	}
+}
+
+// AppendDelta adds a delta of a streamed completion to the message.
+func (m *Message) AppendDelta(delta Message) {
+	if delta.Role != "" {
+		m.Role = delta.Role
+	}
+	m.Content += delta.Content
+	for _, d := range delta.ToolCalls {
+		i := len(m.ToolCalls)
+		if d.Index != nil {
+			i = *d.Index
+		}
+		for len(m.ToolCalls) <= i {
+			m.ToolCalls = append(m.ToolCalls, ToolCall{})
+		}
+		call := &m.ToolCalls[i]
+		if d.Id != "" {
+			call.Id = d.Id
+		}
+		if d.Type != "" {
+			call.Type = d.Type
+		}
+		call.Function.Name += d.Function.Name
+		call.Function.Arguments += d.Function.Arguments
+	}
+}
+
+// FinishReasonLength is the finish reason of an answer that was cut off at the token limit.
+const FinishReasonLength = "length"
+
 type Choice struct {
 	Index        int     `json:"index"`
 	FinishReason string  `json:"finish_reason"`
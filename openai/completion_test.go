@@ -0,0 +1,69 @@
+package openai
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageAppendDelta(t *testing.T) {
+	var deltas []Message
+	for _, raw := range []string{
+		`{"role": "assistant", "content": null, "tool_calls": [{"index": 0, "id": "call1", "type": "function", "function": {"name": "calculate", "arguments": ""}}]}`,
+		`{"tool_calls": [{"index": 0, "function": {"arguments": "{\"expr"}}]}`,
+		`{"tool_calls": [{"index": 0, "function": {"arguments": "ession\": \"1+1\"}"}}]}`,
+		`{"tool_calls": [{"index": 1, "id": "call2", "type": "function", "function": {"name": "get_current_time", "arguments": "{}"}}]}`,
+	} {
+		var delta Message
+		assert.NoError(t, json.Unmarshal([]byte(raw), &delta))
+		deltas = append(deltas, delta)
+	}
+
+	var m Message
+	for _, delta := range deltas {
+		m.AppendDelta(delta)
+	}
+	assert.Equal(t, "assistant", m.Role)
+	assert.Equal(t, "", m.Content)
+	assert.Len(t, m.ToolCalls, 2)
+	assert.Equal(t, "call1", m.ToolCalls[0].Id)
+	assert.Equal(t, "calculate", m.ToolCalls[0].Function.Name)
+	assert.Equal(t, `{"expression": "1+1"}`, m.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, "call2", m.ToolCalls[1].Id)
+	assert.Equal(t, "get_current_time", m.ToolCalls[1].Function.Name)
+
+	m = Message{}
+	m.AppendDelta(Message{Role: "assistant", Content: "Hello"})
+	m.AppendDelta(Message{Content: " world"})
+	assert.Equal(t, Message{Role: "assistant", Content: "Hello world"}, m)
+}
+
+func TestCompletionRequestMarshal(t *testing.T) {
+	req := CompletionRequest{
+		Model: "gpt-4o",
+		Messages: []Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "What is this?", Parts: []ContentPart{NewImagePart("image/png", []byte("png"), "low")}},
+		},
+		Stream: true,
+	}
+	data, err := json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"model": "gpt-4o",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is this?"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,cG5n", "detail": "low"}}
+			]}
+		],
+		"stream": true
+	}`, string(data))
+
+	// Parts are only sent in requests, not saved.
+	data, err = json.Marshal(req.Messages[1])
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"role": "user", "content": "What is this?"}`, string(data))
+}
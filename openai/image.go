@@ -0,0 +1,93 @@
+package openai
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// https://platform.openai.com/docs/api-reference/images/create
+
+type ImageGenerationRequest struct {
+	Model   string `json:"model,omitempty"`
+	Prompt  string `json:"prompt"`
+	N       int    `json:"n,omitempty"`
+	Size    string `json:"size,omitempty"`
+	Quality string `json:"quality,omitempty"`
+	// ResponseFormat is "url" or "b64_json" for the DALL-E models, the GPT image models always return b64_json.
+	ResponseFormat string  `json:"response_format,omitempty"`
+	User           *string `json:"user,omitempty"`
+}
+
+type ImageGenerationResponse struct {
+	Created int         `json:"created"`
+	Data    []ImageData `json:"data"`
+	Error   HTTPError   `json:"error"`
+}
+
+type ImageData struct {
+	URL     string `json:"url"`
+	B64JSON string `json:"b64_json"`
+	// RevisedPrompt is the prompt the image was actually generated from, if the model has rewritten it.
+	RevisedPrompt string `json:"revised_prompt"`
+}
+
+// Decode returns the image of a b64_json response.
+func (d *ImageData) Decode() ([]byte, error) {
+	if d.B64JSON == "" {
+		return nil, fmt.Errorf("the response contains no image data")
+	}
+	return base64.StdEncoding.DecodeString(d.B64JSON)
+}
+
+func (o *OpenAI) ImageGenerationURL() (string, error) {
+	return o.Provider.URL(o.Images.Endpoint, o.Images.Model)
+}
+
+// NewImageGenerationRequest returns a request for a single image with the configured model, size and quality.
+func (o *OpenAI) NewImageGenerationRequest(prompt string, user string) *ImageGenerationRequest {
+	r := &ImageGenerationRequest{
+		Model:          o.Images.Model,
+		Prompt:         prompt,
+		N:              1,
+		Size:           o.Images.Size,
+		Quality:        o.Images.Quality,
+		ResponseFormat: "b64_json",
+	}
+	if strings.HasPrefix(r.Model, "gpt-image") {
+		r.ResponseFormat = ""
+	}
+	if len(user) > 0 {
+		r.User = &user
+	}
+	return r
+}
+
+func (o *OpenAI) ImageGeneration(iReq *ImageGenerationRequest) (*ImageGenerationResponse, error) {
+	return o.ImageGenerationContext(context.Background(), iReq)
+}
+
+// ImageGenerationContext is like ImageGeneration, but the request is canceled when ctx is done, or after the Timeout.
+func (o *OpenAI) ImageGenerationContext(ctx context.Context, iReq *ImageGenerationRequest) (*ImageGenerationResponse, error) {
+	ctx, cancel := withTimeout(ctx, o.Timeout)
+	defer cancel()
+	defer observeLatency("image", iReq.Model, time.Now())
+	var iResp ImageGenerationResponse
+	url, err := o.ImageGenerationURL()
+	if err != nil {
+		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
+	}
+	err = o.request(ctx, url, iReq, &iResp)
+	if iResp.Error.Message != "" {
+		return nil, fmt.Errorf("%w: %s ", err, iResp.Error.Message)
+	}
+	if err != nil {
+		return &iResp, fmt.Errorf("an error occured while performing the request: %w", err)
+	}
+	if len(iResp.Data) == 0 {
+		return nil, fmt.Errorf("no images returned")
+	}
+	return &iResp, nil
+}
@@ -0,0 +1,45 @@
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageGeneration(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/images/generations", r.URL.Path)
+		var req map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, map[string]interface{}{
+			"model":           "dall-e-3",
+			"prompt":          "a cat",
+			"n":               float64(1),
+			"size":            "1024x1024",
+			"response_format": "b64_json",
+		}, req)
+		w.Write([]byte(`{"created": 1, "data": [{"b64_json": "cG5n", "revised_prompt": "a fluffy cat"}]}`))
+	}))
+	defer server.Close()
+
+	oa, err := New(config.OpenAIConfig{
+		Provider: "compatible",
+		BaseURL:  server.URL,
+		Images:   config.Images{Size: "1024x1024"},
+	})
+	assert.NoError(t, err)
+	resp, err := oa.ImageGeneration(oa.NewImageGenerationRequest("a cat", ""))
+	assert.NoError(t, err)
+	data, err := resp.Data[0].Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "png", string(data))
+	assert.Equal(t, "a fluffy cat", resp.Data[0].RevisedPrompt)
+
+	// The GPT image models do not accept the response format.
+	oa.Images.Model = "gpt-image-1"
+	assert.Empty(t, oa.NewImageGenerationRequest("a cat", "").ResponseFormat)
+}
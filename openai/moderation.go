@@ -52,7 +52,8 @@ func (mr *ModerationResponse) IsFlagged() bool {
 	return false
 }
 
-func (mr *ModerationResponse) FlaggedReason() string {
+// FlaggedCategories returns the names of the categories the input has been flagged for, e.g. Hate/Threatening.
+func (mr *ModerationResponse) FlaggedCategories() []string {
 	var reasons []string
 	for _, res := range mr.Results {
 		if res.Flagged {
@@ -91,7 +92,11 @@ func (mr *ModerationResponse) FlaggedReason() string {
 			}
 		}
 	}
+	return reasons
+}
 
+func (mr *ModerationResponse) FlaggedReason() string {
+	reasons := mr.FlaggedCategories()
 	// @todo filter duplicates
 	r := strings.Join(reasons, ",")
 	if len(r) == 0 {
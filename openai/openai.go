@@ -2,12 +2,17 @@ package openai
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
+	"io"
 	"net/http"
-	"net/url"
 	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 //var ErrorContextLengthExceeded = errors.New("context length exceeded")
@@ -33,18 +38,67 @@ func (e *ErrorContextLengthExceeded) Is(tgt error) bool {
 }
 
 type OpenAI struct {
-	HostName           string
+	Provider           Provider
 	CompletionEndpoint string
 	ModerationEndpoint string
-	ApiToken           string
 	PrePrompt          string
 	Model              string
 	InputModeration    bool
 	OutputModeration   bool
 	SendUserId         bool
-	ModelParams        config.ModelParams
+	Stream             bool
+	StreamInterval     time.Duration
+	Retry              RetryPolicy
+	ContextWindow      int
+	// Vision enables sending the images attached to the messages, for models that support it.
+	Vision       bool
+	ImageDetail  string
+	MaxImageSize int64
+	// Transcription is the conversion of audio attachments to text, the defaults are filled in by New.
+	Transcription config.Transcription
+	// Images are the settings of the image generation, the defaults are filled in by New.
+	Images config.Images
+	// Tools are the names of the tools the model may call.
+	Tools []string
+	// MaxToolIterations is the number of completion requests in which the model may call tools before it has to
+	// answer.
+	MaxToolIterations int
+	// MaxContinuations is the number of follow-up requests asking the model to continue an answer that was cut off at
+	// the token limit.
+	MaxContinuations int
+	// MaxAnswerTokens stops the continuations once the answer has this many tokens, 0 means no limit.
+	MaxAnswerTokens int
+	ModelParams     config.ModelParams
+	// Client sends the requests, it is shared by the clients with the same HTTP settings.
+	Client *http.Client
+	// CompletionTimeout and ModerationTimeout limit the requests to these endpoints with their retries, Timeout the
+	// others.
+	Timeout           time.Duration
+	CompletionTimeout time.Duration
+	ModerationTimeout time.Duration
 }
 
+// defaultMaxImageSize is the limit of the OpenAI API, used if MaxImageSize is not set.
+const defaultMaxImageSize = 20 * 1024 * 1024
+
+// The defaults of the transcription and the image generation settings. The size is the limit of the OpenAI API, the types are the formats it
+// accepts.
+var (
+	defaultTranscriptionEndpoint = "v1/audio/transcriptions"
+	defaultTranscriptionModel    = "whisper-1"
+	defaultMaxAudioSize          = int64(25 * 1024 * 1024)
+	defaultImagesEndpoint        = "v1/images/generations"
+	defaultImagesModel           = "dall-e-3"
+	defaultAudioTypes            = []string{"audio/mpeg", "audio/mp3", "audio/mp4", "audio/m4a", "audio/x-m4a", "audio/wav",
+		"audio/x-wav", "audio/wave", "audio/webm", "audio/ogg", "audio/flac", "audio/x-flac"}
+)
+
+// defaultMaxToolIterations is used if MaxToolIterations is not set.
+const defaultMaxToolIterations = 5
+
+// defaultMaxContinuations is used if MaxContinuations is not set.
+const defaultMaxContinuations = 3
+
 type HTTPError struct {
 	Message string `json:"message"`
 	Type    string `json:"type"`
@@ -52,46 +106,125 @@ type HTTPError struct {
 	Code    string `json:"code"`
 }
 
-func NewFromConfig(config *config.Config) *OpenAI {
+func NewFromConfig(config *config.Config) (*OpenAI, error) {
+	return New(config.OpenAI)
+}
+
+// New creates a client from the OpenAI section of the configuration, or from the result of config.ResolveOpenAI.
+func New(config config.OpenAIConfig) (*OpenAI, error) {
+	provider, err := NewProviderFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := provider.(*AzureProvider); ok && (config.InputModeration || config.OutputModeration) {
+		// Azure has no moderation endpoint, every message would fail. It filters the content itself.
+		return nil, fmt.Errorf("InputModeration and OutputModeration are not supported by the azure provider, disable them")
+	}
+	client, err := NewClientFromConfig(config.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create HTTP client: %w", err)
+	}
+
 	oa := OpenAI{
-		HostName:           config.OpenAI.HostName,
-		ApiToken:           config.OpenAI.ApiToken,
-		PrePrompt:          strings.TrimSpace(config.OpenAI.PrePrompt),
-		Model:              config.OpenAI.Model,
-		ModerationEndpoint: config.OpenAI.ModerationEndpoint,
-		CompletionEndpoint: config.OpenAI.CompletionEndpoint,
-		InputModeration:    config.OpenAI.InputModeration,
-		OutputModeration:   config.OpenAI.OutputModeration,
-		SendUserId:         config.OpenAI.SendUserId,
+		Provider:           provider,
+		PrePrompt:          strings.TrimSpace(config.PrePrompt),
+		Model:              config.Model,
+		ModerationEndpoint: config.ModerationEndpoint,
+		CompletionEndpoint: config.CompletionEndpoint,
+		InputModeration:    config.InputModeration,
+		OutputModeration:   config.OutputModeration,
+		SendUserId:         config.SendUserId,
+		Stream:             config.Stream,
+		StreamInterval:     time.Second,
+		Retry:              NewRetryPolicyFromConfig(config.Retry),
+		ContextWindow:      config.ContextWindow,
+		Vision:             config.Vision,
+		ImageDetail:        config.ImageDetail,
+		MaxImageSize:       defaultMaxImageSize,
+		Tools:              config.Tools,
+		MaxToolIterations:  defaultMaxToolIterations,
+		MaxContinuations:   defaultMaxContinuations,
+		MaxAnswerTokens:    config.MaxAnswerTokens,
+
+		ModelParams: config.ModelParams,
+
+		Client:            client,
+		Timeout:           defaultTimeout,
+		CompletionTimeout: defaultCompletionTimeout,
+		ModerationTimeout: defaultModerationTimeout,
+	}
+	if config.StreamInterval != nil {
+		oa.StreamInterval = *config.StreamInterval
+	}
+	if config.MaxImageSize > 0 {
+		oa.MaxImageSize = config.MaxImageSize
+	}
+	if config.MaxToolIterations != nil {
+		oa.MaxToolIterations = *config.MaxToolIterations
+	}
+	if config.MaxContinuations != nil {
+		oa.MaxContinuations = *config.MaxContinuations
+	}
+	if config.HTTP.Timeout != nil {
+		oa.Timeout = *config.HTTP.Timeout
+	}
+	if config.HTTP.CompletionTimeout != nil {
+		oa.CompletionTimeout = *config.HTTP.CompletionTimeout
+	}
+	if config.HTTP.ModerationTimeout != nil {
+		oa.ModerationTimeout = *config.HTTP.ModerationTimeout
+	}
 
-		ModelParams: config.OpenAI.ModelParams,
+	oa.Transcription = config.Transcription
+	if oa.Transcription.Endpoint == "" {
+		oa.Transcription.Endpoint = defaultTranscriptionEndpoint
+	}
+	if oa.Transcription.Model == "" {
+		oa.Transcription.Model = defaultTranscriptionModel
+	}
+	if oa.Transcription.MaxSize <= 0 {
+		oa.Transcription.MaxSize = defaultMaxAudioSize
 	}
-	return &oa
+	if len(oa.Transcription.Types) == 0 {
+		oa.Transcription.Types = defaultAudioTypes
+	}
+
+	oa.Images = config.Images
+	if oa.Images.Endpoint == "" {
+		oa.Images.Endpoint = defaultImagesEndpoint
+	}
+	if oa.Images.Model == "" {
+		oa.Images.Model = defaultImagesModel
+	}
+	return &oa, nil
 }
 
 func (o *OpenAI) CompletionURL() (string, error) {
-	url, err := url.JoinPath("https://", o.HostName, o.CompletionEndpoint)
-	if err != nil {
-		return "", err
-	}
-	return url, nil
+	return o.Provider.URL(o.CompletionEndpoint, o.Model)
 }
 
+// moderationModel is the model of the moderation endpoint.
+const moderationModel = "text-moderation-latest"
+
 func (o *OpenAI) ModerationURL() (string, error) {
-	url, err := url.JoinPath("https://", o.HostName, o.ModerationEndpoint)
-	if err != nil {
-		return "", err
-	}
-	return url, nil
+	return o.Provider.URL(o.ModerationEndpoint, moderationModel)
 }
 
 func (o *OpenAI) Completion(cReq *CompletionRequest) (*CompletionResponse, error) {
+	return o.CompletionContext(context.Background(), cReq)
+}
+
+// CompletionContext is like Completion, but the request is canceled when ctx is done, or after the CompletionTimeout.
+func (o *OpenAI) CompletionContext(ctx context.Context, cReq *CompletionRequest) (*CompletionResponse, error) {
+	ctx, cancel := withTimeout(ctx, o.CompletionTimeout)
+	defer cancel()
+	defer observeLatency("completion", cReq.Model, time.Now())
 	var cResp CompletionResponse
 	url, err := o.CompletionURL()
 	if err != nil {
 		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
 	}
-	err = o.request(url, cReq, &cResp)
+	err = o.request(ctx, url, cReq, &cResp)
 	if cResp.Error.Code == "context_length_exceeded" {
 		return nil, NewErrorContextLengthExceeded(cResp.Error.Message)
 	} else if cResp.Error.Message != "" {
@@ -102,16 +235,26 @@ func (o *OpenAI) Completion(cReq *CompletionRequest) (*CompletionResponse, error
 		return &cResp, fmt.Errorf("an error occured while performing the request: %w", err)
 	}
 
+	metrics.TokensUsed.Add(float64(cResp.Usage.PromptTokens), cReq.Model, "prompt")
+	metrics.TokensUsed.Add(float64(cResp.Usage.CompletionTokens), cReq.Model, "completion")
 	return &cResp, nil
 }
 
 func (o *OpenAI) Moderation(mReq *ModerationRequest) (*ModerationResponse, error) {
+	return o.ModerationContext(context.Background(), mReq)
+}
+
+// ModerationContext is like Moderation, but the request is canceled when ctx is done, or after the ModerationTimeout.
+func (o *OpenAI) ModerationContext(ctx context.Context, mReq *ModerationRequest) (*ModerationResponse, error) {
+	ctx, cancel := withTimeout(ctx, o.ModerationTimeout)
+	defer cancel()
+	defer observeLatency("moderation", moderationModel, time.Now())
 	var mResp ModerationResponse
 	url, err := o.ModerationURL()
 	if err != nil {
 		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
 	}
-	err = o.request(url, mReq, &mResp)
+	err = o.request(ctx, url, mReq, &mResp)
 	if mResp.Error.Message != "" {
 		return nil, fmt.Errorf("%w: %s ", err, mResp.Error.Message)
 	}
@@ -124,33 +267,37 @@ func (o *OpenAI) Moderation(mReq *ModerationRequest) (*ModerationResponse, error
 		return nil, fmt.Errorf("empty moderation response")
 	}
 
+	categories := mResp.FlaggedCategories()
+	if mResp.IsFlagged() && len(categories) == 0 {
+		categories = []string{"Other"}
+	}
+	for _, category := range categories {
+		metrics.ModerationFlags.Inc(category)
+	}
 	return &mResp, nil
 }
 
-func (o *OpenAI) request(url string, request interface{}, oaResponse interface{}) error {
-	data, err := json.Marshal(request)
-	if err != nil {
-		return fmt.Errorf("cannot marshal request body: %w", err)
-	}
+// observeLatency records the duration of a request to the endpoint, which has been started at start.
+func observeLatency(endpoint string, model string, start time.Time) {
+	metrics.OpenAILatency.Observe(time.Since(start).Seconds(), endpoint, model)
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+func (o *OpenAI) request(ctx context.Context, url string, request interface{}, oaResponse interface{}) error {
+	resp, err := o.post(ctx, url, request)
 	if err != nil {
-		return fmt.Errorf("cannot create new request: %w", err)
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", o.ApiToken))
+	return decodeResponse(resp, oaResponse)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("cannot perform request: %w", err)
-	}
+// decodeResponse decodes the JSON body of the response into oaResponse, and closes the body.
+func decodeResponse(resp *http.Response, oaResponse interface{}) error {
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		return parseError(resp, oaResponse)
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(oaResponse)
+	err := json.NewDecoder(resp.Body).Decode(oaResponse)
 	if err != nil {
 		return fmt.Errorf("cannot parse response body: %w", err)
 	}
@@ -158,6 +305,75 @@ func (o *OpenAI) request(url string, request interface{}, oaResponse interface{}
 	return nil
 }
 
+// post sends the request as a JSON body to the url. Failed attempts are retried according to the retry policy, and
+// the response of the last attempt is returned. The caller is responsible for closing the body of the response. The
+// request and the waiting between the attempts stop when ctx is done.
+func (o *OpenAI) post(ctx context.Context, url string, request interface{}) (*http.Response, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal request body: %w", err)
+	}
+	return o.postBody(ctx, url, "application/json; charset=UTF-8", data)
+}
+
+// postBody is like post, but the body is sent as is, with the content type.
+func (o *OpenAI) postBody(ctx context.Context, url string, contentType string, data []byte) (*http.Response, error) {
+	start := time.Now()
+	client := o.httpClient()
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("cannot create new request: %w", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		o.Provider.Authenticate(req)
+
+		resp, err := client.Do(req)
+
+		var retry bool
+		if err != nil {
+			retry = o.Retry.retriableError(err)
+		} else {
+			retry = resp.StatusCode != http.StatusOK && o.Retry.retriableStatus(resp)
+		}
+		if !retry || attempt >= o.Retry.MaxAttempts {
+			if err != nil {
+				return nil, fmt.Errorf("cannot perform request: %w", err)
+			}
+			return resp, nil
+		}
+
+		delay := o.Retry.delay(attempt, resp)
+		logger := log.WithField("url", url).
+			WithField("attempt", attempt).
+			WithField("delay", delay)
+		if err != nil {
+			logger = logger.WithError(err)
+		} else {
+			logger = logger.WithField("statusCode", resp.StatusCode)
+		}
+
+		if time.Since(start)+delay > o.Retry.Deadline {
+			logger.Warn("OpenAI request failed, and there is no time left to retry it.")
+			if err != nil {
+				return nil, fmt.Errorf("cannot perform request: %w", err)
+			}
+			return resp, nil
+		}
+
+		logger.Warn("OpenAI request failed, retrying.")
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("cannot perform request: %w", ctx.Err())
+		}
+	}
+}
+
 func (o *OpenAI) NewCompletionRequest(messages []Message, user string) *CompletionRequest {
 	r := &CompletionRequest{
 		Model:            o.Model,
@@ -172,10 +388,27 @@ func (o *OpenAI) NewCompletionRequest(messages []Message, user string) *Completi
 	if len(user) > 0 {
 		r.User = &user
 	}
-	
+
 	return r
 }
 
+// defaultReplyReserve is the number of tokens left for the answer if MaxTokens is not set.
+const defaultReplyReserve = 512
+
+// HistoryBudget returns the number of tokens that can be spent on history in a completion request that contains the
+// messages, so the request and the answer (up to MaxTokens) fit in the context window of the model.
+func (o *OpenAI) HistoryBudget(messages []Message) int {
+	window := o.ContextWindow
+	if window == 0 {
+		window = ContextWindow(o.Model)
+	}
+	reply := defaultReplyReserve
+	if o.ModelParams.MaxTokens != nil {
+		reply = *o.ModelParams.MaxTokens
+	}
+	return window - CountMessageTokens(o.Model, messages) - reply
+}
+
 func parseError(resp *http.Response, oaResponse interface{}) error {
 	if resp.Body == nil {
 		return fmt.Errorf("HTTP Error: %d", resp.StatusCode)
@@ -0,0 +1,335 @@
+// Package openaitest provides an in-process fake of the OpenAI API for tests, with scripted completions and
+// moderation.
+package openaitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+)
+
+const (
+	CompletionEndpoint    = "v1/chat/completions"
+	ModerationEndpoint    = "v1/moderations"
+	TranscriptionEndpoint = "v1/audio/transcriptions"
+)
+
+// Message is a message of a completion request, with the text parts of the content joined.
+type Message struct {
+	Role       string
+	Content    string
+	Images     int
+	ToolCalls  []openai.ToolCall
+	ToolCallId string
+}
+
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var wire struct {
+		Role       string            `json:"role"`
+		Content    json.RawMessage   `json:"content"`
+		ToolCalls  []openai.ToolCall `json:"tool_calls"`
+		ToolCallId string            `json:"tool_call_id"`
+	}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	m.Role, m.ToolCalls, m.ToolCallId = wire.Role, wire.ToolCalls, wire.ToolCallId
+
+	// The content is a string, or a list of parts with images.
+	if err := json.Unmarshal(wire.Content, &m.Content); err == nil || len(wire.Content) == 0 {
+		return nil
+	}
+	var parts []openai.ContentPart
+	if err := json.Unmarshal(wire.Content, &parts); err != nil {
+		return fmt.Errorf("invalid content: %w", err)
+	}
+	var texts []string
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			texts = append(texts, p.Text)
+		case "image_url":
+			m.Images++
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// Request is a completion request received by the server.
+type Request struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+	// StreamOptions is set if the request asks for the usage in the stream.
+	StreamOptions *openai.StreamOptions `json:"stream_options"`
+	Tools         []openai.Tool         `json:"tools"`
+	ToolChoice    interface{}           `json:"tool_choice"`
+	User          string                `json:"user"`
+}
+
+// usage returns the usage of the request with the reply, every word counts as a token.
+func (r *Request) usage(reply Reply) openai.Usage {
+	var u openai.Usage
+	for _, m := range r.Messages {
+		u.PromptTokens += len(strings.Fields(m.Content))
+	}
+	u.CompletionTokens = len(strings.Fields(reply.Content))
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
+
+// LastMessage returns the content of the last message of the request.
+func (r *Request) LastMessage() string {
+	if len(r.Messages) == 0 {
+		return ""
+	}
+	return r.Messages[len(r.Messages)-1].Content
+}
+
+// Reply is the scripted answer to a completion request. If StatusCode is set, the request fails with Error.
+type Reply struct {
+	Content   string
+	ToolCalls []openai.ToolCall
+	// FinishReason is stop, or tool_calls if there are ToolCalls, by default.
+	FinishReason string
+	StatusCode   int
+	Error        openai.HTTPError
+	// Delay is the time the server takes to answer, unless the request is canceled.
+	Delay time.Duration
+}
+
+// ContextLengthExceeded is the reply OpenAI sends if the request does not fit in the context window of the model.
+func ContextLengthExceeded() Reply {
+	return Reply{
+		StatusCode: http.StatusBadRequest,
+		Error: openai.HTTPError{
+			Message: "This model's maximum context length is 4097 tokens.",
+			Type:    "invalid_request_error",
+			Param:   "messages",
+			Code:    "context_length_exceeded",
+		},
+	}
+}
+
+// ToolCall returns a reply in which the model calls the tool with the arguments.
+func ToolCall(id string, name string, arguments string) Reply {
+	return Reply{
+		ToolCalls: []openai.ToolCall{{
+			Id:       id,
+			Type:     "function",
+			Function: openai.FunctionCall{Name: name, Arguments: arguments},
+		}},
+	}
+}
+
+// Server is a fake OpenAI server. The completion requests are answered by the queued replies, then by echoing the
+// last message.
+type Server struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	replies  []Reply
+	requests []Request
+	flagged  []string
+	inputs   []string
+	// transcript is the text of every transcription, see Transcript.
+	transcript string
+}
+
+// NewServer starts a fake server. Call Close when done.
+func NewServer() *Server {
+	s := &Server{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+CompletionEndpoint, s.completion)
+	mux.HandleFunc("/"+ModerationEndpoint, s.moderation)
+	mux.HandleFunc("/"+TranscriptionEndpoint, s.transcription)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Config returns the OpenAI settings that make the bot use the server.
+func (s *Server) Config() config.OpenAIConfig {
+	return config.OpenAIConfig{
+		Provider:           "compatible",
+		BaseURL:            s.URL,
+		ApiToken:           "test-token",
+		Model:              "gpt-3.5-turbo",
+		CompletionEndpoint: CompletionEndpoint,
+		ModerationEndpoint: ModerationEndpoint,
+	}
+}
+
+// Enqueue adds replies, they answer the next completion requests in order.
+func (s *Server) Enqueue(replies ...Reply) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.replies = append(s.replies, replies...)
+}
+
+// Flag makes the moderation flag the inputs that contain the text.
+func (s *Server) Flag(text string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.flagged = append(s.flagged, text)
+}
+
+// Transcript sets the text of the transcriptions.
+func (s *Server) Transcript(text string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.transcript = text
+}
+
+// Requests returns the completion requests received so far.
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// ModerationInputs returns the inputs of the moderation requests received so far.
+func (s *Server) ModerationInputs() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.inputs...)
+}
+
+func writeError(w http.ResponseWriter, status int, e openai.HTTPError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": e})
+}
+
+func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, openai.HTTPError{Message: err.Error(), Type: "invalid_request_error"})
+		return
+	}
+
+	s.mutex.Lock()
+	s.requests = append(s.requests, req)
+	reply := Reply{Content: "Echo: " + req.LastMessage()}
+	if len(s.replies) > 0 {
+		reply = s.replies[0]
+		s.replies = s.replies[1:]
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-time.After(reply.Delay):
+	case <-r.Context().Done():
+		return
+	}
+	if reply.StatusCode != 0 {
+		writeError(w, reply.StatusCode, reply.Error)
+		return
+	}
+	if reply.FinishReason == "" {
+		reply.FinishReason = "stop"
+		if len(reply.ToolCalls) > 0 {
+			reply.FinishReason = "tool_calls"
+		}
+	}
+
+	message := openai.Message{Role: "assistant", Content: reply.Content, ToolCalls: reply.ToolCalls}
+	usage := req.usage(reply)
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(openai.CompletionResponse{
+			ID:      "chatcmpl-test",
+			Object:  "chat.completion",
+			Model:   req.Model,
+			Choices: []openai.Choice{{FinishReason: reply.FinishReason, Message: message}},
+			Usage:   usage,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	chunk := func(delta openai.Message, finishReason string) {
+		data, _ := json.Marshal(openai.CompletionChunk{
+			ID:      "chatcmpl-test",
+			Object:  "chat.completion.chunk",
+			Model:   req.Model,
+			Choices: []openai.ChunkChoice{{FinishReason: finishReason, Delta: delta}},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	chunk(openai.Message{Role: "assistant"}, "")
+	// The content is sent word by word, like the tokens of a real stream.
+	for _, word := range strings.SplitAfter(reply.Content, " ") {
+		if word != "" {
+			chunk(openai.Message{Content: word}, "")
+		}
+	}
+	for i, call := range reply.ToolCalls {
+		index := i
+		call.Index = &index
+		chunk(openai.Message{ToolCalls: []openai.ToolCall{call}}, "")
+	}
+	chunk(openai.Message{}, reply.FinishReason)
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		data, _ := json.Marshal(openai.CompletionChunk{
+			ID:      "chatcmpl-test",
+			Object:  "chat.completion.chunk",
+			Model:   req.Model,
+			Choices: []openai.ChunkChoice{},
+			Usage:   &usage,
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func (s *Server) moderation(w http.ResponseWriter, r *http.Request) {
+	var req openai.ModerationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, openai.HTTPError{Message: err.Error(), Type: "invalid_request_error"})
+		return
+	}
+
+	s.mutex.Lock()
+	s.inputs = append(s.inputs, req.Input)
+	var result openai.Result
+	for _, text := range s.flagged {
+		if strings.Contains(req.Input, text) {
+			result.Flagged = true
+			result.Categories.Harassment = true
+			result.CategoryScores.Harassment = 0.99
+		}
+	}
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openai.ModerationResponse{
+		ID:      "modr-test",
+		Model:   "text-moderation-latest",
+		Results: []openai.Result{result},
+	})
+}
+
+func (s *Server) transcription(w http.ResponseWriter, r *http.Request) {
+	if _, _, err := r.FormFile("file"); err != nil {
+		writeError(w, http.StatusBadRequest, openai.HTTPError{Message: err.Error(), Type: "invalid_request_error"})
+		return
+	}
+
+	s.mutex.Lock()
+	text := s.transcript
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openai.TranscriptionResponse{Text: text})
+}
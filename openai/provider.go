@@ -0,0 +1,139 @@
+package openai
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+)
+
+// Provider knows where the endpoints of an OpenAI-compatible API are, and how to authenticate to them. The requests
+// and the responses have the same shape for all providers.
+type Provider interface {
+	// URL returns the url of the endpoint (e.g. "v1/chat/completions") when it is used with the model.
+	URL(endpoint string, model string) (string, error)
+	// Authenticate sets the authentication headers of the request.
+	Authenticate(req *http.Request)
+}
+
+func NewProviderFromConfig(cfg config.OpenAIConfig) (Provider, error) {
+	switch cfg.Provider {
+	case "", "openai":
+		return &OpenAIProvider{
+			HostName: cfg.HostName,
+			ApiToken: cfg.ApiToken,
+		}, nil
+	case "azure":
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("BaseURL is required for the azure provider")
+		}
+		return &AzureProvider{
+			BaseURL:     cfg.BaseURL,
+			ApiKey:      cfg.ApiToken,
+			ApiVersion:  cfg.ApiVersion,
+			Deployments: cfg.Deployments,
+		}, nil
+	case "compatible":
+		p := &CompatibleProvider{
+			BaseURL:    cfg.BaseURL,
+			AuthHeader: cfg.AuthHeader,
+			AuthPrefix: cfg.AuthPrefix,
+			ApiToken:   cfg.ApiToken,
+		}
+		if p.BaseURL == "" {
+			scheme := cfg.Scheme
+			if scheme == "" {
+				scheme = "https"
+			}
+			p.BaseURL = scheme + "://" + cfg.HostName
+		}
+		if p.AuthHeader == "" {
+			p.AuthHeader = "Authorization"
+			if p.AuthPrefix == "" {
+				p.AuthPrefix = "Bearer "
+			}
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown provider: %s", cfg.Provider)
+	}
+}
+
+// OpenAIProvider is the API of OpenAI.
+type OpenAIProvider struct {
+	HostName string
+	ApiToken string
+}
+
+func (p *OpenAIProvider) URL(endpoint string, model string) (string, error) {
+	return url.JoinPath("https://", p.HostName, endpoint)
+}
+
+func (p *OpenAIProvider) Authenticate(req *http.Request) {
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", p.ApiToken))
+}
+
+// AzureProvider is Azure OpenAI, where the models are deployed under a deployment name, and the deployment is part of
+// the url. See: https://learn.microsoft.com/en-us/azure/ai-services/openai/reference
+type AzureProvider struct {
+	// BaseURL is the endpoint of the resource, e.g. https://my-resource.openai.azure.com
+	BaseURL    string
+	ApiKey     string
+	ApiVersion string
+	// Deployments maps the models to deployment names. If a model is not in the map, the deployment is assumed to
+	// have the same name as the model.
+	Deployments map[string]string
+}
+
+// defaultAzureApiVersion is used if ApiVersion is not set.
+const defaultAzureApiVersion = "2024-02-01"
+
+func (p *AzureProvider) URL(endpoint string, model string) (string, error) {
+	deployment, ok := p.Deployments[model]
+	if !ok {
+		deployment = model
+	}
+	if deployment == "" {
+		return "", fmt.Errorf("no deployment for model %q", model)
+	}
+
+	// The endpoints are the same as in the OpenAI API, but without the version prefix.
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "/"), "v1/")
+	u, err := url.JoinPath(p.BaseURL, "openai/deployments", url.PathEscape(deployment), endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	apiVersion := p.ApiVersion
+	if apiVersion == "" {
+		apiVersion = defaultAzureApiVersion
+	}
+	return u + "?api-version=" + url.QueryEscape(apiVersion), nil
+}
+
+func (p *AzureProvider) Authenticate(req *http.Request) {
+	req.Header.Set("api-key", p.ApiKey)
+}
+
+// CompatibleProvider is a server with an OpenAI-compatible API, e.g. a self-hosted one, which can be reached over
+// plain HTTP as well, and may use a different header for authentication.
+type CompatibleProvider struct {
+	// BaseURL contains the scheme, the host and optionally a path prefix, e.g. http://localhost:8080
+	BaseURL    string
+	AuthHeader string
+	AuthPrefix string
+	ApiToken   string
+}
+
+func (p *CompatibleProvider) URL(endpoint string, model string) (string, error) {
+	return url.JoinPath(p.BaseURL, endpoint)
+}
+
+func (p *CompatibleProvider) Authenticate(req *http.Request) {
+	// Local servers often do not need authentication at all.
+	if p.ApiToken != "" {
+		req.Header.Set(p.AuthHeader, p.AuthPrefix+p.ApiToken)
+	}
+}
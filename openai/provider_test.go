@@ -0,0 +1,81 @@
+package openai
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviders(t *testing.T) {
+	p, err := NewProviderFromConfig(config.OpenAIConfig{HostName: "api.openai.com", ApiToken: "secret"})
+	assert.NoError(t, err)
+	u, err := p.URL("v1/chat/completions", "gpt-4o")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.openai.com/v1/chat/completions", u)
+	req, _ := http.NewRequest("POST", u, nil)
+	p.Authenticate(req)
+	assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+
+	p, err = NewProviderFromConfig(config.OpenAIConfig{
+		Provider:    "azure",
+		BaseURL:     "https://res.openai.azure.com/",
+		ApiToken:    "secret",
+		Deployments: map[string]string{"gpt-4o": "my-gpt-4o"},
+	})
+	assert.NoError(t, err)
+	u, err = p.URL("v1/chat/completions", "gpt-4o")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://res.openai.azure.com/openai/deployments/my-gpt-4o/chat/completions?api-version=2024-02-01", u)
+	u, err = p.URL("v1/chat/completions", "gpt-35-turbo")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://res.openai.azure.com/openai/deployments/gpt-35-turbo/chat/completions?api-version=2024-02-01", u)
+	req, _ = http.NewRequest("POST", u, nil)
+	p.Authenticate(req)
+	assert.Equal(t, "secret", req.Header.Get("api-key"))
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	_, err = NewProviderFromConfig(config.OpenAIConfig{Provider: "azure"})
+	assert.Error(t, err)
+
+	p, err = NewProviderFromConfig(config.OpenAIConfig{Provider: "compatible", Scheme: "http", HostName: "localhost:8080"})
+	assert.NoError(t, err)
+	u, err = p.URL("v1/chat/completions", "llama3")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/v1/chat/completions", u)
+	req, _ = http.NewRequest("POST", u, nil)
+	p.Authenticate(req)
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	p, err = NewProviderFromConfig(config.OpenAIConfig{
+		Provider:   "compatible",
+		BaseURL:    "https://llm.example.com/api",
+		AuthHeader: "X-Api-Key",
+		ApiToken:   "secret",
+	})
+	assert.NoError(t, err)
+	u, err = p.URL("v1/chat/completions", "llama3")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://llm.example.com/api/v1/chat/completions", u)
+	req, _ = http.NewRequest("POST", u, nil)
+	p.Authenticate(req)
+	assert.Equal(t, "secret", req.Header.Get("X-Api-Key"))
+
+	_, err = NewProviderFromConfig(config.OpenAIConfig{Provider: "unknown"})
+	assert.Error(t, err)
+}
+
+func TestAzureModeration(t *testing.T) {
+	cfg := config.OpenAIConfig{Provider: "azure", BaseURL: "https://res.openai.azure.com/", InputModeration: true}
+	_, err := New(cfg)
+	assert.ErrorContains(t, err, "not supported by the azure provider")
+
+	cfg.InputModeration, cfg.OutputModeration = false, true
+	_, err = New(cfg)
+	assert.Error(t, err)
+
+	cfg.OutputModeration = false
+	_, err = New(cfg)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,147 @@
+package openai
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+)
+
+// RetryPolicy decides whether and when a failed request is sent again.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent at most, including the first attempt.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It is doubled on every subsequent retry up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter randomizes the delay by the given fraction in both directions, e.g. 0.2 means ±20%.
+	Jitter float64
+	// Deadline limits the overall time spent on a request including all retries. No retry is attempted if it would
+	// end after the deadline.
+	Deadline      time.Duration
+	StatusCodes   []int
+	NetworkErrors bool
+}
+
+func NewRetryPolicyFromConfig(cfg config.Retry) RetryPolicy {
+	p := RetryPolicy{
+		MaxAttempts:   4,
+		BaseDelay:     time.Second,
+		MaxDelay:      30 * time.Second,
+		Jitter:        0.2,
+		Deadline:      2 * time.Minute,
+		StatusCodes:   []int{429, 500, 502, 503},
+		NetworkErrors: true,
+	}
+	if cfg.MaxAttempts != nil {
+		p.MaxAttempts = *cfg.MaxAttempts
+	}
+	if cfg.BaseDelay != nil {
+		p.BaseDelay = *cfg.BaseDelay
+	}
+	if cfg.MaxDelay != nil {
+		p.MaxDelay = *cfg.MaxDelay
+	}
+	if cfg.Jitter != nil {
+		p.Jitter = *cfg.Jitter
+	}
+	if cfg.Deadline != nil {
+		p.Deadline = *cfg.Deadline
+	}
+	if cfg.StatusCodes != nil {
+		p.StatusCodes = cfg.StatusCodes
+	}
+	if cfg.NetworkErrors != nil {
+		p.NetworkErrors = *cfg.NetworkErrors
+	}
+	return p
+}
+
+// retriableStatus reports whether a response with a non-OK status code should be retried.
+func (p *RetryPolicy) retriableStatus(resp *http.Response) bool {
+	for _, code := range p.StatusCodes {
+		if resp.StatusCode == code {
+			// OpenAI uses 429 for both rate limits and exhausted quotas, but waiting does not help with the latter.
+			return !(resp.StatusCode == http.StatusTooManyRequests && isQuotaExceeded(resp))
+		}
+	}
+	return false
+}
+
+// retriableError reports whether a request that could not be performed at all should be retried.
+func (p *RetryPolicy) retriableError(err error) bool {
+	if !p.NetworkErrors {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// delay returns the time to wait before the given retry (1 for the first retry). If the server tells when to come
+// back, that is used unless the backoff would wait longer anyway.
+func (p *RetryPolicy) delay(retry int, resp *http.Response) time.Duration {
+	d := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(retry-1)))
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+
+	if resp != nil {
+		if hint := serverDelay(resp.Header, time.Now()); hint > d {
+			d = hint
+		}
+	}
+	return d
+}
+
+// serverDelay reads how long to wait from the Retry-After header, or if it is missing, from the rate limit headers of
+// OpenAI. It returns 0 if none of them are present.
+func serverDelay(header http.Header, now time.Time) time.Duration {
+	if ra := header.Get("Retry-After"); ra != "" {
+		if seconds, err := strconv.Atoi(ra); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(ra); err == nil {
+			return date.Sub(now)
+		}
+	}
+
+	// See: https://platform.openai.com/docs/guides/rate-limits/rate-limits-in-headers
+	var d time.Duration
+	for _, limit := range []string{"requests", "tokens"} {
+		if header.Get("x-ratelimit-remaining-"+limit) != "0" {
+			continue
+		}
+		if reset, err := time.ParseDuration(header.Get("x-ratelimit-reset-" + limit)); err == nil && reset > d {
+			d = reset
+		}
+	}
+	return d
+}
+
+// isQuotaExceeded peeks into the error in the body without consuming it.
+func isQuotaExceeded(resp *http.Response) bool {
+	if resp.Body == nil {
+		return false
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(body, []byte("insufficient_quota"))
+}
@@ -0,0 +1,65 @@
+package openai
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerDelay(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	h := http.Header{}
+	assert.Equal(t, time.Duration(0), serverDelay(h, now))
+
+	h.Set("Retry-After", "7")
+	assert.Equal(t, 7*time.Second, serverDelay(h, now))
+
+	h.Set("Retry-After", now.Add(90*time.Second).Format(http.TimeFormat))
+	assert.Equal(t, 90*time.Second, serverDelay(h, now))
+
+	// The reset headers are only taken into account if the corresponding limit is exhausted.
+	h = http.Header{}
+	h.Set("x-ratelimit-remaining-requests", "0")
+	h.Set("x-ratelimit-reset-requests", "1s")
+	h.Set("x-ratelimit-remaining-tokens", "100")
+	h.Set("x-ratelimit-reset-tokens", "6m0s")
+	assert.Equal(t, time.Second, serverDelay(h, now))
+
+	h.Set("x-ratelimit-remaining-tokens", "0")
+	assert.Equal(t, 6*time.Minute, serverDelay(h, now))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   time.Second,
+		MaxDelay:    5 * time.Second,
+		StatusCodes: []int{429, 503},
+	}
+
+	assert.Equal(t, time.Second, p.delay(1, nil))
+	assert.Equal(t, 4*time.Second, p.delay(3, nil))
+	assert.Equal(t, 5*time.Second, p.delay(10, nil))
+
+	resp := &http.Response{StatusCode: 503, Header: http.Header{"Retry-After": []string{"20"}}}
+	assert.Equal(t, 20*time.Second, p.delay(1, resp))
+	assert.True(t, p.retriableStatus(resp))
+
+	resp = &http.Response{StatusCode: 400}
+	assert.False(t, p.retriableStatus(resp))
+
+	body := `{"error": {"message": "You exceeded your current quota.", "code": "insufficient_quota"}}`
+	resp = &http.Response{StatusCode: 429, Body: io.NopCloser(strings.NewReader(body))}
+	assert.False(t, p.retriableStatus(resp))
+	// The body must still be readable by the caller.
+	b, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, body, string(b))
+
+	resp = &http.Response{StatusCode: 429, Body: io.NopCloser(strings.NewReader(`{"error": {"code": "rate_limit_exceeded"}}`))}
+	assert.True(t, p.retriableStatus(resp))
+}
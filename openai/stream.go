@@ -0,0 +1,150 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
+)
+
+// https://platform.openai.com/docs/api-reference/chat/streaming
+
+type CompletionChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int           `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	// Usage is only set in the last chunk, if it is asked for with StreamOptions.
+	Usage *Usage    `json:"usage,omitempty"`
+	Error HTTPError `json:"error"`
+}
+
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	FinishReason string  `json:"finish_reason"`
+	Delta        Message `json:"delta"`
+}
+
+// CompletionStream reads the server-sent events of a streamed completion. Call Recv until it returns io.EOF, then Close.
+type CompletionStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	cancel context.CancelFunc
+	// model and start are for the metrics, which are recorded when the stream is closed.
+	model  string
+	start  time.Time
+	closed bool
+}
+
+var streamDataPrefix = []byte("data:")
+var streamDone = []byte("[DONE]")
+
+// CompletionStream is like Completion, but the response is sent back as a stream of deltas.
+func (o *OpenAI) CompletionStream(cReq *CompletionRequest) (*CompletionStream, error) {
+	return o.CompletionStreamContext(context.Background(), cReq)
+}
+
+// CompletionStreamContext is like CompletionStream, but the stream is canceled when ctx is done, or if it does not end
+// within the CompletionTimeout.
+func (o *OpenAI) CompletionStreamContext(ctx context.Context, cReq *CompletionRequest) (*CompletionStream, error) {
+	url, err := o.CompletionURL()
+	if err != nil {
+		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
+	}
+
+	ctx, cancel := withTimeout(ctx, o.CompletionTimeout)
+	cReq.Stream = true
+	if _, ok := o.Provider.(*AzureProvider); !ok {
+		// The usage is not sent in streams by default. Older Azure API versions reject the option.
+		cReq.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+	start := time.Now()
+	resp, err := o.post(ctx, url, cReq)
+	if err != nil {
+		observeLatency("completion", cReq.Model, start)
+		cancel()
+		return nil, fmt.Errorf("an error occured while performing the request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		observeLatency("completion", cReq.Model, start)
+		defer cancel()
+		defer resp.Body.Close()
+		var cResp CompletionResponse
+		err = parseError(resp, &cResp)
+		if cResp.Error.Code == "context_length_exceeded" {
+			return nil, NewErrorContextLengthExceeded(cResp.Error.Message)
+		} else if cResp.Error.Message != "" {
+			return nil, fmt.Errorf("%w: %s ", err, cResp.Error.Message)
+		}
+		return nil, fmt.Errorf("an error occured while performing the request: %w", err)
+	}
+
+	return &CompletionStream{
+		body:   resp.Body,
+		reader: bufio.NewReader(resp.Body),
+		cancel: cancel,
+		model:  cReq.Model,
+		start:  start,
+	}, nil
+}
+
+// Recv returns the next chunk of the stream. It returns io.EOF when the server indicates the end of the stream.
+func (s *CompletionStream) Recv() (*CompletionChunk, error) {
+	for {
+		line, err := s.reader.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// The connection must not be closed before the [DONE] message arrives.
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("cannot read stream: %w", err)
+		}
+
+		line = bytes.TrimSpace(line)
+		// Empty lines separate the events, and the other fields (event, id, retry) and comments are not used by OpenAI.
+		if !bytes.HasPrefix(line, streamDataPrefix) {
+			continue
+		}
+
+		data := bytes.TrimSpace(line[len(streamDataPrefix):])
+		if bytes.Equal(data, streamDone) {
+			return nil, io.EOF
+		}
+
+		var chunk CompletionChunk
+		err = json.Unmarshal(data, &chunk)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse stream chunk: %w", err)
+		}
+		if chunk.Error.Message != "" {
+			return nil, fmt.Errorf("error in stream: %s", chunk.Error.Message)
+		}
+		if chunk.Usage != nil {
+			metrics.TokensUsed.Add(float64(chunk.Usage.PromptTokens), s.model, "prompt")
+			metrics.TokensUsed.Add(float64(chunk.Usage.CompletionTokens), s.model, "completion")
+		}
+		return &chunk, nil
+	}
+}
+
+// Close ends the stream, the duration of the whole request is recorded then.
+func (s *CompletionStream) Close() error {
+	if !s.closed {
+		s.closed = true
+		observeLatency("completion", s.model, s.start)
+	}
+	err := s.body.Close()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return err
+}
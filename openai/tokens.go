@@ -0,0 +1,223 @@
+package openai
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The tokens are counted exactly if the BPE ranks of the encoding have been loaded with LoadEncodings. The ranks are
+// several megabytes each, so they are not built in. Without them, the text is split into the same pieces as the
+// cl100k/o200k pre-tokenizers do, and the tokens of each piece are counted from above. A token is at least one byte, so symbols, whitespace, and letters that do not look like a word (e.g.
+// base64 or camelCase identifiers) are counted one token per byte. Numbers of up to three digits are always a single
+// token. Non-ASCII text is counted by bytes, but CJK text at least one token per character. Only lowercase and
+// capitalized ASCII words are estimated from their length, and the estimate is generous: rare words have more tokens
+// than common ones, but not more than one per three characters.
+
+type encoding struct {
+	name string
+	// pattern is the pre-tokenizer pattern used with the ranks.
+	pattern string
+	// bpe is nil if the ranks have not been loaded, then the tokens are estimated.
+	bpe *bpe
+	// Words not longer than wordLength (without the leading space) are counted as a single token.
+	wordLength int
+	// The number of characters in a token for longer words, and bytes for non-ASCII text.
+	charsPerToken float64
+	bytesPerToken float64
+}
+
+var cl100k = &encoding{
+	name:          "cl100k_base",
+	pattern:       cl100kPattern,
+	wordLength:    6,
+	charsPerToken: 3,
+	bytesPerToken: 2,
+}
+
+var o200k = &encoding{
+	name:          "o200k_base",
+	pattern:       o200kPattern,
+	wordLength:    7,
+	charsPerToken: 3,
+	bytesPerToken: 2.5,
+}
+
+// preTokenizer is the pre-tokenizer pattern of cl100k without the \s+(?!\S) alternative, since RE2 does not support
+// lookaheads. This does not change the number of pieces, only where the whitespace ends up. It is used for the
+// estimate of both encodings.
+var preTokenizer = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// Tokens added by the chat format, see:
+// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
+const tokensPerMessage = 3
+const tokensReplyPriming = 3
+
+// contextWindows is matched by prefix, the longest matching prefix wins.
+var contextWindows = map[string]int{
+	"gpt-3.5-turbo":          16385,
+	"gpt-3.5-turbo-0613":     4096,
+	"gpt-3.5-turbo-0301":     4096,
+	"gpt-3.5-turbo-16k":      16385,
+	"gpt-4":                  8192,
+	"gpt-4-32k":              32768,
+	"gpt-4-1106":             128000,
+	"gpt-4-0125":             128000,
+	"gpt-4-turbo":            128000,
+	"gpt-4-vision":           128000,
+	"gpt-4o":                 128000,
+	"gpt-4.1":                1047576,
+	"gpt-4.5":                128000,
+	"o1":                     200000,
+	"o1-mini":                128000,
+	"o3":                     200000,
+	"o4-mini":                200000,
+	"chatgpt-4o-latest":      128000,
+	"gpt-35-turbo":           16385, // Azure
+	"gpt-35-turbo-16k":       16385,
+	"gpt-3.5-turbo-instruct": 4096,
+}
+
+// defaultContextWindow is used for unknown models.
+const defaultContextWindow = 4096
+
+// ContextWindow returns the maximum number of tokens (prompt and completion together) of the model.
+func ContextWindow(model string) int {
+	window, length := defaultContextWindow, 0
+	for prefix, w := range contextWindows {
+		if strings.HasPrefix(model, prefix) && len(prefix) > length {
+			window, length = w, len(prefix)
+		}
+	}
+	return window
+}
+
+func encodingForModel(model string) *encoding {
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "chatgpt-4o", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return o200k
+		}
+	}
+	return cl100k
+}
+
+// CountTokens returns the number of tokens in the text for the model. It is an estimate if the ranks of the encoding
+// have not been loaded.
+func CountTokens(model string, text string) int {
+	enc := encodingForModel(model)
+	if enc.bpe != nil {
+		return enc.bpe.count(text)
+	}
+	n := 0
+	for _, piece := range preTokenizer.FindAllString(text, -1) {
+		n += enc.pieceTokens(piece)
+	}
+	return n
+}
+
+// CountMessageTokens counts the number of prompt tokens of a completion request with the messages.
+func CountMessageTokens(model string, messages []Message) int {
+	n := tokensReplyPriming
+	for _, m := range messages {
+		n += tokensPerMessage + CountTokens(model, m.Role) + CountTokens(model, m.Content)
+		for _, part := range m.Parts {
+			n += countPartTokens(model, part)
+		}
+		for _, call := range m.ToolCalls {
+			n += CountTokens(model, call.Function.Name) + CountTokens(model, call.Function.Arguments)
+		}
+	}
+	return n
+}
+
+// The tokens of an image depend on its size, which is not known here. A low detail image is always 85 tokens, a high
+// detail one is 765 tokens if it is 1024x1024 (larger images are scaled down to about that size).
+const tokensLowDetailImage = 85
+const tokensImage = 765
+
+func countPartTokens(model string, part ContentPart) int {
+	if part.ImageURL == nil {
+		return CountTokens(model, part.Text)
+	}
+	if part.ImageURL.Detail == "low" {
+		return tokensLowDetailImage
+	}
+	return tokensImage
+}
+
+func (e *encoding) pieceTokens(piece string) int {
+	// The pieces are symbols, whitespace, numbers or words with an optional leading character, see preTokenizer.
+	lead, word := "", piece
+	if r, size := utf8.DecodeRuneInString(piece); size < len(piece) && !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+		lead, word = piece[:size], piece[size:]
+	}
+	if !isLetters(word) {
+		if isASCIIDigits(piece) {
+			return 1
+		}
+		return len(piece)
+	}
+
+	n := 0
+	if lead != "" && lead != " " {
+		// A space is part of the token of the word, other characters may not be.
+		n += len(lead)
+	}
+	switch {
+	case utf8.RuneCountInString(word) != len(word):
+		tokens := int(math.Ceil(float64(len(word)) / e.bytesPerToken))
+		if hasCJK(word) {
+			if runes := utf8.RuneCountInString(word); runes > tokens {
+				tokens = runes
+			}
+		}
+		n += tokens
+	case !isWordLike(word):
+		n += len(word)
+	case len(word) <= e.wordLength:
+		n++
+	default:
+		n += int(math.Ceil(float64(len(word)) / e.charsPerToken))
+	}
+	return n
+}
+
+func isLetters(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isASCIIDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isWordLike returns true for lowercase and capitalized words, e.g. "hello" and "Hello", but not for "HELLO", "getId"
+// or base64.
+func isWordLike(word string) bool {
+	for i, r := range word {
+		if i > 0 && unicode.IsUpper(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasCJK(s string) bool {
+	for _, r := range s {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package openai
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountTokens(t *testing.T) {
+	// Common words, punctuation and numbers are counted exactly.
+	for text, tokens := range map[string]int{
+		"":              0,
+		"Hello world":   2,
+		"Hello, world!": 4,
+		"1234567":       3,
+	} {
+		assert.Equal(t, tokens, CountTokens("gpt-4", text), text)
+		assert.Equal(t, tokens, CountTokens("gpt-4o", text), text)
+	}
+
+	// The rest is counted from above.
+	for _, c := range []struct {
+		model  string
+		text   string
+		tokens int
+	}{
+		{"gpt-4", "internationalization", 7},              // 3 characters per token
+		{"gpt-4", "SGVsbG8gd29ybGQ=", 14},                 // base64, per byte
+		{"gpt-4", "getUserName()", 13},                    // camelCase and symbols per byte
+		{"gpt-4", "https://example.com/a?b=c", 15},        // symbols per byte
+		{"gpt-4", "d41d8cd98f00b204e9800998ecf8427e", 18}, // a token per piece
+		{"gpt-4", "你好世界", 6},                              // 2 bytes per token
+		{"gpt-4o", "你好世界", 5},                             // at least one per character
+		{"gpt-4o", "árvíztűrő tükörfúrógép", 13},          // 2.5 bytes per token
+	} {
+		assert.Equal(t, c.tokens, CountTokens(c.model, c.text), c.text)
+	}
+
+	messages := []Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello world"},
+	}
+	// 3 for the priming, 3 per message, 1 per role plus the content.
+	assert.Equal(t, 3+3+1+CountTokens("gpt-4", messages[0].Content)+3+1+2, CountMessageTokens("gpt-4", messages))
+}
+
+func TestContextWindow(t *testing.T) {
+	assert.Equal(t, 8192, ContextWindow("gpt-4"))
+	assert.Equal(t, 8192, ContextWindow("gpt-4-0613"))
+	assert.Equal(t, 32768, ContextWindow("gpt-4-32k-0613"))
+	assert.Equal(t, 128000, ContextWindow("gpt-4o-mini"))
+	assert.Equal(t, 4096, ContextWindow("gpt-3.5-turbo-0613"))
+	assert.Equal(t, 16385, ContextWindow("gpt-3.5-turbo-1106"))
+	assert.Equal(t, defaultContextWindow, ContextWindow("my-local-llama"))
+}
@@ -0,0 +1,84 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"time"
+)
+
+// https://platform.openai.com/docs/api-reference/audio/createTranscription
+
+type TranscriptionRequest struct {
+	// FileName has to have an extension which tells the format of the audio, e.g. voice.mp3
+	FileName string
+	File     []byte
+	Model    string
+	// Language is the ISO-639-1 code of the language of the audio, it is detected if empty.
+	Language string
+}
+
+type TranscriptionResponse struct {
+	Text  string    `json:"text"`
+	Error HTTPError `json:"error"`
+}
+
+func (o *OpenAI) TranscriptionURL() (string, error) {
+	return o.Provider.URL(o.Transcription.Endpoint, o.Transcription.Model)
+}
+
+// Transcribe converts the speech in an audio file to text.
+func (o *OpenAI) Transcribe(tReq *TranscriptionRequest) (*TranscriptionResponse, error) {
+	return o.TranscribeContext(context.Background(), tReq)
+}
+
+// TranscribeContext is like Transcribe, but the request is canceled when ctx is done, or after the Timeout.
+func (o *OpenAI) TranscribeContext(ctx context.Context, tReq *TranscriptionRequest) (*TranscriptionResponse, error) {
+	ctx, cancel := withTimeout(ctx, o.Timeout)
+	defer cancel()
+	defer observeLatency("transcription", tReq.Model, time.Now())
+	var tResp TranscriptionResponse
+	url, err := o.TranscriptionURL()
+	if err != nil {
+		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"model":           tReq.Model,
+		"language":        tReq.Language,
+		"response_format": "json",
+	}
+	for name, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := w.WriteField(name, value); err != nil {
+			return nil, fmt.Errorf("cannot create request body: %w", err)
+		}
+	}
+	fw, err := w.CreateFormFile("file", tReq.FileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request body: %w", err)
+	}
+	if _, err := fw.Write(tReq.File); err != nil {
+		return nil, fmt.Errorf("cannot create request body: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("cannot create request body: %w", err)
+	}
+
+	resp, err := o.postBody(ctx, url, w.FormDataContentType(), body.Bytes())
+	if err == nil {
+		err = decodeResponse(resp, &tResp)
+	}
+	if tResp.Error.Message != "" {
+		return nil, fmt.Errorf("%w: %s ", err, tResp.Error.Message)
+	}
+	if err != nil {
+		return &tResp, fmt.Errorf("an error occured while performing the request: %w", err)
+	}
+	return &tResp, nil
+}
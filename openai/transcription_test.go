@@ -0,0 +1,39 @@
+package openai
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranscribe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/audio/transcriptions", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.NoError(t, r.ParseMultipartForm(1024))
+		assert.Equal(t, "whisper-1", r.FormValue("model"))
+		assert.Equal(t, "hu", r.FormValue("language"))
+		f, header, err := r.FormFile("file")
+		assert.NoError(t, err)
+		assert.Equal(t, "voice.mp3", header.Filename)
+		data, _ := io.ReadAll(f)
+		assert.Equal(t, "mp3 data", string(data))
+		w.Write([]byte(`{"text": "Hello bot"}`))
+	}))
+	defer server.Close()
+
+	oa, err := New(config.OpenAIConfig{Provider: "compatible", BaseURL: server.URL, ApiToken: "secret"})
+	assert.NoError(t, err)
+	resp, err := oa.Transcribe(&TranscriptionRequest{
+		FileName: "voice.mp3",
+		File:     []byte("mp3 data"),
+		Model:    oa.Transcription.Model,
+		Language: "hu",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello bot", resp.Text)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// promptText returns the text of the message as it is sent to OpenAI. The messages quoted in it are fetched from
+// Rocket.Chat, see extractPrompt.
+func promptText(rocketmsg rocket.Message, triggerPrefix string) string {
+	var quoted []rocket.Message
+	if len(rocketmsg.QuotedMsgs) > 0 {
+		var err error
+		quoted, err = rocketmsg.RequestQuotedMessages()
+		if err != nil {
+			log.WithError(err).WithField("quotedMsgs", rocketmsg.QuotedMsgs).Warn("Cannot fetch a quoted message.")
+		}
+	}
+	return extractPrompt(rocketmsg, quoted, triggerPrefix)
+}
+
+// extractPrompt returns the text of the message without the mention of the bot and the prefix of the trigger (if it is
+// not empty), with the other mentions replaced by the names of the users, and the quoted messages of the same room
+// before it. When a file is uploaded, the text is in the description of the attachment.
+func extractPrompt(rocketmsg rocket.Message, quoted []rocket.Message, triggerPrefix string) string {
+	text := rocketmsg.StripQuotes(rocketmsg.GetNotAddressedText())
+	text, _ = cutTriggerPrefix(text, triggerPrefix)
+	text = mentionNames(rocketmsg, text)
+	if text == "" {
+		var descriptions []string
+		for _, a := range rocketmsg.Attachments {
+			if a.Description != "" {
+				descriptions = append(descriptions, a.Description)
+			}
+		}
+		text = strings.Join(descriptions, "\n")
+	}
+
+	var parts []string
+	for _, q := range quoted {
+		// The user may not be allowed to see the other rooms of the bot.
+		if q.RoomId != rocketmsg.RoomId {
+			continue
+		}
+		qtext := mentionNames(q, q.StripQuotes(q.Text))
+		if qtext == "" {
+			continue
+		}
+		parts = append(parts, "> "+q.UserName+": "+strings.ReplaceAll(qtext, "\n", "\n> "))
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// cutTriggerPrefix returns the text without the prefix and the whitespace around it, and true if the text starts with
+// the prefix. The case is ignored, e.g. "Bot, hello" starts with "bot,". An empty prefix is not cut.
+func cutTriggerPrefix(text string, prefix string) (string, bool) {
+	trimmed := strings.TrimSpace(text)
+	if prefix == "" || len(trimmed) < len(prefix) || !strings.EqualFold(trimmed[:len(prefix)], prefix) {
+		return text, false
+	}
+	return strings.TrimSpace(trimmed[len(prefix):]), true
+}
+
+// mentionNames replaces the mentions of the users in the text with their names, e.g. "@jdoe" becomes "John Doe".
+// Mentions of unknown users, and of users without a name are kept.
+func mentionNames(rocketmsg rocket.Message, text string) string {
+	return rocket.ReplaceMentions(text, func(username string) (string, bool) {
+		for _, u := range rocketmsg.Mentions {
+			if strings.EqualFold(u.Username, username) && u.Name != "" {
+				return u.Name, true
+			}
+		}
+		return "", false
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromptText(t *testing.T) {
+	assert.Equal(t, "hello", promptText(rocket.Message{Text: "hello"}, ""))
+	assert.Equal(t, "what is this?", promptText(rocket.Message{
+		Attachments: []rocket.Attachment{
+			{Description: "what is this?", ImageURL: "/file-upload/abc/screenshot.png"},
+		},
+	}, ""))
+	// The prefix of the trigger is not part of the prompt.
+	assert.Equal(t, "hello", promptText(rocket.Message{Text: "Bot, hello"}, "bot,"))
+	assert.Equal(t, "bot, hello", promptText(rocket.Message{Text: "bot, hello"}, ""))
+}
+
+func TestExtractPrompt(t *testing.T) {
+	msg := rocket.Message{
+		RoomId:   "room",
+		Text:     "Is @jdoe right? Ask @nobody.",
+		Mentions: []rocket.User{{Username: "jdoe", Name: "John Doe"}, {Username: "nobody"}},
+	}
+	quoted := []rocket.Message{
+		{RoomId: "room", UserName: "jdoe", Text: "It is\n**fine**"},
+		{RoomId: "other", UserName: "jane", Text: "secret"},
+	}
+	assert.Equal(t, "> jdoe: It is\n> **fine**\n\nIs John Doe right? Ask @nobody.", extractPrompt(msg, quoted, ""))
+}
@@ -0,0 +1,341 @@
+package rocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Websocket tunables
+const socketReadSizeLimit = 65536
+const pingTime = 30 * time.Second
+const readTimeout = 90 * time.Second
+
+// methodTimeout is the longest time runMethod waits for the result of a method call.
+const methodTimeout = 30 * time.Second
+
+// Backoff between reconnection attempts
+const reconnectMinDelay = time.Second
+const reconnectMaxDelay = 2 * time.Minute
+
+// connection is a single websocket connection to Rocket.Chat. When the connection breaks, a new one is opened by
+// supervise, while RocketCon and its message channels are kept.
+type connection struct {
+	ws        *websocket.Conn
+	send      chan interface{}
+	done      chan struct{}
+	closeOnce sync.Once
+	// subscriptions are the ids of the subscriptions made on the connection.
+	subscriptions      []string
+	subscriptionsMutex sync.Mutex
+}
+
+// closeFrame is written to the connection to close the websocket cleanly, after the packets queued before it.
+type closeFrame struct{}
+
+func (conn *connection) close() {
+	conn.closeOnce.Do(func() {
+		close(conn.done)
+		conn.ws.Close()
+	})
+}
+
+func (conn *connection) addSubscription(id string) {
+	conn.subscriptionsMutex.Lock()
+	defer conn.subscriptionsMutex.Unlock()
+	conn.subscriptions = append(conn.subscriptions, id)
+}
+
+func (conn *connection) subscriptionIds() []string {
+	conn.subscriptionsMutex.Lock()
+	defer conn.subscriptionsMutex.Unlock()
+	return append([]string(nil), conn.subscriptions...)
+}
+
+// write queues a packet to be sent on the connection. Packets written after the connection is closed are dropped.
+func (conn *connection) write(packet interface{}) {
+	select {
+	case conn.send <- packet:
+	case <-conn.done:
+		log.WithField("packet", packet).Debug("Connection is closed, packet dropped.")
+	}
+}
+
+func (rock *RocketCon) currentConn() *connection {
+	rock.connMutex.RLock()
+	defer rock.connMutex.RUnlock()
+	return rock.conn
+}
+
+// write queues a packet to be sent on the current connection.
+func (rock *RocketCon) write(packet interface{}) {
+	if conn := rock.currentConn(); conn != nil {
+		conn.write(packet)
+	}
+}
+
+// open dials the websocket, then sends the DDP connect message, logs in and subscribes to the rooms.
+func (rock *RocketCon) open() (*connection, error) {
+	wsURL := rock.getWsURL()
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initiate websocket to %s: %w", wsURL, err)
+	}
+
+	ws.SetReadLimit(socketReadSizeLimit)
+	ws.SetReadDeadline(time.Now().Add(readTimeout))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(readTimeout))
+		return nil
+	})
+
+	conn := &connection{
+		ws:   ws,
+		send: make(chan interface{}, 1024),
+		done: make(chan struct{}),
+	}
+	rock.connMutex.Lock()
+	rock.conn = conn
+	rock.connMutex.Unlock()
+
+	go rock.writeLoop(conn)
+	go rock.readLoop(conn)
+
+	rock.connect()
+	err = rock.login()
+	if err != nil {
+		conn.close()
+		return nil, fmt.Errorf("cannot log in: %w", err)
+	}
+	err = rock.subscribeRooms()
+	if err != nil {
+		conn.close()
+		return nil, fmt.Errorf("cannot subscribe to rooms: %w", err)
+	}
+	return conn, nil
+}
+
+// supervise waits until the connection breaks, then reconnects with exponential backoff, until Close is called.
+func (rock *RocketCon) supervise(conn *connection) {
+	for {
+		select {
+		case <-conn.done:
+		case <-rock.quit:
+			return
+		}
+		log.Warn("The connection to Rocket.Chat has been lost, reconnecting.")
+
+		delay := reconnectMinDelay
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-time.After(delay):
+			case <-rock.quit:
+				return
+			}
+
+			var err error
+			conn, err = rock.open()
+			if err == nil {
+				log.WithField("attempt", attempt).Info("Reconnected to Rocket.Chat.")
+				metrics.Reconnects.Inc()
+				break
+			}
+
+			delay *= 2
+			if delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+			log.WithError(err).
+				WithField("attempt", attempt).
+				WithField("nextAttemptIn", delay).
+				Warn("Cannot reconnect to Rocket.Chat.")
+		}
+	}
+}
+
+func (rock *RocketCon) writeLoop(conn *connection) {
+	tick := time.NewTicker(pingTime)
+	defer tick.Stop()
+
+	for {
+		var packet interface{}
+		select {
+		case packet = <-conn.send:
+		case <-tick.C:
+			// Keep the connection alive, the pong resets the read deadline.
+			packet = map[string]string{
+				"msg": "ping",
+			}
+		case <-conn.done:
+			return
+		}
+
+		if _, ok := packet.(closeFrame); ok {
+			// The server answers with a close frame too, then the read loop ends.
+			err := conn.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			if err != nil {
+				log.WithError(err).Warn("Cannot close websocket.")
+				conn.close()
+				return
+			}
+			continue
+		}
+
+		raw, err := json.Marshal(packet)
+		if err != nil {
+			log.WithError(err).WithField("packet", packet).Error("Cannot marshal packet.")
+			continue
+		}
+		err = conn.ws.WriteMessage(websocket.TextMessage, raw)
+		if err != nil {
+			log.WithError(err).WithField("packet", string(raw)).Error("Cannot write to websocket.")
+			conn.close()
+			return
+		}
+	}
+}
+
+func (rock *RocketCon) readLoop(conn *connection) {
+	defer conn.close()
+	for {
+		_, raw, err := conn.ws.ReadMessage()
+		if err != nil {
+			select {
+			case <-conn.done:
+				// The connection has been closed on purpose.
+			default:
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					log.Debug("The websocket has been closed.")
+				} else {
+					log.WithError(err).Warn("Cannot read websocket.")
+				}
+			}
+			return
+		}
+		conn.ws.SetReadDeadline(time.Now().Add(readTimeout))
+
+		err = rock.handleFrame(conn, raw)
+		if err != nil {
+			log.WithError(err).WithField("raw", string(raw)).Warn("Cannot handle data read from websocket.")
+		}
+	}
+}
+
+func (rock *RocketCon) handleFrame(conn *connection, raw []byte) error {
+	var frame ddpFrame
+	err := json.Unmarshal(raw, &frame)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal frame: %w", err)
+	}
+
+	switch frame.Msg {
+	case "connected":
+		if frame.Session == "" {
+			return errors.New("connected frame without a session")
+		}
+		rock.session = frame.Session
+	case "result":
+		rock.resultsMutex.Lock()
+		channel, ok := rock.results[frame.Id]
+		rock.resultsMutex.Unlock()
+		if ok {
+			select {
+			case channel <- &frame:
+			default:
+			}
+		}
+	case "added":
+		switch frame.Collection {
+		case "users":
+			break
+		default:
+			log.WithField("collection", frame.Collection).Trace("Ignored incoming added msg.")
+		}
+	case "updated":
+		break
+	case "changed":
+		return rock.handleChanged(&frame)
+	case "nosub":
+		if frame.Error != nil {
+			return fmt.Errorf("subscription %s failed: %w", frame.Id, frame.Error)
+		}
+	case "error":
+		return fmt.Errorf("Rocket.Chat could not handle a message of the bot: %s %s", frame.Reason, frame.OffendingMessage)
+	case "ready":
+		break
+	case "ping":
+		pong := map[string]string{
+			"msg": "pong",
+		}
+		conn.write(pong)
+	case "":
+		// Not a DDP message, e.g. the server_id sent before connected.
+		break
+	default:
+		log.WithField("raw", string(raw)).Trace("Ping.")
+	}
+	return nil
+}
+
+// handleChanged handles the events of the streams the bot is subscribed to.
+func (rock *RocketCon) handleChanged(frame *ddpFrame) error {
+	var fields streamFields
+	if err := json.Unmarshal(frame.Fields, &fields); err != nil {
+		return fmt.Errorf("cannot unmarshal fields of %s: %w", frame.Collection, err)
+	}
+
+	switch frame.Collection {
+	case "stream-notify-user":
+		if len(fields.Args) < 2 {
+			return nil
+		}
+		var event string
+		if err := json.Unmarshal(fields.Args[0], &event); err != nil {
+			return fmt.Errorf("cannot unmarshal subscription event: %w", err)
+		}
+		switch event {
+		case "inserted":
+			var sub subscriptionObject
+			if err := json.Unmarshal(fields.Args[1], &sub); err != nil {
+				return fmt.Errorf("cannot unmarshal subscription: %w", err)
+			}
+			if sub.Rid == "" {
+				return errors.New("subscription without a room id")
+			}
+			rock.setChannel(sub.Rid, sub.Fname, sub.T)
+			rock.subscribeRoom(sub.Rid)
+		}
+	case "stream-room-messages":
+		for _, arg := range fields.Args {
+			var obj messageObject
+			if err := json.Unmarshal(arg, &obj); err != nil {
+				return fmt.Errorf("cannot unmarshal message: %w", err)
+			}
+			message, err := rock.handleStreamedMessage(&obj)
+			if err != nil {
+				return err
+			}
+			if message.IsNew && !message.IsMe {
+				metrics.MessagesReceived.Inc(message.metricsRoom())
+				select {
+				case rock.newMessages <- message:
+					break
+				default:
+				}
+			} else {
+				select {
+				case rock.messages <- message:
+					break
+				default:
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package rocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// https://github.com/meteor/meteor/blob/devel/packages/ddp/DDP.md
+// https://developer.rocket.chat/reference/api/realtime-api
+
+// ddpFrame is a message received on the websocket. Only the fields of the message types the bot handles are
+// decoded, the rest is kept raw until the type is known.
+type ddpFrame struct {
+	Msg string `json:"msg"`
+	// Id is the id of the method call (result), or of the subscription (nosub, ready).
+	Id string `json:"id"`
+	// Session is set in connected.
+	Session string `json:"session"`
+	// Collection and Fields are set in added and changed.
+	Collection string          `json:"collection"`
+	Fields     json.RawMessage `json:"fields"`
+	// Result is set in result, its type depends on the method.
+	Result json.RawMessage `json:"result"`
+	// Error is set in result and nosub if the call or the subscription failed.
+	Error *DDPError `json:"error"`
+	// Reason and OffendingMessage are set in the error frame, if the server could not parse a message of the bot.
+	Reason           string          `json:"reason"`
+	OffendingMessage json.RawMessage `json:"offendingMessage"`
+}
+
+// DDPError is an error returned by a method call or a subscription.
+type DDPError struct {
+	// Code is a number (e.g. 403) or a string (e.g. error-invalid-room), depending on the method.
+	Code      json.RawMessage `json:"error"`
+	ErrorType string          `json:"errorType"`
+	Reason    string          `json:"reason"`
+	Message   string          `json:"message"`
+}
+
+func (e *DDPError) Error() string {
+	msg := "Rocket.Chat replied with an error"
+	if len(e.Code) > 0 {
+		msg += ": " + strings.Trim(string(e.Code), `"`)
+	}
+	if e.ErrorType != "" {
+		msg += " " + e.ErrorType
+	}
+	if e.Reason != "" {
+		msg += " (" + e.Reason + ")"
+	} else if e.Message != "" {
+		msg += " (" + e.Message + ")"
+	}
+	return msg
+}
+
+// streamFields are the fields of the changed frames of streams, e.g. stream-room-messages.
+type streamFields struct {
+	EventName string            `json:"eventName"`
+	Args      []json.RawMessage `json:"args"`
+}
+
+// decodeResult decodes the result of a method call into out, which may be nil.
+func (frame *ddpFrame) decodeResult(out interface{}) error {
+	if out == nil || len(frame.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(frame.Result, out); err != nil {
+		return fmt.Errorf("cannot parse method result: %w", err)
+	}
+	return nil
+}
+
+// date is a date of the DDP API ({"$date": milliseconds}) or of the REST API (ISO 8601).
+type date struct {
+	time.Time
+}
+
+func (d *date) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var ddp struct {
+		Date *float64 `json:"$date"`
+	}
+	if err := json.Unmarshal(data, &ddp); err == nil {
+		if ddp.Date == nil {
+			return fmt.Errorf("invalid date: %s", data)
+		}
+		d.Time = time.UnixMilli(int64(*ddp.Date))
+		return nil
+	}
+	var iso string
+	if err := json.Unmarshal(data, &iso); err != nil {
+		return fmt.Errorf("invalid date: %s", data)
+	}
+	t, err := time.Parse(time.RFC3339Nano, iso)
+	if err != nil {
+		return fmt.Errorf("invalid date: %w", err)
+	}
+	d.Time = t
+	return nil
+}
+
+func (d date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int64{"$date": d.UnixMilli()})
+}
+
+// userObject is the author of a message, or a member of a room.
+type userObject struct {
+	Id       string `json:"_id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+// messageObject is a message as Rocket.Chat sends it, in streams and in the results of methods and REST calls.
+type messageObject struct {
+	Id  string `json:"_id"`
+	Rid string `json:"rid"`
+	Msg string `json:"msg"`
+	// T is the type of system messages, e.g. uj (user joined). It is empty for the messages of users.
+	T           string             `json:"t"`
+	Tmid        string             `json:"tmid"`
+	U           userObject         `json:"u"`
+	Mentions    []userObject       `json:"mentions"`
+	Ts          date               `json:"ts"`
+	UpdatedAt   date               `json:"_updatedAt"`
+	EditedAt    *date              `json:"editedAt"`
+	Attachments []attachmentObject `json:"attachments"`
+	Urls        []struct {
+		Meta json.RawMessage `json:"meta"`
+	} `json:"urls"`
+	Reactions map[string]struct {
+		Usernames []string `json:"usernames"`
+	} `json:"reactions"`
+}
+
+// validate returns an error if a field the bot relies on is missing.
+func (obj *messageObject) validate() error {
+	switch {
+	case obj.Id == "":
+		return fmt.Errorf("malformed message: missing _id")
+	case obj.Rid == "":
+		return fmt.Errorf("malformed message %s: missing rid", obj.Id)
+	case obj.U.Id == "":
+		return fmt.Errorf("malformed message %s: missing author", obj.Id)
+	}
+	return nil
+}
+
+type attachmentObject struct {
+	Description string `json:"description"`
+	Title       string `json:"title"`
+	TitleLink   string `json:"title_link"`
+	Type        string `json:"type"`
+	ImageURL    string `json:"image_url"`
+	ImageType   string `json:"image_type"`
+	ImageSize   int64  `json:"image_size"`
+	AudioURL    string `json:"audio_url"`
+	AudioType   string `json:"audio_type"`
+	AudioSize   int64  `json:"audio_size"`
+}
+
+// subscriptionObject is the subscription of the bot to a room.
+type subscriptionObject struct {
+	Rid string `json:"rid"`
+	// Name is the name of the room, or the username of the other user in direct messages.
+	Name  string `json:"name"`
+	Fname string `json:"fname"`
+	// T is the type of the room: c (channel), p (private group), d (direct messages) or l (livechat).
+	T string `json:"t"`
+}
+
+// roomObject is a room the bot is a member of, returned by rooms/get.
+type roomObject struct {
+	Id    string `json:"_id"`
+	Name  string `json:"name"`
+	Fname string `json:"fname"`
+	T     string `json:"t"`
+}
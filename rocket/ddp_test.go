@@ -0,0 +1,162 @@
+package rocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFrameTestCon() *RocketCon {
+	return &RocketCon{
+		UserId:      "bot",
+		UserName:    "bot",
+		HostName:    "chat.example.com",
+		channels:    map[string]channel{"room": {Name: "general", Type: RoomTypeChannel}},
+		results:     make(map[string]chan *ddpFrame),
+		messages:    make(chan Message, 10),
+		newMessages: make(chan Message, 10),
+	}
+}
+
+func TestHandleFrameMalformed(t *testing.T) {
+	rock := newFrameTestCon()
+	for _, raw := range []string{
+		`not json`,
+		`{"msg":"connected"}`,
+		`{"msg":"changed","collection":"stream-room-messages","fields":"x"}`,
+		`{"msg":"changed","collection":"stream-room-messages","fields":{"args":[{"_id":"m1"}]}}`,
+		`{"msg":"changed","collection":"stream-room-messages","fields":{"args":[{"_id":"m1","rid":"room","u":{"_id":"u1"},"ts":true}]}}`,
+		`{"msg":"changed","collection":"stream-notify-user","fields":{"args":["inserted",{"fname":"x"}]}}`,
+		`{"msg":"nosub","id":"3","error":{"error":404,"reason":"Not found"}}`,
+	} {
+		assert.Error(t, rock.handleFrame(nil, []byte(raw)), raw)
+	}
+	assert.NoError(t, rock.handleFrame(nil, []byte(`{"server_id":"0"}`)))
+}
+
+func TestHandleFrameMessage(t *testing.T) {
+	rock := newFrameTestCon()
+	raw := `{"msg":"changed","collection":"stream-room-messages","id":"id","fields":{"eventName":"room","args":[{
+		"_id":"m1","rid":"room","msg":"@bot hello","tmid":"t1",
+		"u":{"_id":"u1","username":"jdoe","name":"John Doe"},
+		"ts":{"$date":1700000000000},"_updatedAt":{"$date":1700000000000},
+		"attachments":[{"title":"cat.png","title_link":"/file-upload/f1/cat.png","image_url":"/file-upload/f1/cat.png","image_type":"image/png","image_size":1234}]
+	}]}}`
+	require.NoError(t, rock.handleFrame(nil, []byte(raw)))
+
+	var msg Message
+	select {
+	case msg = <-rock.newMessages:
+	case msg = <-rock.messages:
+	default:
+		t.Fatal("no message")
+	}
+	assert.Equal(t, "m1", msg.Id)
+	assert.Equal(t, "@bot hello", msg.Text)
+	assert.Equal(t, "general", msg.RoomName)
+	assert.Equal(t, "t1", msg.ThreadId)
+	assert.Equal(t, "jdoe", msg.UserName)
+	assert.Equal(t, time.UnixMilli(1700000000000), msg.Timestamp)
+	require.Len(t, msg.Attachments, 1)
+	assert.True(t, msg.Attachments[0].IsImage())
+	assert.Equal(t, "f1", msg.Attachments[0].FileId)
+	assert.Equal(t, int64(1234), msg.Attachments[0].ImageSize)
+}
+
+func TestHandleFrameMessageAfterReply(t *testing.T) {
+	rock := newFrameTestCon()
+	now := time.Now()
+
+	// The reply of the bot, returned by sendMessage, is newer than the message that is still on its way in the stream.
+	var reply messageObject
+	require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{"_id":"r1","rid":"room","msg":"answer","u":{"_id":"bot","username":"bot"},"ts":{"$date":%d}}`,
+		now.Add(2*time.Second).UnixMilli())), &reply))
+	_, err := rock.handleMessageObject(&reply)
+	require.NoError(t, err)
+
+	raw := fmt.Sprintf(`{"msg":"changed","collection":"stream-room-messages","id":"id","fields":{"eventName":"room","args":[{
+		"_id":"m2","rid":"room","msg":"@bot next","u":{"_id":"u1","username":"jdoe"},"ts":{"$date":%d}
+	}]}}`, now.Add(time.Second).UnixMilli())
+	require.NoError(t, rock.handleFrame(nil, []byte(raw)))
+	select {
+	case msg := <-rock.newMessages:
+		assert.Equal(t, "m2", msg.Id)
+	default:
+		t.Fatal("the message is not new")
+	}
+
+	// The same message again, e.g. after a change, is not new.
+	require.NoError(t, rock.handleFrame(nil, []byte(raw)))
+	assert.Empty(t, rock.newMessages)
+}
+
+func TestHandleFrameResult(t *testing.T) {
+	rock := newFrameTestCon()
+	c := rock.watchResults("7")
+	require.NoError(t, rock.handleFrame(nil, []byte(`{"msg":"result","id":"7","error":{"error":"error-invalid-room","reason":"Invalid room"}}`)))
+
+	frame := <-c
+	var ddpErr *DDPError
+	require.True(t, errors.As(error(frame.Error), &ddpErr))
+	assert.Equal(t, "Rocket.Chat replied with an error: error-invalid-room (Invalid room)", ddpErr.Error())
+}
+
+func TestDate(t *testing.T) {
+	var d date
+	require.NoError(t, json.Unmarshal([]byte(`{"$date":1700000000000}`), &d))
+	assert.Equal(t, time.UnixMilli(1700000000000), d.Time)
+	require.NoError(t, json.Unmarshal([]byte(`"2023-11-14T22:13:20.000Z"`), &d))
+	assert.True(t, time.UnixMilli(1700000000000).Equal(d.Time))
+	assert.Error(t, json.Unmarshal([]byte(`{"date":1}`), &d))
+	assert.Error(t, json.Unmarshal([]byte(`"yesterday"`), &d))
+}
+
+func TestMentions(t *testing.T) {
+	rock := newFrameTestCon()
+	rock.channels["dm"] = channel{Name: "jdoe", Type: RoomTypeDirect}
+	parse := func(raw string) Message {
+		var obj messageObject
+		require.NoError(t, json.Unmarshal([]byte(raw), &obj))
+		msg, err := rock.handleMessageObject(&obj)
+		require.NoError(t, err)
+		return msg
+	}
+
+	msg := parse(`{"_id":"m1","rid":"room","msg":"@bot hello","u":{"_id":"u1","username":"jdoe"},"mentions":[{"_id":"bot","username":"bot"}]}`)
+	assert.True(t, msg.IsMention)
+	assert.True(t, msg.AmIPinged)
+	assert.False(t, msg.IsDirect)
+	assert.Equal(t, RoomTypeChannel, msg.RoomType)
+
+	msg = parse(`{"_id":"m2","rid":"room","msg":"ask @bot","u":{"_id":"u1","username":"jdoe"},"mentions":[{"_id":"bot","username":"bot"}]}`)
+	assert.True(t, msg.IsMention)
+	assert.False(t, msg.AmIPinged)
+
+	// Only the mentions listed by Rocket.Chat count, e.g. not the ones in code blocks.
+	msg = parse(`{"_id":"m3","rid":"room","msg":"@all ` + "`@bot`" + `","u":{"_id":"u1","username":"jdoe"},"mentions":[{"_id":"all","username":"all"}]}`)
+	assert.False(t, msg.IsMention)
+	assert.False(t, msg.AmIPinged)
+
+	msg = parse(`{"_id":"m4","rid":"dm","msg":"hello","u":{"_id":"u1","username":"jdoe"}}`)
+	assert.True(t, msg.IsDirect)
+	assert.False(t, msg.IsMention)
+
+	// The room name of a channel can be the same as the username of the author.
+	rock.channels["named"] = channel{Name: "jdoe", Type: RoomTypeChannel}
+	msg = parse(`{"_id":"m5","rid":"named","msg":"hello","u":{"_id":"u1","username":"jdoe"}}`)
+	assert.False(t, msg.IsDirect)
+}
+
+func TestIsAddressedTo(t *testing.T) {
+	assert.True(t, isAddressedTo("@bot hello", "bot"))
+	assert.True(t, isAddressedTo("  @Bot, hello", "bot"))
+	assert.True(t, isAddressedTo("@bot", "bot"))
+	assert.False(t, isAddressedTo("@bot2 hello", "bot"))
+	assert.False(t, isAddressedTo("hello @bot", "bot"))
+	assert.False(t, isAddressedTo("@bo", "bot"))
+}
@@ -1,9 +1,13 @@
 package rocket
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
 )
 
 type Message struct {
@@ -18,58 +22,78 @@ type Message struct {
 	UserId      string              `yaml:"UserId"`
 	RoomName    string              `yaml:"RoomName"`
 	RoomId      string              `yaml:"RoomId"`
+	RoomType    string              `yaml:"RoomType"` // One of the RoomType constants, empty if the room is not known.
+	ThreadId    string              `yaml:"ThreadId"` // The id of the first message of the thread, if the message is in a thread.
 	Text        string              `yaml:"Text"`
 	Timestamp   time.Time           `yaml:"Timestamp"`
 	UpdatedAt   time.Time           `yaml:"UpdatedAt"`
 	Reactions   map[string][]string `yaml:"Reactions"`
-	Attachments []attachment        `yaml:"Attachments"`
+	Attachments []Attachment        `yaml:"Attachments"`
 	QuotedMsgs  []string            `yaml:"QuotedMsgs"`
-	obj         map[string]interface{}
+	Mentions    []User              `yaml:"Mentions"` // The users mentioned in the message, as listed by Rocket.Chat.
 	rocketCon   *RocketCon
 }
 
-type attachment struct {
+type Attachment struct {
 	Description string
 	Title       string
 	Type        string
 	Link        string
+	// ImageURL is set if the attachment is an image. Uploaded files have a path on the server, e.g.
+	// /file-upload/<file id>/<name>, they can be fetched with RocketCon.DownloadFile.
+	ImageURL  string
+	ImageType string
+	ImageSize int64
+	// AudioURL is set if the attachment is an audio file, e.g. a voice message.
+	AudioURL  string
+	AudioType string
+	AudioSize int64
+	// FileId is set if the attachment is an uploaded file.
+	FileId string
+}
+
+// IsImage returns true if the attachment is an image.
+func (a *Attachment) IsImage() bool {
+	return a.ImageURL != ""
 }
 
+// IsAudio returns true if the attachment is an audio file.
+func (a *Attachment) IsAudio() bool {
+	return a.AudioURL != ""
+}
+
+// lastMessageTime is the time of the last change of a message in the stream, see handleStreamedMessage. It is guarded
+// by lastMessageMutex, since the read loop of a new connection may start before the old one has stopped.
 var lastMessageTime time.Time
+var lastMessageMutex sync.Mutex
 
 func init() {
 	lastMessageTime = time.Now()
 }
 
-func (rock *RocketCon) handleMessageObject(obj map[string]interface{}) Message {
+// handleMessageObject parses a message, e.g. from the result of a method or the REST API. It does not move
+// lastMessageTime, the messages of the bot and of the history would hide the ones that are still coming in the stream.
+func (rock *RocketCon) handleMessageObject(obj *messageObject) (Message, error) {
 	var msg Message
+	if err := obj.validate(); err != nil {
+		return msg, err
+	}
 	msg.rocketCon = rock
 	msg.IsNew = true
-	_, msg.IsEdited = obj["editedAt"]
+	msg.IsEdited = obj.EditedAt != nil
 	if msg.IsEdited {
 		msg.IsNew = false
 	}
-	msg.Id = obj["_id"].(string)
-	msg.Text = obj["msg"].(string)
-	msg.RoomId = obj["rid"].(string)
-	msg.UserId = obj["u"].(map[string]interface{})["_id"].(string)
-	msg.UserName = obj["u"].(map[string]interface{})["username"].(string)
-		// Check if the bot name is included in the message text
-	if !strings.Contains(strings.ToLower(msg.Text), fmt.Sprintf("@%s", strings.ToLower(rock.UserName))) {
-		// Prepend "@rocket.cat" to the message text if the bot name is not present
-		//msg.Text = "@rocket.cat " + msg.Text
-	}
-	if attachments, ok := obj["attachments"]; ok && attachments != nil {
-		msg.Attachments = make([]attachment, 0)
-		for _, val := range attachments.([]interface{}) {
-			if _, ok := val.(map[string]interface{})["description"]; ok {
-				var attach attachment
-				attach.Description = val.(map[string]interface{})["description"].(string)
-				attach.Title = val.(map[string]interface{})["title"].(string)
-				attach.Link = val.(map[string]interface{})["title_link"].(string)
-				attach.Type = val.(map[string]interface{})["type"].(string)
-				msg.Attachments = append(msg.Attachments, attach)
-			}
+	msg.Id = obj.Id
+	msg.Text = obj.Msg
+	msg.RoomId = obj.Rid
+	msg.UserId = obj.U.Id
+	msg.UserName = obj.U.Username
+	msg.ThreadId = obj.Tmid
+	if obj.Attachments != nil {
+		msg.Attachments = make([]Attachment, 0, len(obj.Attachments))
+		for _, attach := range obj.Attachments {
+			msg.Attachments = append(msg.Attachments, parseAttachment(attach))
 		}
 	}
 
@@ -77,89 +101,156 @@ func (rock *RocketCon) handleMessageObject(obj map[string]interface{}) Message {
 		msg.IsMe = true
 	}
 
-	if strings.Contains(strings.ToLower(msg.Text), fmt.Sprintf("@%s", strings.ToLower(rock.UserName))) {
-		msg.IsMention = true
-	}
-
-	if len(msg.Text) > len(rock.UserName)+2 {
-		if string(strings.ToLower(msg.Text)[:len(rock.UserName)+2]) == fmt.Sprintf("@%s ", strings.ToLower(rock.UserName)) {
-			msg.AmIPinged = true
+	// Rocket.Chat lists the users mentioned in the message, @all and @here are not mentions of the bot.
+	for _, u := range obj.Mentions {
+		if (u.Id != "" && u.Id == rock.UserId) || strings.EqualFold(u.Username, rock.UserName) {
+			msg.IsMention = true
 		}
+		msg.Mentions = append(msg.Mentions, User{Id: u.Id, Username: u.Username, Name: u.Name})
 	}
-	msg.IsMention = true
-	msg.AmIPinged = true
-	if _, ok := obj["unread"]; !ok {
-		// Not sure what it was, but currently this key is not part of the map, and there's no repeated messages with
-		// this commented out.
-		//msg.IsNew = false
-	}
+	msg.AmIPinged = msg.IsMention && isAddressedTo(msg.Text, rock.UserName)
 
-	if _, ok := obj["urls"]; ok && len(obj["urls"].([]interface{})) != 0 {
-		if _, ok := obj["urls"].([]interface{})[0].(map[string]interface{})["meta"]; ok {
-			msg.IsNew = false
-		}
+	// The preview of a link is added by a change of the message, it is not new.
+	if len(obj.Urls) != 0 && obj.Urls[0].Meta != nil {
+		msg.IsNew = false
 	}
 
-	if react, ok := obj["reactions"]; ok {
+	if obj.Reactions != nil {
 		msg.IsNew = false
 		msg.Reactions = make(map[string][]string)
-		for emote, val := range react.(map[string]interface{}) {
-			for _, username := range val.(map[string]interface{})["usernames"].([]interface{}) {
-				msg.Reactions[emote] = append(msg.Reactions[emote], username.(string))
-			}
-		}
-	}
-	if _, ok := obj["ts"]; ok {
-		var unixTs float64
-		switch obj["ts"].(type) {
-		case map[string]interface{}:
-			unixTs = obj["ts"].(map[string]interface{})["$date"].(float64)
-			msg.Timestamp = time.Unix(int64(unixTs/1000), 0)
-		case string:
-			msg.Timestamp, _ = time.Parse("2006-01-02T15:04:05.999999999Z", obj["ts"].(string))
+		for emote, val := range obj.Reactions {
+			msg.Reactions[emote] = append(msg.Reactions[emote], val.Usernames...)
 		}
 	}
+	msg.Timestamp = obj.Ts.Time
+	msg.UpdatedAt = obj.UpdatedAt.Time
 
-	if _, ok := obj["_updatedAt"]; ok {
-		var unixTs float64
-		switch obj["_updatedAt"].(type) {
-		case map[string]interface{}:
-			unixTs = obj["_updatedAt"].(map[string]interface{})["$date"].(float64)
-			msg.Timestamp = time.Unix(int64(unixTs/1000), 0)
-		case string:
-			msg.Timestamp, _ = time.Parse("2006-01-02T15:04:05.999999999Z", obj["_updatedAt"].(string))
-		}
+	if c, ok := rock.channel(msg.RoomId); ok {
+		msg.RoomName = c.Name
+		msg.RoomType = c.Type
+		msg.IsDirect = c.Type == RoomTypeDirect
 	}
 
-	if val, ok := rock.channels[msg.RoomId]; ok {
-		msg.RoomName = val
-		if msg.RoomName == msg.UserName {
-			msg.IsDirect = true
-		}
-	}
+	msg.QuotedMsgs = rock.quotedMessageIds(msg.Text)
 
-	msg.QuotedMsgs = make([]string, 0)
-	if rocketLinks := strings.Split(msg.Text, "]("+rock.getHttpURL()); len(rocketLinks) > 0 {
-		for _, val := range rocketLinks {
-			msgIdEnd := strings.IndexAny(val, "&)")
-			msgIdBegin := strings.Index(val, "?msg=")
-			if msgIdBegin != -1 && msgIdEnd != -1 {
-				msg.QuotedMsgs = append(msg.QuotedMsgs, val[msgIdBegin+5:msgIdEnd])
-			}
-		}
+	return msg, nil
+}
+
+// handleStreamedMessage parses a message of the stream of a room.
+func (rock *RocketCon) handleStreamedMessage(obj *messageObject) (Message, error) {
+	msg, err := rock.handleMessageObject(obj)
+	if err != nil {
+		return msg, err
 	}
 
-	if msg.Timestamp.After(lastMessageTime) {
-		lastMessageTime = msg.Timestamp
+	// Any change of a message (e.g. a new reaction) is sent again, only the messages that changed since the last one
+	// are new.
+	changed := msg.Timestamp
+	if msg.UpdatedAt.After(changed) {
+		changed = msg.UpdatedAt
+	}
+	lastMessageMutex.Lock()
+	if changed.After(lastMessageTime) {
+		lastMessageTime = changed
 	} else {
 		msg.IsNew = false
 	}
+	lastMessageMutex.Unlock()
+
+	return msg, nil
+}
+
+// isAddressedTo returns true if the text starts with the mention of the user, e.g. "@bot hello".
+func isAddressedTo(text string, username string) bool {
+	text = strings.TrimSpace(text)
+	mention := "@" + username
+	if len(text) < len(mention) || !strings.EqualFold(text[:len(mention)], mention) {
+		return false
+	}
+	// The mention of @bot2 does not address @bot.
+	rest := text[len(mention):]
+	return rest == "" || strings.IndexAny(rest[:1], " \t\n,:;.!?") == 0
+}
+
+func parseAttachment(obj attachmentObject) Attachment {
+	attach := Attachment{
+		Description: obj.Description,
+		Title:       obj.Title,
+		Link:        obj.TitleLink,
+		Type:        obj.Type,
+		ImageURL:    obj.ImageURL,
+		ImageType:   obj.ImageType,
+		ImageSize:   obj.ImageSize,
+		AudioURL:    obj.AudioURL,
+		AudioType:   obj.AudioType,
+		AudioSize:   obj.AudioSize,
+	}
+	for _, link := range []string{attach.Link, attach.ImageURL, attach.AudioURL} {
+		if strings.HasPrefix(link, "/file-upload/") {
+			attach.FileId = strings.SplitN(strings.TrimPrefix(link, "/file-upload/"), "/", 2)[0]
+			break
+		}
+	}
+	return attach
+}
 
-	return msg
+// DownloadFile downloads an uploaded file of the message, see RocketCon.DownloadFile.
+func (msg *Message) DownloadFile(path string, maxSize int64) ([]byte, string, error) {
+	return msg.rocketCon.DownloadFile(path, maxSize)
 }
 
+// DownloadFileContext is like DownloadFile, but the download is canceled when ctx is done.
+func (msg *Message) DownloadFileContext(ctx context.Context, path string, maxSize int64) ([]byte, string, error) {
+	return msg.rocketCon.DownloadFileContext(ctx, path, maxSize)
+}
+
+// Reply answers the message in its thread. Messages in the main channel are answered in the main channel, unless
+// AlwaysThread is set.
 func (msg *Message) Reply(text string) (Message, error) {
-	return msg.rocketCon.SendMessage(msg.RoomId, text)
+	return msg.ReplyContext(context.Background(), text)
+}
+
+// ReplyContext is like Reply, but it stops waiting for Rocket.Chat when ctx is done.
+func (msg *Message) ReplyContext(ctx context.Context, text string) (Message, error) {
+	reply, err := msg.rocketCon.SendThreadMessageContext(ctx, msg.RoomId, msg.ReplyThreadId(), text)
+	if err == nil {
+		metrics.RepliesSent.Inc(msg.metricsRoom())
+	}
+	return reply, err
+}
+
+// ReplyFile uploads a file as a reply to the message, in the same thread as Reply would send it.
+func (msg *Message) ReplyFile(name string, data []byte, description string) (Message, error) {
+	return msg.ReplyFileContext(context.Background(), name, data, description)
+}
+
+// ReplyFileContext is like ReplyFile, but the upload is canceled when ctx is done.
+func (msg *Message) ReplyFileContext(ctx context.Context, name string, data []byte, description string) (Message, error) {
+	reply, err := msg.rocketCon.UploadThreadFileContext(ctx, msg.RoomId, msg.ReplyThreadId(), name, data, description)
+	if err == nil {
+		metrics.RepliesSent.Inc(msg.metricsRoom())
+	}
+	return reply, err
+}
+
+// metricsRoom returns the name of the room of the message for the metrics, or its id if the name is not known.
+func (msg *Message) metricsRoom() string {
+	if msg.RoomName != "" {
+		return msg.RoomName
+	}
+	return msg.RoomId
+}
+
+// ReplyThreadId returns the id of the thread the replies to the message go to, or an empty string if they go to the
+// main channel.
+func (msg *Message) ReplyThreadId() string {
+	if msg.ThreadId != "" {
+		return msg.ThreadId
+	}
+	if msg.rocketCon != nil && msg.rocketCon.AlwaysThread && !msg.IsDirect {
+		return msg.Id
+	}
+	return ""
 }
 
 func (msg *Message) DM(text string) (Message, error) {
@@ -177,15 +268,28 @@ func (msg *Message) React(emoji string) error {
 	return msg.rocketCon.React(msg.Id, emoji)
 }
 
+// MaxMessageSize returns the maximum length of a message in characters, see RocketCon.MaxMessageSize.
+func (msg *Message) MaxMessageSize() int {
+	if msg.rocketCon == nil {
+		return defaultMaxMessageSize
+	}
+	return msg.rocketCon.MaxMessageSize()
+}
+
+// GetNotAddressedText returns the text without the mentions of the bot, e.g. "@bot, hello" becomes "hello".
 func (msg *Message) GetNotAddressedText() string {
-	r := msg.Text
-	if len(msg.Text) > 2 && msg.AmIPinged {
-		r = string(strings.ToLower(msg.Text))
+	if msg.rocketCon == nil {
+		return msg.Text
 	}
-	return r
+	return strings.TrimSpace(RemoveMention(msg.Text, msg.rocketCon.UserName))
 }
 
 func (msg *Message) EditText(text string) error {
+	return msg.EditTextContext(context.Background(), text)
+}
+
+// EditTextContext is like EditText, but it stops waiting for Rocket.Chat when ctx is done.
+func (msg *Message) EditTextContext(ctx context.Context, text string) error {
 	obj := map[string]interface{}{
 		"method": "updateMessage",
 		"params": []map[string]interface{}{
@@ -197,7 +301,7 @@ func (msg *Message) EditText(text string) error {
 		},
 	}
 
-	_, err := msg.rocketCon.runMethod(obj)
+	err := msg.rocketCon.runMethodContext(ctx, obj, nil)
 	return err
 }
 
@@ -211,7 +315,7 @@ func (msg *Message) Delete(text string) error {
 		},
 	}
 
-	_, err := msg.rocketCon.runMethod(obj)
+	err := msg.rocketCon.runMethod(obj, nil)
 	return err
 }
 
@@ -224,7 +328,7 @@ func (msg *Message) SetIsTyping(typing bool) error {
 			typing,
 		},
 	}
-	_, err := msg.rocketCon.runMethod(obj)
+	err := msg.rocketCon.runMethod(obj, nil)
 	return err
 }
 
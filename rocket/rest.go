@@ -0,0 +1,314 @@
+package rocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// https://developer.rocket.chat/apidocs
+
+const (
+	restTimeout = 60 * time.Second
+	// restPageSize is the number of items requested in a page by restPages.
+	restPageSize = 100
+	// maxRateLimitWait is the longest time a request waits for the rate limit to reset, instead of failing.
+	maxRateLimitWait = 30 * time.Second
+)
+
+// RestError is an error response of the REST API.
+type RestError struct {
+	StatusCode int
+	// ErrorType is the machine-readable type of the error, e.g. error-room-not-found.
+	ErrorType string `json:"errorType"`
+	Message   string `json:"error"`
+}
+
+func (e *RestError) Error() string {
+	msg := fmt.Sprintf("rocketchat REST error (HTTP %d)", e.StatusCode)
+	if e.ErrorType != "" {
+		msg += " " + e.ErrorType
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// IsRateLimited returns true if the request has been refused because of the rate limit.
+func (e *RestError) IsRateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// restResponse is the envelope of all REST responses.
+type restResponse struct {
+	Success   bool   `json:"success"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// restPage is the envelope of paginated responses.
+type restPage struct {
+	Count  int `json:"count"`
+	Offset int `json:"offset"`
+	Total  int `json:"total"`
+}
+
+// rateLimits tracks the x-ratelimit-* headers of the responses by endpoint, so requests wait for the reset instead
+// of being refused.
+type rateLimits struct {
+	mutex     sync.Mutex
+	endpoints map[string]rateLimit
+}
+
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+// wait returns how long a request to the endpoint has to wait for the rate limit to reset.
+func (r *rateLimits) wait(endpoint string, now time.Time) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	limit, ok := r.endpoints[endpoint]
+	if !ok || limit.remaining > 0 || !limit.reset.After(now) {
+		return 0
+	}
+	return limit.reset.Sub(now)
+}
+
+func (r *rateLimits) update(endpoint string, header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	// The reset is a unix timestamp in milliseconds.
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.endpoints == nil {
+		r.endpoints = make(map[string]rateLimit)
+	}
+	r.endpoints[endpoint] = rateLimit{remaining: remaining, reset: time.UnixMilli(reset)}
+}
+
+func (rock *RocketCon) httpClient() *http.Client {
+	rock.clientOnce.Do(func() {
+		rock.client = &http.Client{Timeout: restTimeout}
+	})
+	return rock.client
+}
+
+// newRestRequest creates a request to the Rocket.Chat server with the authentication of the bot.
+func (rock *RocketCon) newRestRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, rock.getHttpURL()+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %w", err)
+	}
+	request.Header.Set("X-Auth-Token", rock.AuthToken)
+	request.Header.Set("X-User-Id", rock.UserId)
+	return request, nil
+}
+
+// restDo sends a request to the REST API, and decodes the JSON response into out, which may be nil. Error responses
+// are returned as *RestError. If the rate limit of the endpoint is exhausted, the request waits for the reset, if it
+// is not too far.
+func (rock *RocketCon) restDo(method string, path string, query url.Values, contentType string, body []byte, out interface{}) error {
+	return rock.restDoContext(context.Background(), method, path, query, contentType, body, out)
+}
+
+// restDoContext is like restDo, but the request is canceled when ctx is done.
+func (rock *RocketCon) restDoContext(ctx context.Context, method string, path string, query url.Values, contentType string, body []byte, out interface{}) error {
+	endpoint := path
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	for attempt := 1; ; attempt++ {
+		if wait := rock.rateLimits.wait(endpoint, time.Now()); wait > 0 {
+			if wait > maxRateLimitWait {
+				return &RestError{StatusCode: http.StatusTooManyRequests, ErrorType: "error-too-many-requests",
+					Message: fmt.Sprintf("rate limited for %s", wait.Round(time.Second))}
+			}
+			log.WithField("endpoint", endpoint).WithField("wait", wait).Info("Waiting for the rate limit of Rocket.Chat.")
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return fmt.Errorf("cannot perform request to %s: %w", endpoint, ctx.Err())
+			}
+		}
+
+		request, err := rock.newRestRequest(ctx, method, path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+
+		response, err := rock.httpClient().Do(request)
+		if err != nil {
+			return fmt.Errorf("cannot perform request to %s: %w", endpoint, err)
+		}
+		data, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read response of %s: %w", endpoint, err)
+		}
+		rock.rateLimits.update(endpoint, response.Header)
+
+		if response.StatusCode == http.StatusTooManyRequests && attempt == 1 {
+			// The limit is known now, the next attempt waits for the reset.
+			continue
+		}
+		return decodeRestResponse(response.StatusCode, data, out)
+	}
+}
+
+func decodeRestResponse(statusCode int, data []byte, out interface{}) error {
+	var envelope restResponse
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		if statusCode != http.StatusOK {
+			return &RestError{StatusCode: statusCode, Message: strings.TrimSpace(string(data))}
+		}
+		return fmt.Errorf("cannot parse response: %w", err)
+	}
+	if statusCode != http.StatusOK || !envelope.Success {
+		return &RestError{StatusCode: statusCode, ErrorType: envelope.ErrorType, Message: envelope.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("cannot parse response: %w", err)
+	}
+	return nil
+}
+
+func (rock *RocketCon) restGet(path string, query url.Values, out interface{}) error {
+	return rock.restDo("GET", path, query, "", nil, out)
+}
+
+// restFile is a file in a multipart request.
+type restFile struct {
+	Field string
+	Name  string
+	Data  []byte
+}
+
+// restPostMultipart posts a form with files, e.g. an upload. The request is canceled when ctx is done.
+func (rock *RocketCon) restPostMultipart(ctx context.Context, path string, fields map[string]string, files []restFile, out interface{}) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, f := range files {
+		fw, err := w.CreateFormFile(f.Field, f.Name)
+		if err != nil {
+			return fmt.Errorf("cannot create request body: %w", err)
+		}
+		if _, err := fw.Write(f.Data); err != nil {
+			return fmt.Errorf("cannot create request body: %w", err)
+		}
+	}
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			return fmt.Errorf("cannot create request body: %w", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot create request body: %w", err)
+	}
+	return rock.restDoContext(ctx, "POST", path, nil, w.FormDataContentType(), body.Bytes(), out)
+}
+
+// restPages gets all pages of a paginated endpoint, and calls page with the raw JSON of each. The count and offset
+// query parameters are set by restPages.
+func (rock *RocketCon) restPages(path string, query url.Values, page func(data json.RawMessage) error) error {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("count", strconv.Itoa(restPageSize))
+
+	for offset := 0; ; {
+		q.Set("offset", strconv.Itoa(offset))
+		var data json.RawMessage
+		if err := rock.restGet(path, q, &data); err != nil {
+			return err
+		}
+		var p restPage
+		if err := json.Unmarshal(data, &p); err != nil {
+			return fmt.Errorf("cannot parse page: %w", err)
+		}
+		if err := page(data); err != nil {
+			return err
+		}
+
+		offset += p.Count
+		if p.Count == 0 || offset >= p.Total {
+			return nil
+		}
+	}
+}
+
+// ErrFileTooLarge is returned by DownloadFile if the file is larger than the limit.
+var ErrFileTooLarge = errors.New("the file is too large")
+
+// DownloadFile downloads a file uploaded to Rocket.Chat, e.g. the ImageURL of an attachment, with the authentication
+// of the bot. The path has to be on the Rocket.Chat server, so the credentials are not sent anywhere else. It returns
+// the content and the content type of the file. If maxSize is positive, larger files are not downloaded.
+func (rock *RocketCon) DownloadFile(path string, maxSize int64) ([]byte, string, error) {
+	return rock.DownloadFileContext(context.Background(), path, maxSize)
+}
+
+// DownloadFileContext is like DownloadFile, but the download is canceled when ctx is done.
+func (rock *RocketCon) DownloadFileContext(ctx context.Context, path string, maxSize int64) ([]byte, string, error) {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return nil, "", fmt.Errorf("not a path on the Rocket.Chat server: %s", path)
+	}
+
+	request, err := rock.newRestRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	response, err := rock.httpClient().Do(request)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot download file: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, "", &RestError{StatusCode: response.StatusCode, Message: "cannot download file"}
+	}
+	var reader io.Reader = response.Body
+	if maxSize > 0 {
+		if response.ContentLength > maxSize {
+			return nil, "", ErrFileTooLarge
+		}
+		// The content length may be missing or wrong.
+		reader = io.LimitReader(response.Body, maxSize+1)
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot download file: %w", err)
+	}
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		return nil, "", ErrFileTooLarge
+	}
+	return body, response.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,130 @@
+package rocket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCon returns a connection whose REST requests are served by the handler.
+func newTestCon(t *testing.T, handler http.HandlerFunc) *RocketCon {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return &RocketCon{HostName: host, HostPort: uint16(p), UserId: "bot", AuthToken: "token"}
+}
+
+func TestRestError(t *testing.T) {
+	rock := newTestCon(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token", r.Header.Get("X-Auth-Token"))
+		assert.Equal(t, "bot", r.Header.Get("X-User-Id"))
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"success":false,"errorType":"error-invalid-user","error":"Invalid user"}`)
+	})
+
+	_, err := rock.RequestUserName("nobody")
+	var restErr *RestError
+	require.True(t, errors.As(err, &restErr))
+	assert.Equal(t, http.StatusBadRequest, restErr.StatusCode)
+	assert.Equal(t, "error-invalid-user", restErr.ErrorType)
+	assert.Equal(t, "Invalid user", restErr.Message)
+}
+
+func TestRestUser(t *testing.T) {
+	rock := newTestCon(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/users.info", r.URL.Path)
+		assert.Equal(t, "u1", r.URL.Query().Get("userId"))
+		fmt.Fprint(w, `{"success":true,"user":{"_id":"u1","username":"jdoe","name":"John Doe"}}`)
+	})
+
+	name, err := rock.RequestUserName("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, "jdoe", name)
+	name, err = rock.RequestDisplayName("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, "John Doe", name)
+}
+
+func TestRestSetting(t *testing.T) {
+	rock := newTestCon(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/settings.public", r.URL.Path)
+		fmt.Fprintf(w, `{"success":true,"settings":[{"_id":%q,"value":8000}]}`, r.URL.Query().Get("_id"))
+	})
+
+	assert.Equal(t, 8000, rock.requestMaxMessageSize())
+	var value string
+	assert.Error(t, rock.RequestPublicSetting("Site_Name", &value))
+}
+
+func TestRestPagination(t *testing.T) {
+	const total = 250
+	rock := newTestCon(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/channels.members", r.URL.Path)
+		assert.Equal(t, "room", r.URL.Query().Get("roomId"))
+		count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		n := 0
+		members := ""
+		for i := offset; i < total && i < offset+count; i++ {
+			if n > 0 {
+				members += ","
+			}
+			members += fmt.Sprintf(`{"_id":"%d","username":"user%d"}`, i, i)
+			n++
+		}
+		fmt.Fprintf(w, `{"success":true,"members":[%s],"count":%d,"offset":%d,"total":%d}`, members, n, offset, total)
+	})
+
+	users, err := rock.ListUsersInRoomId("room")
+	assert.NoError(t, err)
+	require.Len(t, users, total)
+	assert.Equal(t, "user0", users[0])
+	assert.Equal(t, "user249", users[total-1])
+}
+
+func TestRestRateLimit(t *testing.T) {
+	requests := 0
+	rock := newTestCon(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		reset := time.Now().Add(50 * time.Millisecond).UnixMilli()
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		if requests == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"success":false,"error":"Too many requests"}`)
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", "10")
+		fmt.Fprint(w, `{"success":true,"emojis":{"update":[{"name":"party"}]}}`)
+	})
+
+	emojis, err := rock.ListCustomEmojis()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":party:"}, emojis)
+	assert.Equal(t, 2, requests)
+}
+
+func TestRateLimitsWait(t *testing.T) {
+	var limits rateLimits
+	now := time.Now()
+	assert.Zero(t, limits.wait("/api/v1/x", now))
+
+	header := http.Header{}
+	header.Set("X-RateLimit-Remaining", "0")
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(time.Second).UnixMilli(), 10))
+	limits.update("/api/v1/x", header)
+	assert.InDelta(t, time.Second, limits.wait("/api/v1/x", now), float64(time.Millisecond))
+	assert.Zero(t, limits.wait("/api/v1/y", now))
+	assert.Zero(t, limits.wait("/api/v1/x", now.Add(2*time.Second)))
+}
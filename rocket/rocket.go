@@ -1,19 +1,20 @@
 package rocket
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mimrock/rocketchat_openai_bot/config"
 
-	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -26,21 +27,24 @@ type RocketCon struct {
 	HostName      string `yaml:"domain"`
 	HostSSL       bool   `yaml:"ssl"`
 	HostPort      uint16 `yaml:"port"`
+	AlwaysThread  bool   `yaml:"alwaysthread"`
 	session       string
-	channels      map[string]string
-	send          chan interface{}
-	receive       chan interface{}
-	results       map[string]chan map[string]interface{}
-	resultsMutex  sync.RWMutex
-	resultsAppend chan struct {
-		string  string
-		channel chan map[string]interface{}
-	}
-	resultsDel  chan string
-	nextId      chan string
-	messages    chan Message
-	newMessages chan Message
-	quit        chan struct{}
+	channels      map[string]channel
+	channelsMutex sync.RWMutex
+	conn          *connection
+	connMutex     sync.RWMutex
+	results       map[string]chan *ddpFrame
+	resultsMutex  sync.Mutex
+	nextId        chan string
+	messages      chan Message
+	newMessages   chan Message
+	quit          chan struct{}
+	quitOnce      sync.Once
+	client        *http.Client
+	clientOnce    sync.Once
+	rateLimits    rateLimits
+	// maxMessageSize is the Message_MaxAllowedSize setting of the server, read when the bot connects.
+	maxMessageSize int
 }
 
 const STATUS_ONLINE string = "online"
@@ -48,6 +52,14 @@ const STATUS_BUSY string = "busy"
 const STATUS_AWAY string = "away"
 const STATUS_OFFLINE string = "offline"
 
+// The types of rooms.
+const (
+	RoomTypeChannel  = "c"
+	RoomTypePrivate  = "p"
+	RoomTypeDirect   = "d"
+	RoomTypeLivechat = "l"
+)
+
 func NewConnection(domain string, username string, password string) (*RocketCon, error) {
 	log.WithField("message", "Method").Debug("NewConnection")
 	var rock RocketCon
@@ -77,6 +89,7 @@ func NewConnectionFromConfig(config *config.Config) (*RocketCon, error) {
 	rock.HostPort = config.RocketChat.Port
 	rock.HostSSL = config.RocketChat.SSL
 	rock.AuthToken = config.RocketChat.AuthToken
+	rock.AlwaysThread = config.RocketChat.AlwaysThread
 
 	if rock.HostName == "" {
 		return &rock, errors.New("HostName not set")
@@ -98,278 +111,135 @@ func NewConnectionFromConfig(config *config.Config) (*RocketCon, error) {
 }
 
 func (rock *RocketCon) init() error {
-		log.WithField("message", "INit").Debug("I am in init")
-	// Init variables
-	rock.send = make(chan interface{}, 1024)
-	rock.receive = make(chan interface{}, 1024)
-	rock.resultsAppend = make(chan struct {
-		string  string
-		channel chan map[string]interface{}
-	}, 0)
-	rock.resultsDel = make(chan string, 1024)
-	rock.results = make(map[string]chan map[string]interface{})
+	rock.results = make(map[string]chan *ddpFrame)
 	rock.nextId = make(chan string, 0)
 	rock.messages = make(chan Message, 1024)
 	rock.newMessages = make(chan Message, 1024)
 	rock.quit = make(chan struct{}, 0)
-	rock.channels = make(map[string]string)
+	rock.channels = make(map[string]channel)
 
+	// Manage Method/Subscription Ids
 	go func() {
-	  for {
-		// Use defer to recover from any panic in the run method
-		defer func() {
-		if r := recover(); r != nil {
-			log.WithField("error", r).Error("Recovered from panic in run method")
-			}
-		}()
-		rock.run() // Call the run method
-		time.Sleep(2 * time.Second) // Optional: delay before restarting
+		for i := uint64(0); ; i++ {
+			i++
+			rock.nextId <- fmt.Sprintf("%d", i)
 		}
 	}()
-log.WithField("message", "afterRun").Debug("hello")
-	// Send Init Messages
-	rock.connect()
-	err := rock.login()
+
+	// The first connection is not retried, so configuration errors (e.g. a wrong password) are reported immediately.
+	conn, err := rock.open()
 	if err != nil {
-		close(rock.quit)
+		rock.Close()
 		return err
 	}
 
+	user, err := rock.RequestUser(rock.UserId)
+	if err != nil {
+		log.WithError(err).Error("Cannot request the user info of the bot.")
+	}
 	if rock.UserName == "" {
-		rock.UserName = rock.RequestUserName(rock.UserId)
+		rock.UserName = user.Username
 	}
+	rock.DisplayName = user.Name
+	rock.maxMessageSize = rock.requestMaxMessageSize()
 
-	rock.subscribeRooms()
-	rock.DisplayName, _ = rock.RequestDisplayName(rock.UserId)
+	go rock.supervise(conn)
 	return nil
 }
 
-func (rock *RocketCon) run() {
-	log.WithField("message", "Method").Debug("run")
-	
-	
-	// Set some websocket tunables
-	const socketreadsizelimit = 65536
-	const pingtime = 120 * time.Second
-	const timeout = 125 * time.Second
-	log.WithField("message", "Method").Debug("rock.getWsUrl")
-	// Define Websocket URL
-	wsURL := rock.getWsURL()
-
-	// Init websocket
-	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
-	if err != nil {
-		log.WithError(err).WithField("wsURL", wsURL).Error("Cannot initiate websocket")
+// Close stops the connection for good. GetMessage and GetNewMessage return an error afterwards.
+func (rock *RocketCon) Close() error {
+	rock.quitOnce.Do(func() {
 		close(rock.quit)
-	}
-	log.WithField("message", "Method").Debug("ws.close")
-	defer ws.Close()
-	
-	// Configure Websocket using Tunables
-	ws.SetReadLimit(socketreadsizelimit)
-	ws.SetReadDeadline(time.Now().Add(timeout))
-	log.WithField("message", "Method").Debug("BeforePong")
-	ws.SetPongHandler(func(string) error {
-		ws.SetReadDeadline(time.Now().Add(timeout))
-		return nil
 	})
+	if conn := rock.currentConn(); conn != nil {
+		conn.close()
+	}
+	return nil
+}
 
-	
-	tick := time.NewTicker(pingtime)
-	defer tick.Stop()
-	log.WithField("message", "Method").Debug("Tickstop")
-	
-	// Manage Method/Subscription Ids
-	go func() {
-		for i := uint64(0); ; i++ {
-			i++
-			rock.nextId <- fmt.Sprintf("%d", i)
-		}
-	}()
-log.WithField("message", "Method").Debug("Subscription")
-	
-	// Manage Results map
-	go func() {
-		for {
-			select {
-			case addition := <-rock.resultsAppend:
-				rock.resultsMutex.Lock()
-				rock.results[addition.string] = addition.channel
-				rock.resultsMutex.Unlock()
-			case remove := <-rock.resultsDel:
-				rock.resultsMutex.Lock()
-				delete(rock.results, remove)
-				rock.resultsMutex.Unlock()
-			}
-		}
-	}()
-	log.WithField("message", "Method").Debug("ManageResult MAp")
-
-	// Send Thread
-	go func() {
-		for {
-			msg := <-rock.send
-			packet, err := json.Marshal(msg)
-			err = ws.WriteMessage(websocket.TextMessage, packet)
-			if err != nil {
-				log.WithError(err).WithField("packet", packet).Error("Cannot write to websocket.")
-				return
-			}
-		}
-	}()
-log.WithField("message", "Method").Debug("1")
+// Shutdown stops the connection for good, like Close, but cleanly: the status of the bot is set to offline, the
+// subscriptions are stopped, and the websocket is closed with a close frame. If ctx is done before the server closes
+// the websocket too, it is closed anyway.
+func (rock *RocketCon) Shutdown(ctx context.Context) error {
+	// No messages are delivered and no reconnection is made from now on.
+	rock.quitOnce.Do(func() {
+		close(rock.quit)
+	})
+	conn := rock.currentConn()
+	if conn == nil {
+		return nil
+	}
+	defer conn.close()
 
-	// Read Thread
-	for {
-		_, raw, err := ws.ReadMessage()
-		ws.SetReadDeadline(time.Now().Add(timeout))
+	offline := map[string]interface{}{
+		"method": "UserPresence:" + STATUS_OFFLINE,
+		"params": []string{},
+	}
+	var err error
+	if e := rock.runMethodContext(ctx, offline, nil); e != nil {
+		err = fmt.Errorf("cannot set the status to offline: %w", e)
+	}
 
-		if err != nil {
-			log.WithError(err).WithField("ws", ws).Warn("Cannot read websocket.")
-			break
-		}
-log.WithField("message", "Method").Debug("2")
-		var pack map[string]interface{}
-		err = json.Unmarshal(raw, &pack)
-		if err != nil {
-			log.WithError(err).WithField("raw", raw).Warn("Cannot unmarshal data read from websocket.")
-			continue
-		}
-log.WithField("message", "Method").Debug("3")
-		if msg, ok := pack["msg"]; ok {
-			switch msg {
-			case "connected":
-				if session, ok := pack["session"].(string); ok {
-   				 rock.session = session
-						} else {
-							    log.Warn("Session is nil or not a string")
-								}
-				log.WithField("message", "Method").Debug("4")
-			case "result":
-				rock.resultsMutex.RLock()
-				if channel, ok := rock.results[pack["id"].(string)]; ok {
-					// We want to unlock the resultsMutex before the following blocking operation.
-					rock.resultsMutex.RUnlock()
-					channel <- pack
-					log.WithField("message", "Method").Debug("5")
-				} else {
-					rock.resultsMutex.RUnlock()
-					log.WithField("message", "Method").Debug("6")
-				}
-				log.WithField("message", "Method").Debug("7")
-				rock.resultsDel <- pack["id"].(string)
-				log.WithField("message", "Method").Debug("8")
-			case "added":
-				log.WithField("message", "Method").Debug("9")
-				switch pack["collection"].(string) {
-				case "users":
-					break
-				default:
-					log.WithField("pack", pack).Trace("Ignored incoming added msg.")
-				}
-			case "updated":
-				break
-			case "changed":
-				log.WithField("message", "Method").Debug("11")
-				log.WithField("message", "Method").Debug(pack) 
-				log.WithField("message", "Method").Debug(pack["fields"])
-// Check if it exists and is not nil
-			
-				obj := pack["fields"].(map[string]interface{})["args"].([]interface{})
-				log.WithField("message", "Method").Debug("12")
-				log.WithField("message", "Method").Debug(pack["collection"])
-				switch pack["collection"].(string) {
-				case "stream-notify-user":
-					log.WithField("message", "Method").Debug("13")
-					switch obj[0].(string) {
-					case "inserted":
-						
-						log.WithField("message", "Method").Debug("14")
-						log.WithField("message", "Method").Debug(obj[1])
-						id := obj[1].(map[string]interface{})["rid"].(string)
-						name := obj[1].(map[string]interface{})["fname"].(string)
-						log.WithField("message", "Method").Debug("Ok? here")
-						rock.channels[id] = name
-						rock.subscribeRoom(id)
-						log.WithField("message", "Method").Debug("After subsription")
-					}
-				case "stream-room-messages":
-					for _, val := range obj {
-						log.WithField("message", "Method").Debug("15")
-						message := rock.handleMessageObject(val.(map[string]interface{}))
-						log.WithField("message", "Method").Debug("16")
-						if message.IsNew && !message.IsMe {
-							select {
-							case rock.newMessages <- message:
-								break
-							default:
-							}
-						} else {
-							select {
-							case rock.messages <- message:
-								break
-							default:
-							}
-						}
-					}
-				}
-			case "ready":
-				break
-			case "ping":
-				log.WithField("message", "Method").Debug("17")
-				pong := map[string]string{
-					"msg": "pong",
-				}
-				rock.send <- pong
-			default:
-				log.WithField("raw", string(raw)).Trace("Ping.")
-			}
+	for _, id := range conn.subscriptionIds() {
+		conn.write(map[string]interface{}{"msg": "unsub", "id": id})
+	}
+	conn.write(closeFrame{})
+	select {
+	case <-conn.done:
+	case <-ctx.Done():
+		if err == nil {
+			err = fmt.Errorf("the websocket has not been closed by the server: %w", ctx.Err())
 		}
 	}
-	close(rock.quit)
-	time.Sleep(100 * time.Millisecond) // Ugly hack to make sure rock.quit is closed before we return
+	return err
 }
 
 func (rock *RocketCon) generateId() string {
 	return <-rock.nextId
 }
 
-func (rock *RocketCon) watchResults(str string) chan map[string]interface{} {
-	c := make(chan map[string]interface{})
-	rock.resultsAppend <- struct {
-		string  string
-		channel chan map[string]interface{}
-	}{string: str, channel: c}
+func (rock *RocketCon) watchResults(str string) chan *ddpFrame {
+	// The channel is buffered, so the read loop never blocks on a caller that has already given up waiting.
+	c := make(chan *ddpFrame, 1)
+	rock.resultsMutex.Lock()
+	rock.results[str] = c
+	rock.resultsMutex.Unlock()
 	return c
 }
 
+func (rock *RocketCon) unwatchResults(str string) {
+	rock.resultsMutex.Lock()
+	delete(rock.results, str)
+	rock.resultsMutex.Unlock()
+}
+
 func (rock *RocketCon) subscribeRoom(rid string) {
-	subscribeRoom := map[string]interface{}{
-		"msg":  "sub",
-		"id":   rock.generateId(),
-		"name": "stream-room-messages",
-		"params": []interface{}{
-			rid,
-			false,
-		},
+	rock.subscribe("stream-room-messages", rid, false)
+}
+
+// subscribe subscribes to a stream on the current connection. The id of the subscription is kept, so it can be
+// stopped on shutdown.
+func (rock *RocketCon) subscribe(name string, params ...interface{}) {
+	conn := rock.currentConn()
+	if conn == nil {
+		return
 	}
-	rock.send <- subscribeRoom
+	id := rock.generateId()
+	conn.addSubscription(id)
+	conn.write(map[string]interface{}{
+		"msg":    "sub",
+		"id":     id,
+		"name":   name,
+		"params": params,
+	})
 }
 
 func (rock *RocketCon) subscribeRooms() error {
 	if rock.UserId == "" {
 		return errors.New("error: Can't subscribe to rooms if user is not known")
 	}
-	subscriptionMonitor := map[string]interface{}{
-		"msg":  "sub",
-		"id":   rock.generateId(),
-		"name": "stream-notify-user",
-		"params": []interface{}{
-			rock.UserId + "/subscriptions-changed",
-			false,
-		},
-	}
-	rock.send <- subscriptionMonitor
+	rock.subscribe("stream-notify-user", rock.UserId+"/subscriptions-changed", false)
 
 	subscriptionsGet := map[string]interface{}{
 		"method": "subscriptions/get",
@@ -379,24 +249,65 @@ func (rock *RocketCon) subscribeRooms() error {
 			},
 		},
 	}
-	reply, err := rock.runMethod(subscriptionsGet)
+	var result struct {
+		Update []subscriptionObject `json:"update"`
+	}
+	err := rock.runMethod(subscriptionsGet, &result)
 	if err != nil {
 		return err
 	}
 
-	objects := reply["result"].(map[string]interface{})["update"].([]interface{})
+	subscribed := make(map[string]bool)
+	for _, sub := range result.Update {
+		if sub.Rid == "" {
+			continue
+		}
+		rock.subscribeRoom(sub.Rid)
+		subscribed[sub.Rid] = true
+		if sub.Name != "" {
+			rock.setChannel(sub.Rid, sub.Name, sub.T)
+		}
+	}
 
-	for index, _ := range objects {
-		rock.subscribeRoom(objects[index].(map[string]interface{})["rid"].(string))
-		if _, ok := objects[index].(map[string]interface{})["name"]; ok {
-			name := objects[index].(map[string]interface{})["name"].(string)
-			id := objects[index].(map[string]interface{})["rid"].(string)
-			rock.channels[id] = name
+	// After a reconnection, rooms that the bot has joined since the start are not necessarily part of the list above.
+	for _, id := range rock.channelIds() {
+		if !subscribed[id] {
+			rock.subscribeRoom(id)
 		}
 	}
 	return nil
 }
 
+// channel is a room the bot is a member of.
+type channel struct {
+	Name string
+	// Type is the type of the room, one of the RoomType constants.
+	Type string
+}
+
+func (rock *RocketCon) setChannel(id string, name string, roomType string) {
+	rock.channelsMutex.Lock()
+	rock.channels[id] = channel{Name: name, Type: roomType}
+	rock.channelsMutex.Unlock()
+}
+
+func (rock *RocketCon) channel(id string) (channel, bool) {
+	rock.channelsMutex.RLock()
+	defer rock.channelsMutex.RUnlock()
+	c, ok := rock.channels[id]
+	return c, ok
+}
+
+func (rock *RocketCon) channelIds() []string {
+	rock.channelsMutex.RLock()
+	defer rock.channelsMutex.RUnlock()
+	ids := make([]string, 0, len(rock.channels))
+	for id := range rock.channels {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 func (rock *RocketCon) getHttpURL() string {
 	var httpURL string
 	if rock.HostSSL {
@@ -411,52 +322,77 @@ func (rock *RocketCon) getWsURL() string {
 	return strings.Replace(httpURL, "http", "ws", 1) + "/websocket"
 }
 
-func (rock *RocketCon) restRequest(str string) []byte {
-	// Define Websocket URL
-	httpURL := rock.getHttpURL() + str
+// UploadFile uploads a file to the room, with the description as its message.
+func (rock *RocketCon) UploadFile(rid string, name string, data []byte, description string) (Message, error) {
+	return rock.UploadThreadFile(rid, "", name, data, description)
+}
 
-	// Build Request
-	client := &http.Client{}
-	request, err := http.NewRequest("GET", httpURL, nil)
-	if err != nil {
-		log.WithError(err).WithField("httpURL", httpURL).Error("Cannot create new GET request to rocketChat.")
-		return make([]byte, 0)
+// UploadThreadFile uploads a file to the thread of the message tmid. If tmid is empty, it is uploaded to the main
+// channel of the room.
+func (rock *RocketCon) UploadThreadFile(rid string, tmid string, name string, data []byte, description string) (Message, error) {
+	return rock.UploadThreadFileContext(context.Background(), rid, tmid, name, data, description)
+}
+
+// UploadThreadFileContext is like UploadThreadFile, but the upload is canceled when ctx is done.
+func (rock *RocketCon) UploadThreadFileContext(ctx context.Context, rid string, tmid string, name string, data []byte, description string) (Message, error) {
+	fields := make(map[string]string)
+	if description != "" {
+		fields["description"] = description
+	}
+	if tmid != "" {
+		fields["tmid"] = tmid
 	}
-	request.Header.Set("X-Auth-Token", rock.AuthToken)
-	request.Header.Set("X-User-Id", rock.UserId)
 
-	// Get Request
-	response, err := client.Do(request)
+	var resp struct {
+		Message *messageObject `json:"message"`
+	}
+	err := rock.restPostMultipart(ctx, "/api/v1/rooms.upload/"+url.PathEscape(rid), fields,
+		[]restFile{{Field: "file", Name: name, Data: data}}, &resp)
 	if err != nil {
-		log.WithError(err).WithField("request", request).Error("Cannot perform GET request to rocketChat.")
-		return make([]byte, 0)
+		return Message{}, fmt.Errorf("cannot upload file: %w", err)
 	}
 
-	// Parse Request
-	//defer response.Body.Close()
-	body, _ := io.ReadAll(response.Body)
-	return body
+	return rock.sentMessage(resp.Message), nil
+}
+
+// runMethod calls a method of the realtime API, and decodes its result into result, which may be nil. If the method
+// fails, a *DDPError is returned.
+func (rock *RocketCon) runMethod(i map[string]interface{}, result interface{}) error {
+	return rock.runMethodContext(context.Background(), i, result)
 }
 
-func (rock *RocketCon) runMethod(i map[string]interface{}) (map[string]interface{}, error) {
+// runMethodContext is like runMethod, but it stops waiting for the result when ctx is done.
+func (rock *RocketCon) runMethodContext(ctx context.Context, i map[string]interface{}, result interface{}) error {
+	conn := rock.currentConn()
+	if conn == nil {
+		return errors.New("not connected to Rocket.Chat")
+	}
+
 	id := rock.generateId()
 	i["msg"] = "method"
 	i["id"] = id
 	c := rock.watchResults(id)
-	defer close(c)
-	rock.send <- i
-	reply := <-c
-	if _, ok := reply["error"]; ok {
-		if _, ok := reply["error"].(map[string]interface{})["error"]; ok {
-			//errNo := reply["error"].(map[string]interface{})["error"].(string)
-			errNo := reply["error"].(map[string]interface{})["error"].(float64)
-			errType := reply["error"].(map[string]interface{})["errorType"].(string)
-			return reply, fmt.Errorf("Rocket.Chat replied with an error: %f %s", errNo, errType)
-		} else {
-			return reply, errors.New("Unknown error")
-		}
+	defer rock.unwatchResults(id)
+	conn.write(i)
+
+	var reply *ddpFrame
+	select {
+	case reply = <-c:
+	case <-conn.done:
+		return errors.New("the connection to Rocket.Chat was lost while waiting for the result")
+	case <-time.After(methodTimeout):
+		return fmt.Errorf("no result for method %v in %s", i["method"], methodTimeout)
+	case <-ctx.Done():
+		return fmt.Errorf("no result for method %v: %w", i["method"], ctx.Err())
+	}
+
+	if reply.Error != nil {
+		return reply.Error
 	}
-	return reply, nil
+	if err := reply.decodeResult(result); err != nil {
+		return fmt.Errorf("%v: %w", i["method"], err)
+	}
+	return nil
 }
 
 func (rock *RocketCon) connect() {
@@ -465,7 +401,7 @@ func (rock *RocketCon) connect() {
 		"version": "1",
 		"support": []string{"1", "pre2", "pre1"},
 	}
-	rock.send <- init
+	rock.write(init)
 }
 
 func (rock *RocketCon) login() error {
@@ -497,12 +433,26 @@ func (rock *RocketCon) login() error {
 		}
 	}
 
-	reply, err := rock.runMethod(obj)
+	var result struct {
+		Id    string `json:"id"`
+		Token string `json:"token"`
+	}
+	err := rock.runMethod(obj, &result)
+	var ddpErr *DDPError
+	if errors.As(err, &ddpErr) && rock.AuthToken != "" && rock.Password != "" && rock.UserName != "" {
+		// The token may have expired while the bot was disconnected, but a fresh one can be obtained with the password.
+		log.WithError(err).Warn("Cannot resume the session with the auth token, logging in with the password.")
+		rock.AuthToken = ""
+		return rock.login()
+	}
 	if err != nil {
 		return err
 	}
-	rock.UserId = reply["result"].(map[string]interface{})["id"].(string)
-	rock.AuthToken = reply["result"].(map[string]interface{})["token"].(string)
+	if result.Id == "" || result.Token == "" {
+		return errors.New("the login result has no user id or token")
+	}
+	rock.UserId = result.Id
+	rock.AuthToken = result.Token
 	return nil
 }
 
@@ -519,24 +469,48 @@ func (rock *RocketCon) GetMessage() (Message, error) {
 }
 
 func (rock *RocketCon) GetNewMessage() (Message, error) {
+	return rock.GetNewMessageContext(context.Background())
+}
+
+// GetNewMessageContext is like GetNewMessage, but it returns the error of ctx if it is done before a message arrives.
+func (rock *RocketCon) GetNewMessageContext(ctx context.Context) (Message, error) {
 	var msg Message
 	select {
 	case msg := <-rock.newMessages:
 		return msg, nil
 	case <-rock.quit:
 		return msg, errors.New("The rocket connection has been closed")
+	case <-ctx.Done():
+		return msg, ctx.Err()
 	}
 }
 
-func (rock *RocketCon) RequestUserName(userid string) string {
-	res := rock.restRequest("/api/v1/users.info?userId=" + userid)
-	var m map[string]interface{}
-	err := json.Unmarshal(res, &m)
+// User is the public information of a user, returned by users.info.
+type User struct {
+	Id       string `json:"_id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+}
+
+// RequestUser returns the information of the user with the id.
+func (rock *RocketCon) RequestUser(userid string) (User, error) {
+	var resp struct {
+		User User `json:"user"`
+	}
+	if err := rock.restGet("/api/v1/users.info", url.Values{"userId": {userid}}, &resp); err != nil {
+		return User{}, fmt.Errorf("cannot request user info: %w", err)
+	}
+	return resp.User, nil
+}
+
+// RequestUserName returns the username (the handle used in mentions) of the user with the id.
+func (rock *RocketCon) RequestUserName(userid string) (string, error) {
+	user, err := rock.RequestUser(userid)
 	if err != nil {
-		log.WithError(err).WithField("response", res).Error("Error while parsing userinfo response.")
-		return ""
+		return "", err
 	}
-	return m["user"].(map[string]interface{})["name"].(string)
+	return user.Username, nil
 }
 
 func (rock *RocketCon) RefreshChannelCache() error {
@@ -544,77 +518,170 @@ func (rock *RocketCon) RefreshChannelCache() error {
 		"method": "rooms/get",
 	}
 
-	reply, err := rock.runMethod(obj)
+	var rooms []roomObject
+	err := rock.runMethod(obj, &rooms)
 	if err != nil {
 		return err
 	}
-	for _, val := range reply["result"].([]interface{}) {
-		if _, ok := val.(map[string]interface{})["fname"]; ok {
-			name := val.(map[string]interface{})["fname"].(string)
-			id := val.(map[string]interface{})["_id"].(string)
-			rock.channels[id] = name
+	for _, room := range rooms {
+		if room.Id != "" && room.Fname != "" {
+			rock.setChannel(room.Id, room.Fname, room.T)
 		}
 	}
-	return err
+	return nil
 }
 
-func (rock *RocketCon) requestMessageObj(mid string) map[string]interface{} {
-	resp := rock.restRequest("/api/v1/chat.getMessage?msgId=" + mid)
-	var m map[string]interface{}
-	err := json.Unmarshal(resp, &m)
-	if err != nil {
-		log.WithError(err).WithField("response", resp).Error("Error while parsing chat.getMessage response.")
-		return m
+func (rock *RocketCon) requestMessageObj(mid string) (*messageObject, error) {
+	var resp struct {
+		Message *messageObject `json:"message"`
+	}
+	if err := rock.restGet("/api/v1/chat.getMessage", url.Values{"msgId": {mid}}, &resp); err != nil {
+		return nil, fmt.Errorf("cannot request message: %w", err)
 	}
-	return m
+	if resp.Message == nil {
+		return nil, fmt.Errorf("cannot request message: empty response")
+	}
+	return resp.Message, nil
 }
 
+// RequestDisplayName returns the full name of the user with the id.
 func (rock *RocketCon) RequestDisplayName(uid string) (string, error) {
-	resp := rock.restRequest("/api/v1/users.info?userId=" + uid)
-	var m map[string]interface{}
-	err := json.Unmarshal(resp, &m)
+	user, err := rock.RequestUser(uid)
 	if err != nil {
 		return "", err
 	}
-	if user, ok := m["user"]; ok {
-		if name, ok := user.(map[string]interface{})["name"]; ok {
-			return name.(string), nil
-		}
-	}
-	return "", errors.New("Some error")
+	return user.Name, nil
 }
 
 func (rock *RocketCon) RequestMessage(mid string) (Message, error) {
-	var msg Message
-	obj := rock.requestMessageObj(mid)
-	if _, ok := obj["message"]; ok {
-		msg = rock.handleMessageObject(obj["message"].(map[string]interface{}))
-		return msg, nil
+	obj, err := rock.requestMessageObj(mid)
+	if err != nil {
+		return Message{}, err
 	}
-	return msg, errors.New("Some error")
+	return rock.handleMessageObject(obj)
 }
 
-func (rock *RocketCon) SendMessage(rid string, text string) (Message, error) {
+func (rock *RocketCon) LoadHistory(rid string, limit int) ([]Message, error) {
 	obj := map[string]interface{}{
-		"method": "sendMessage",
+		"method": "loadHistory",
+		// rid, end (nil means now), limit, last seen, show thread messages
+		"params": []interface{}{rid, nil, limit, nil, false},
+	}
+
+	var result struct {
+		Messages []messageObject `json:"messages"`
+	}
+	err := rock.runMethod(obj, &result)
+	if err != nil {
+		return nil, err
+	}
+	return rock.messageList(result.Messages), nil
+}
+
+// LoadThreadMessages returns the last messages of the thread, at most limit, oldest first.
+func (rock *RocketCon) LoadThreadMessages(tmid string, limit int) ([]Message, error) {
+	obj := map[string]interface{}{
+		"method": "getThreadMessages",
 		"params": []map[string]interface{}{
 			map[string]interface{}{
-				"rid": rid,
-				"msg": text,
+				"tmid":  tmid,
+				"limit": limit,
 			},
 		},
 	}
 
-	var msg Message
-	reply, err := rock.runMethod(obj)
+	var result []messageObject
+	err := rock.runMethod(obj, &result)
 	if err != nil {
-		return msg, err
+		return nil, err
 	}
-	if replyObj, ok := reply["result"].(map[string]interface{}); ok {
-		msg = rock.handleMessageObject(replyObj)
+	return rock.messageList(result), nil
+}
+
+// messageList converts a list of message objects to messages sorted by time. System messages (e.g. someone has
+// joined the room) and malformed messages are left out.
+func (rock *RocketCon) messageList(objs []messageObject) []Message {
+	messages := make([]Message, 0, len(objs))
+	for i := range objs {
+		if objs[i].T != "" {
+			continue
+		}
+		msg, err := rock.handleMessageObject(&objs[i])
+		if err != nil {
+			log.WithError(err).Warn("Skipping message of the history.")
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+	return messages
+}
+
+func (rock *RocketCon) SendMessage(rid string, text string) (Message, error) {
+	return rock.SendThreadMessage(rid, "", text)
+}
+
+// SendThreadMessage sends a message to the thread of the message tmid. If tmid is empty, it is sent to the main
+// channel of the room. A text longer than MaxMessageSize is split into several messages (see SplitText), the first
+// one is returned.
+func (rock *RocketCon) SendThreadMessage(rid string, tmid string, text string) (Message, error) {
+	return rock.SendThreadMessageContext(context.Background(), rid, tmid, text)
+}
+
+// SendThreadMessageContext is like SendThreadMessage, but it stops waiting for Rocket.Chat when ctx is done.
+func (rock *RocketCon) SendThreadMessageContext(ctx context.Context, rid string, tmid string, text string) (Message, error) {
+	var first Message
+	for i, part := range SplitText(text, rock.MaxMessageSize()) {
+		msg, err := rock.sendThreadMessage(ctx, rid, tmid, part)
+		if err != nil {
+			return first, err
+		}
+		if i == 0 {
+			first = msg
+		}
+	}
+	return first, nil
+}
+
+// sendThreadMessage sends the text as it is, in one message.
+func (rock *RocketCon) sendThreadMessage(ctx context.Context, rid string, tmid string, text string) (Message, error) {
+	params := map[string]interface{}{
+		"rid": rid,
+		"msg": text,
+	}
+	if tmid != "" {
+		params["tmid"] = tmid
+	}
+	obj := map[string]interface{}{
+		"method": "sendMessage",
+		"params": []map[string]interface{}{
+			params,
+		},
+	}
+
+	var result *messageObject
+	err := rock.runMethodContext(ctx, obj, &result)
+	if err != nil {
+		return Message{}, err
+	}
+	return rock.sentMessage(result), nil
+}
+
+// sentMessage converts the message object returned for a message sent by the bot. If it is missing or malformed, an
+// empty message is returned, since the message has been sent anyway.
+func (rock *RocketCon) sentMessage(obj *messageObject) Message {
+	var msg Message
+	if obj != nil {
+		var err error
+		msg, err = rock.handleMessageObject(obj)
+		if err != nil {
+			log.WithError(err).Warn("Cannot parse the message sent by the bot.")
+		}
 	}
 	msg.IsMe = true
-	return msg, nil
+	return msg
 }
 
 func (rock *RocketCon) DM(username string, text string) (Message, error) {
@@ -625,12 +692,17 @@ func (rock *RocketCon) DM(username string, text string) (Message, error) {
 		},
 	}
 
-	reply, err := rock.runMethod(obj)
+	var result struct {
+		Rid string `json:"rid"`
+	}
+	err := rock.runMethod(obj, &result)
 	if err != nil {
 		return Message{}, err
 	}
-	rid := reply["result"].(map[string]interface{})["rid"].(string)
-	return rock.SendMessage(rid, text)
+	if result.Rid == "" {
+		return Message{}, errors.New("createDirectMessage returned no room id")
+	}
+	return rock.SendMessage(result.Rid, text)
 }
 
 func (rock *RocketCon) React(mid string, emoji string) error {
@@ -642,7 +714,7 @@ func (rock *RocketCon) React(mid string, emoji string) error {
 		},
 	}
 
-	_, err := rock.runMethod(reaction)
+	err := rock.runMethod(reaction, nil)
 	return err
 }
 
@@ -654,7 +726,7 @@ func (rock *RocketCon) UserDefaultStatus(status string) error {
 		},
 	}
 
-	_, err := rock.runMethod(reaction)
+	err := rock.runMethod(reaction, nil)
 	return err
 }
 
@@ -664,57 +736,76 @@ func (rock *RocketCon) UserTemporaryStatus(status string) error {
 		"params": []string{},
 	}
 
-	_, err := rock.runMethod(reaction)
+	err := rock.runMethod(reaction, nil)
 	return err
 }
 
 func (rock *RocketCon) ListCustomEmojis() ([]string, error) {
 	emojis := make([]string, 0)
 
-	reply := rock.restRequest("/api/v1/emoji-custom.list")
-	var m map[string]interface{}
-	err := json.Unmarshal(reply, &m)
-	if err != nil {
-		return emojis, err
+	var resp struct {
+		Emojis struct {
+			Update []struct {
+				Name string `json:"name"`
+			} `json:"update"`
+		} `json:"emojis"`
 	}
-
-	if _, ok := m["emojis"]; ok {
-		for _, val := range m["emojis"].(map[string]interface{})["update"].([]interface{}) {
-			emojis = append(emojis, fmt.Sprintf(":%s:", val.(map[string]interface{})["name"].(string)))
-		}
+	if err := rock.restGet("/api/v1/emoji-custom.list", nil, &resp); err != nil {
+		return emojis, fmt.Errorf("cannot list custom emojis: %w", err)
+	}
+	for _, emoji := range resp.Emojis.Update {
+		emojis = append(emojis, fmt.Sprintf(":%s:", emoji.Name))
 	}
 	return emojis, nil
 }
 
+// membersEndpoints are the endpoints that list the members of the rooms, by room type. Each one rejects the rooms of
+// the other types.
+var membersEndpoints = map[string]string{
+	RoomTypeChannel: "/api/v1/channels.members",
+	RoomTypePrivate: "/api/v1/groups.members",
+	RoomTypeDirect:  "/api/v1/im.members",
+}
+
+// ListUsersInRoomId returns the usernames of all members of the room, page by page. The endpoint is chosen by the type
+// of the room, rooms of unknown type are listed as channels.
 func (rock *RocketCon) ListUsersInRoomId(roomId string) ([]string, error) {
 	users := make([]string, 0)
 
-	reply := rock.restRequest(fmt.Sprintf("/api/v1/channels.members?roomId=%s&count=1000", roomId))
-	var m map[string]interface{}
-	err := json.Unmarshal(reply, &m)
-	if err != nil {
-		return users, err
+	endpoint := membersEndpoints[RoomTypeChannel]
+	if c, ok := rock.channel(roomId); ok && membersEndpoints[c.Type] != "" {
+		endpoint = membersEndpoints[c.Type]
 	}
-
-	if members, ok := m["members"]; ok {
-		for _, member := range members.([]interface{}) {
-			if username, ok := member.(map[string]interface{})["username"]; ok {
-				users = append(users, username.(string))
+	err := rock.restPages(endpoint, url.Values{"roomId": {roomId}}, func(data json.RawMessage) error {
+		var page struct {
+			Members []User `json:"members"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return fmt.Errorf("cannot parse members: %w", err)
+		}
+		for _, member := range page.Members {
+			if member.Username != "" {
+				users = append(users, member.Username)
 			}
 		}
-		return users, nil
+		return nil
+	})
+	if err != nil {
+		return users, fmt.Errorf("cannot list the members of the room: %w", err)
 	}
-	return users, errors.New("Failed to handle members")
+	return users, nil
 }
 
 func (rock *RocketCon) ListUsersInRoom(room string) ([]string, error) {
 	roomId := ""
-	for id, name := range rock.channels {
-		if room == name {
+	rock.channelsMutex.RLock()
+	for id, c := range rock.channels {
+		if room == c.Name {
 			roomId = id
 			break
 		}
 	}
+	rock.channelsMutex.RUnlock()
 	if roomId == "" {
 		return make([]string, 0), errors.New("No Known Room")
 	}
@@ -0,0 +1,914 @@
+// Package rockettest provides an in-process fake Rocket.Chat server for tests, with the realtime (DDP) API at
+// /websocket and the REST routes the bot uses.
+package rockettest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+type User struct {
+	Id       string
+	Username string
+	Name     string
+}
+
+type Room struct {
+	Id   string
+	Name string
+	// Type is c (channel), p (private group) or d (direct messages).
+	Type    string
+	Members []string
+}
+
+type Attachment struct {
+	Title       string
+	Description string
+	Link        string
+	ImageURL    string
+	ImageType   string
+	AudioURL    string
+	AudioType   string
+	Size        int64
+}
+
+type Message struct {
+	Id          string
+	RoomId      string
+	ThreadId    string
+	UserId      string
+	Username    string
+	Text        string
+	Timestamp   time.Time
+	UpdatedAt   time.Time
+	Edited      bool
+	Attachments []Attachment
+	// Mentions are the users mentioned in the text, they are filled in by Send.
+	Mentions []User
+}
+
+// Server is a fake Rocket.Chat server. The bot logs in as Bot, with Password or Token.
+type Server struct {
+	*httptest.Server
+	Bot      User
+	Password string
+	Token    string
+	// MaxMessageSize is the Message_MaxAllowedSize setting, longer messages are rejected. It can be changed before
+	// the bot connects.
+	MaxMessageSize int
+
+	mutex    sync.Mutex
+	users    map[string]*User
+	rooms    map[string]*Room
+	messages []*Message
+	files    map[string][]byte
+	conns    map[*conn]bool
+	nextId   int
+	// status is the last status set by the bot with UserPresence.
+	status string
+	// changed is closed and replaced when the state of the connections changes, e.g. a room has been subscribed.
+	changed chan struct{}
+	// delays are the delayed next calls of the methods, set with DelayMethod.
+	delays map[string]delay
+
+	botMessages chan Message
+}
+
+// NewServer starts a fake server. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		Bot:            User{Id: "bot-id", Username: "bot", Name: "Bot"},
+		Password:       "password",
+		Token:          "bot-token",
+		MaxMessageSize: 5000,
+		users:          make(map[string]*User),
+		rooms:          make(map[string]*Room),
+		files:          make(map[string][]byte),
+		conns:          make(map[*conn]bool),
+		changed:        make(chan struct{}),
+		delays:         make(map[string]delay),
+		botMessages:    make(chan Message, 1024),
+	}
+	s.users[s.Bot.Id] = &s.Bot
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/websocket", s.serveWebsocket)
+	mux.HandleFunc("/api/v1/users.info", s.auth(s.usersInfo))
+	mux.HandleFunc("/api/v1/chat.getMessage", s.auth(s.chatGetMessage))
+	mux.HandleFunc("/api/v1/channels.members", s.auth(s.roomMembers("c")))
+	mux.HandleFunc("/api/v1/groups.members", s.auth(s.roomMembers("p")))
+	mux.HandleFunc("/api/v1/im.members", s.auth(s.roomMembers("d")))
+	mux.HandleFunc("/api/v1/emoji-custom.list", s.auth(s.emojiCustomList))
+	mux.HandleFunc("/api/v1/settings.public", s.settingsPublic)
+	mux.HandleFunc("/api/v1/rooms.upload/", s.auth(s.roomsUpload))
+	mux.HandleFunc("/file-upload/", s.auth(s.fileUpload))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Close disconnects the clients and stops the server.
+func (s *Server) Close() {
+	s.Disconnect()
+	s.Server.Close()
+}
+
+// HostPort returns the host and the port of the server, as the bot is configured with them.
+func (s *Server) HostPort() (string, uint16) {
+	host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, uint16(p)
+}
+
+func (s *Server) newId(prefix string) string {
+	s.nextId++
+	return fmt.Sprintf("%s%d", prefix, s.nextId)
+}
+
+// clock is shared by the servers, because the rocket package remembers the time of the last message across
+// connections, and the messages of a test must not look older than the ones of the previous test.
+var clock struct {
+	mutex  sync.Mutex
+	lastTs time.Time
+}
+
+// now returns the current time in milliseconds, later than all the previous timestamps, so the bot sees every message
+// as new.
+func (s *Server) now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	t := time.Now().Truncate(time.Millisecond)
+	if !t.After(clock.lastTs) {
+		t = clock.lastTs.Add(time.Millisecond)
+	}
+	clock.lastTs = t
+	return t
+}
+
+// notify wakes up the goroutines waiting for a change.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// AddUser creates a user.
+func (s *Server) AddUser(username string, name string) User {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u := &User{Id: s.newId("user-"), Username: username, Name: name}
+	s.users[u.Id] = u
+	return *u
+}
+
+// AddRoom creates a room with the members, and the bot. If the bot is already connected, it is notified about the new
+// room, as Rocket.Chat does when the bot is added to a room.
+func (s *Server) AddRoom(name string, roomType string, members ...User) Room {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r := s.addRoom(name, roomType, members)
+	for c := range s.conns {
+		c.notifyUser(s.Bot.Id+"/subscriptions-changed", "inserted", subscriptionObject(r))
+	}
+	return *r
+}
+
+func (s *Server) addRoom(name string, roomType string, members []User) *Room {
+	r := &Room{Id: s.newId("room-"), Name: name, Type: roomType, Members: []string{s.Bot.Id}}
+	for _, m := range members {
+		r.Members = append(r.Members, m.Id)
+	}
+	s.rooms[r.Id] = r
+	return r
+}
+
+// AddDirectRoom creates the direct message room of the user and the bot.
+func (s *Server) AddDirectRoom(user User) Room {
+	// The bot sees the direct room by the name of the other user.
+	return s.AddRoom(user.Username, "d", user)
+}
+
+// AddFile makes the data downloadable at the path, e.g. /file-upload/<id>/<name>.
+func (s *Server) AddFile(path string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[path] = data
+}
+
+// Post sends a message from the user to the room.
+func (s *Server) Post(room Room, user User, text string) Message {
+	return s.Send(Message{RoomId: room.Id, UserId: user.Id, Text: text})
+}
+
+// PostInThread sends a message from the user to the thread of the message tmid.
+func (s *Server) PostInThread(room Room, tmid string, user User, text string) Message {
+	return s.Send(Message{RoomId: room.Id, ThreadId: tmid, UserId: user.Id, Text: text})
+}
+
+// Send stores the message and streams it to the subscribers of its room. The id, the username and the timestamps are
+// filled in if they are not set.
+func (s *Server) Send(m Message) Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.send(m)
+}
+
+func (s *Server) send(m Message) Message {
+	if m.Id == "" {
+		m.Id = s.newId("msg-")
+	}
+	if m.Username == "" {
+		if u, ok := s.users[m.UserId]; ok {
+			m.Username = u.Username
+		}
+	}
+	if m.Mentions == nil {
+		m.Mentions = s.mentions(m.Text)
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = s.now()
+	}
+	if m.UpdatedAt.IsZero() {
+		m.UpdatedAt = m.Timestamp
+	}
+	stored := m
+	s.messages = append(s.messages, &stored)
+	s.stream(&stored)
+	return m
+}
+
+// mentions returns the known users mentioned in the text, as Rocket.Chat parses them.
+func (s *Server) mentions(text string) []User {
+	var users []User
+	for _, word := range strings.Fields(text) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		username := strings.TrimRight(word[1:], ",:;.!?")
+		for _, u := range s.users {
+			if u.Username == username {
+				users = append(users, *u)
+			}
+		}
+	}
+	return users
+}
+
+// stream sends the message to the connections subscribed to its room, and to BotMessages if the bot wrote it.
+func (s *Server) stream(m *Message) {
+	for c := range s.conns {
+		if c.rooms[m.RoomId] {
+			c.changed("stream-room-messages", m.RoomId, messageObject(m, false))
+		}
+	}
+	if m.UserId == s.Bot.Id {
+		select {
+		case s.botMessages <- *m:
+		default:
+		}
+	}
+}
+
+// BotMessages returns the messages sent by the bot, including the new versions of the edited ones.
+func (s *Server) BotMessages() <-chan Message {
+	return s.botMessages
+}
+
+// WaitBotMessage returns the next message sent or edited by the bot for which accept returns true. accept may be nil.
+func (s *Server) WaitBotMessage(timeout time.Duration, accept func(Message) bool) (Message, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-s.botMessages:
+			if accept == nil || accept(m) {
+				return m, nil
+			}
+		case <-deadline:
+			return Message{}, fmt.Errorf("no message from the bot in %s", timeout)
+		}
+	}
+}
+
+// Messages returns the current state of the messages of the room, in the order they have been sent.
+func (s *Server) Messages(roomId string) []Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var list []Message
+	for _, m := range s.messages {
+		if m.RoomId == roomId {
+			list = append(list, *m)
+		}
+	}
+	return list
+}
+
+// Message returns the current state of a message.
+func (s *Server) Message(id string) (Message, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m := s.message(id); m != nil {
+		return *m, true
+	}
+	return Message{}, false
+}
+
+func (s *Server) message(id string) *Message {
+	for _, m := range s.messages {
+		if m.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// Disconnect closes the websocket connections, the bot is expected to reconnect. The connections are forgotten right
+// away, so WaitSubscribed waits for the new connection.
+func (s *Server) Disconnect() {
+	s.mutex.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+		delete(s.conns, c)
+	}
+	s.notify()
+	s.mutex.Unlock()
+	for _, c := range conns {
+		c.ws.Close()
+	}
+}
+
+// Status returns the last status the bot has set, e.g. online or offline.
+func (s *Server) Status() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+// Subscriptions returns the number of subscriptions of the open connections.
+func (s *Server) Subscriptions() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := 0
+	for c := range s.conns {
+		n += len(c.subs)
+	}
+	return n
+}
+
+// Connections returns the number of open connections.
+func (s *Server) Connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.conns)
+}
+
+// WaitSubscribed waits until a connection has subscribed to the messages of the room, so the messages posted
+// afterwards reach the bot.
+func (s *Server) WaitSubscribed(roomId string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		s.mutex.Lock()
+		subscribed := false
+		for c := range s.conns {
+			subscribed = subscribed || c.rooms[roomId]
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+		if subscribed {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("room %s has not been subscribed in %s", roomId, timeout)
+		}
+	}
+}
+
+// conn is a websocket connection of a client.
+type conn struct {
+	server     *Server
+	ws         *websocket.Conn
+	writeMutex sync.Mutex
+	// rooms are the rooms whose messages are streamed to the client, guarded by the mutex of the server.
+	rooms map[string]bool
+	// userEvents are the stream-notify-user events the client subscribed to.
+	userEvents map[string]bool
+	// subs are the room ids and events by subscription id.
+	subs map[string]string
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (s *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{server: s, ws: ws, rooms: make(map[string]bool), userEvents: make(map[string]bool), subs: make(map[string]string)}
+	s.mutex.Lock()
+	s.conns[c] = true
+	s.notify()
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.notify()
+		s.mutex.Unlock()
+		ws.Close()
+	}()
+
+	for {
+		_, raw, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var frame clientFrame
+		if err := json.Unmarshal(raw, &frame); err != nil {
+			c.write(map[string]interface{}{"msg": "error", "reason": "Bad request", "offendingMessage": string(raw)})
+			continue
+		}
+		c.handle(&frame)
+	}
+}
+
+type clientFrame struct {
+	Msg    string            `json:"msg"`
+	Id     string            `json:"id"`
+	Name   string            `json:"name"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+func (c *conn) write(v interface{}) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.ws.WriteJSON(v)
+}
+
+// changed sends an event of a stream.
+func (c *conn) changed(collection string, eventName string, args ...interface{}) {
+	c.write(map[string]interface{}{
+		"msg":        "changed",
+		"collection": collection,
+		"id":         "id",
+		"fields":     map[string]interface{}{"eventName": eventName, "args": args},
+	})
+}
+
+func (c *conn) notifyUser(eventName string, args ...interface{}) {
+	if c.userEvents[eventName] {
+		c.changed("stream-notify-user", eventName, args...)
+	}
+}
+
+func (c *conn) handle(frame *clientFrame) {
+	s := c.server
+	switch frame.Msg {
+	case "connect":
+		c.write(map[string]interface{}{"msg": "connected", "session": "session"})
+	case "ping":
+		c.write(map[string]interface{}{"msg": "pong"})
+	case "sub":
+		var param string
+		if len(frame.Params) > 0 {
+			json.Unmarshal(frame.Params[0], &param)
+		}
+		s.mutex.Lock()
+		switch frame.Name {
+		case "stream-room-messages":
+			c.rooms[param] = true
+		case "stream-notify-user":
+			c.userEvents[param] = true
+		}
+		c.subs[frame.Id] = param
+		s.notify()
+		s.mutex.Unlock()
+		c.write(map[string]interface{}{"msg": "ready", "subs": []string{frame.Id}})
+	case "unsub":
+		s.mutex.Lock()
+		param := c.subs[frame.Id]
+		delete(c.rooms, param)
+		delete(c.userEvents, param)
+		delete(c.subs, frame.Id)
+		s.notify()
+		s.mutex.Unlock()
+		c.write(map[string]interface{}{"msg": "nosub", "id": frame.Id})
+	case "method":
+		s.mutex.Lock()
+		d, ok := s.delays[frame.Method]
+		delete(s.delays, frame.Method)
+		s.mutex.Unlock()
+		if ok {
+			close(d.called)
+			go func() {
+				time.Sleep(d.duration)
+				c.method(frame)
+			}()
+		} else {
+			c.method(frame)
+		}
+	}
+}
+
+// method runs a method call, and sends its result.
+func (c *conn) method(frame *clientFrame) {
+	s := c.server
+	s.mutex.Lock()
+	result, err := s.call(frame.Method, frame.Params)
+	s.mutex.Unlock()
+	reply := map[string]interface{}{"msg": "result", "id": frame.Id}
+	if err != nil {
+		reply["error"] = err
+	} else {
+		reply["result"] = result
+	}
+	c.write(reply)
+}
+
+// delay is a delayed method call.
+type delay struct {
+	duration time.Duration
+	called   chan struct{}
+}
+
+// DelayMethod delays the next call of the method of the realtime API, e.g. to simulate a server that hangs. The
+// other calls are answered in the meantime. The returned channel is closed when the call arrives.
+func (s *Server) DelayMethod(method string, duration time.Duration) <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	d := delay{duration: duration, called: make(chan struct{})}
+	s.delays[method] = d
+	return d.called
+}
+
+// methodError is the error of a method call, as Rocket.Chat sends it.
+type methodError struct {
+	Error     interface{} `json:"error"`
+	ErrorType string      `json:"errorType"`
+	Reason    string      `json:"reason"`
+}
+
+// checkSize rejects the messages longer than MaxMessageSize, like Rocket.Chat.
+func (s *Server) checkSize(text string) *methodError {
+	if utf8.RuneCountInString(text) > s.MaxMessageSize {
+		return &methodError{Error: "error-message-size-exceeded", ErrorType: "Meteor.Error", Reason: "Message size exceeds Message_MaxAllowedSize"}
+	}
+	return nil
+}
+
+// call runs a method of the realtime API with the mutex of the server held.
+func (s *Server) call(method string, params []json.RawMessage) (interface{}, *methodError) {
+	param := func(i int, v interface{}) {
+		if i < len(params) {
+			json.Unmarshal(params[i], v)
+		}
+	}
+
+	switch method {
+	case "login":
+		var p struct {
+			User struct {
+				Username string `json:"username"`
+			} `json:"user"`
+			Password struct {
+				Digest string `json:"digest"`
+			} `json:"password"`
+			Resume string `json:"resume"`
+		}
+		param(0, &p)
+		digest := fmt.Sprintf("%x", sha256.Sum256([]byte(s.Password)))
+		if (p.Resume != "" && p.Resume == s.Token) || (p.User.Username == s.Bot.Username && p.Password.Digest == digest) {
+			return map[string]interface{}{"id": s.Bot.Id, "token": s.Token}, nil
+		}
+		return nil, &methodError{Error: 403, ErrorType: "Meteor.Error", Reason: "User not found"}
+	case "subscriptions/get":
+		update := make([]interface{}, 0)
+		for _, r := range s.sortedRooms() {
+			update = append(update, subscriptionObject(r))
+		}
+		return map[string]interface{}{"update": update, "remove": []interface{}{}}, nil
+	case "rooms/get":
+		rooms := make([]interface{}, 0)
+		for _, r := range s.sortedRooms() {
+			rooms = append(rooms, map[string]interface{}{"_id": r.Id, "name": r.Name, "fname": r.Name, "t": r.Type})
+		}
+		return rooms, nil
+	case "sendMessage":
+		var p struct {
+			Rid  string `json:"rid"`
+			Msg  string `json:"msg"`
+			Tmid string `json:"tmid"`
+		}
+		param(0, &p)
+		if _, ok := s.rooms[p.Rid]; !ok {
+			return nil, &methodError{Error: "error-invalid-room", ErrorType: "Meteor.Error", Reason: "Invalid room"}
+		}
+		if err := s.checkSize(p.Msg); err != nil {
+			return nil, err
+		}
+		m := s.send(Message{RoomId: p.Rid, ThreadId: p.Tmid, UserId: s.Bot.Id, Text: p.Msg})
+		return messageObject(&m, false), nil
+	case "updateMessage":
+		var p struct {
+			Id  string `json:"_id"`
+			Msg string `json:"msg"`
+		}
+		param(0, &p)
+		m := s.message(p.Id)
+		if m == nil {
+			return nil, &methodError{Error: "error-action-not-allowed", ErrorType: "Meteor.Error", Reason: "Not allowed"}
+		}
+		if err := s.checkSize(p.Msg); err != nil {
+			return nil, err
+		}
+		m.Text = p.Msg
+		m.Edited = true
+		m.UpdatedAt = s.now()
+		s.stream(m)
+		return nil, nil
+	case "deleteMessage":
+		var p struct {
+			Id string `json:"_id"`
+		}
+		param(0, &p)
+		for i, m := range s.messages {
+			if m.Id == p.Id {
+				s.messages = append(s.messages[:i], s.messages[i+1:]...)
+				break
+			}
+		}
+		return nil, nil
+	case "loadHistory":
+		var rid string
+		var limit int
+		param(0, &rid)
+		param(2, &limit)
+		messages := make([]interface{}, 0)
+		for i := len(s.messages) - 1; i >= 0 && (limit <= 0 || len(messages) < limit); i-- {
+			if m := s.messages[i]; m.RoomId == rid && m.ThreadId == "" {
+				messages = append(messages, messageObject(m, false))
+			}
+		}
+		return map[string]interface{}{"messages": messages}, nil
+	case "getThreadMessages":
+		var p struct {
+			Tmid  string `json:"tmid"`
+			Limit int    `json:"limit"`
+		}
+		param(0, &p)
+		var thread []*Message
+		for _, m := range s.messages {
+			if m.ThreadId == p.Tmid {
+				thread = append(thread, m)
+			}
+		}
+		if p.Limit > 0 && len(thread) > p.Limit {
+			thread = thread[len(thread)-p.Limit:]
+		}
+		messages := make([]interface{}, 0, len(thread))
+		for _, m := range thread {
+			messages = append(messages, messageObject(m, false))
+		}
+		return messages, nil
+	case "createDirectMessage":
+		var username string
+		param(0, &username)
+		for _, r := range s.rooms {
+			if r.Type == "d" && r.Name == username {
+				return map[string]interface{}{"rid": r.Id}, nil
+			}
+		}
+		for _, u := range s.users {
+			if u.Username == username {
+				r := s.addRoom(username, "d", []User{*u})
+				return map[string]interface{}{"rid": r.Id}, nil
+			}
+		}
+		return nil, &methodError{Error: "error-invalid-user", ErrorType: "Meteor.Error", Reason: "Invalid user"}
+	case "UserPresence:online", "UserPresence:away", "UserPresence:busy", "UserPresence:offline":
+		s.status = strings.TrimPrefix(method, "UserPresence:")
+		return nil, nil
+	case "setReaction", "stream-notify-room", "UserPresence:setDefaultStatus":
+		return nil, nil
+	}
+	return nil, &methodError{Error: 404, ErrorType: "Meteor.Error", Reason: fmt.Sprintf("Method '%s' not found", method)}
+}
+
+func (s *Server) sortedRooms() []*Room {
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Id < rooms[j].Id
+	})
+	return rooms
+}
+
+func subscriptionObject(r *Room) map[string]interface{} {
+	return map[string]interface{}{"rid": r.Id, "name": r.Name, "fname": r.Name, "t": r.Type}
+}
+
+// messageObject returns the message as Rocket.Chat sends it. The realtime API sends the dates as {"$date": ms}, the
+// REST API in ISO 8601.
+func messageObject(m *Message, rest bool) map[string]interface{} {
+	date := func(t time.Time) interface{} {
+		if rest {
+			return t.UTC().Format("2006-01-02T15:04:05.000Z")
+		}
+		return map[string]int64{"$date": t.UnixMilli()}
+	}
+	obj := map[string]interface{}{
+		"_id":        m.Id,
+		"rid":        m.RoomId,
+		"msg":        m.Text,
+		"u":          map[string]string{"_id": m.UserId, "username": m.Username},
+		"ts":         date(m.Timestamp),
+		"_updatedAt": date(m.UpdatedAt),
+	}
+	if m.ThreadId != "" {
+		obj["tmid"] = m.ThreadId
+	}
+	mentions := make([]interface{}, 0, len(m.Mentions))
+	for _, u := range m.Mentions {
+		mentions = append(mentions, map[string]string{"_id": u.Id, "username": u.Username, "name": u.Name})
+	}
+	obj["mentions"] = mentions
+	if m.Edited {
+		obj["editedAt"] = date(m.UpdatedAt)
+	}
+	if len(m.Attachments) > 0 {
+		attachments := make([]interface{}, 0, len(m.Attachments))
+		for _, a := range m.Attachments {
+			attach := map[string]interface{}{
+				"title":       a.Title,
+				"title_link":  a.Link,
+				"description": a.Description,
+				"type":        "file",
+			}
+			if a.ImageURL != "" {
+				attach["image_url"] = a.ImageURL
+				attach["image_type"] = a.ImageType
+				attach["image_size"] = a.Size
+			}
+			if a.AudioURL != "" {
+				attach["audio_url"] = a.AudioURL
+				attach["audio_type"] = a.AudioType
+				attach["audio_size"] = a.Size
+			}
+			attachments = append(attachments, attach)
+		}
+		obj["attachments"] = attachments
+	}
+	return obj
+}
+
+func writeJSON(w http.ResponseWriter, status int, v map[string]interface{}) {
+	if _, ok := v["success"]; !ok {
+		v["success"] = status == http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func restError(w http.ResponseWriter, status int, errorType string, message string) {
+	writeJSON(w, status, map[string]interface{}{"errorType": errorType, "error": message})
+}
+
+// auth checks the credentials of the bot, then serves the request with the mutex of the server held.
+func (s *Server) auth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-Token") != s.Token || r.Header.Get("X-User-Id") != s.Bot.Id {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"status": "error", "message": "You must be logged in to do this."})
+			return
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		handler(w, r)
+	}
+}
+
+func (s *Server) usersInfo(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.users[r.URL.Query().Get("userId")]
+	if !ok {
+		restError(w, http.StatusBadRequest, "error-invalid-user", "Invalid user")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user": map[string]string{"_id": u.Id, "username": u.Username, "name": u.Name},
+	})
+}
+
+func (s *Server) chatGetMessage(w http.ResponseWriter, r *http.Request) {
+	m := s.message(r.URL.Query().Get("msgId"))
+	if m == nil {
+		restError(w, http.StatusBadRequest, "error-not-allowed", "Not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": messageObject(m, true)})
+}
+
+// roomMembers returns the handler of the members endpoint of the room type. Like Rocket.Chat, it does not find the rooms
+// of the other types.
+func (s *Server) roomMembers(roomType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := s.rooms[r.URL.Query().Get("roomId")]
+		if !ok || room.Type != roomType {
+			restError(w, http.StatusBadRequest, "error-room-not-found", "The required \"roomId\" param provided does not match any room")
+			return
+		}
+		s.members(w, r, room)
+	}
+}
+
+func (s *Server) members(w http.ResponseWriter, r *http.Request, room *Room) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count <= 0 {
+		count = 50
+	}
+	members := make([]interface{}, 0)
+	for i := offset; i >= 0 && i < len(room.Members) && len(members) < count; i++ {
+		if u, ok := s.users[room.Members[i]]; ok {
+			members = append(members, map[string]string{"_id": u.Id, "username": u.Username, "name": u.Name})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"members": members, "count": len(members), "offset": offset, "total": len(room.Members),
+	})
+}
+
+func (s *Server) emojiCustomList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"emojis": map[string]interface{}{"update": []interface{}{}, "remove": []interface{}{}},
+	})
+}
+
+func (s *Server) settingsPublic(w http.ResponseWriter, r *http.Request) {
+	settings := []interface{}{}
+	for _, id := range strings.Split(r.URL.Query().Get("_id"), ",") {
+		if id == "Message_MaxAllowedSize" {
+			settings = append(settings, map[string]interface{}{"_id": id, "value": s.MaxMessageSize})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"settings": settings, "count": len(settings), "offset": 0, "total": len(settings)})
+}
+
+func (s *Server) roomsUpload(w http.ResponseWriter, r *http.Request) {
+	rid := strings.TrimPrefix(r.URL.Path, "/api/v1/rooms.upload/")
+	if _, ok := s.rooms[rid]; !ok || r.Method != http.MethodPost {
+		restError(w, http.StatusBadRequest, "error-invalid-room", "Invalid room")
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		restError(w, http.StatusBadRequest, "error-invalid-file", "Invalid file")
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		restError(w, http.StatusBadRequest, "error-invalid-file", "Invalid file")
+		return
+	}
+
+	path := fmt.Sprintf("/file-upload/%s/%s", s.newId("file-"), header.Filename)
+	s.files[path] = data
+	attach := Attachment{
+		Title:       header.Filename,
+		Description: r.FormValue("description"),
+		Link:        path,
+		Size:        int64(len(data)),
+	}
+	contentType := http.DetectContentType(data)
+	if strings.HasPrefix(contentType, "image/") {
+		attach.ImageURL = path
+		attach.ImageType = contentType
+	}
+	m := s.send(Message{RoomId: rid, ThreadId: r.FormValue("tmid"), UserId: s.Bot.Id, Attachments: []Attachment{attach}})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": messageObject(&m, true)})
+}
+
+func (s *Server) fileUpload(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Write(data)
+}
@@ -0,0 +1,59 @@
+package rocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMaxMessageSize is the default of the Message_MaxAllowedSize setting of Rocket.Chat, used if the setting
+// cannot be read.
+const defaultMaxMessageSize = 5000
+
+// setting is a public setting of the server.
+type setting struct {
+	Id    string          `json:"_id"`
+	Value json.RawMessage `json:"value"`
+}
+
+// RequestPublicSetting reads a public setting of the server into out.
+func (rock *RocketCon) RequestPublicSetting(id string, out interface{}) error {
+	var resp struct {
+		Settings []setting `json:"settings"`
+	}
+	if err := rock.restGet("/api/v1/settings.public", url.Values{"_id": {id}}, &resp); err != nil {
+		return fmt.Errorf("cannot request setting %s: %w", id, err)
+	}
+	for _, s := range resp.Settings {
+		if s.Id != id {
+			continue
+		}
+		if err := json.Unmarshal(s.Value, out); err != nil {
+			return fmt.Errorf("cannot parse setting %s: %w", id, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("setting %s not found", id)
+}
+
+// requestMaxMessageSize returns the Message_MaxAllowedSize setting of the server, the maximum length of a message in
+// characters.
+func (rock *RocketCon) requestMaxMessageSize() int {
+	var size int
+	err := rock.RequestPublicSetting("Message_MaxAllowedSize", &size)
+	if err != nil || size <= 0 {
+		log.WithError(err).WithField("default", defaultMaxMessageSize).Warn("Cannot read the maximum message size, using the default.")
+		return defaultMaxMessageSize
+	}
+	return size
+}
+
+// MaxMessageSize returns the maximum length of a message in characters.
+func (rock *RocketCon) MaxMessageSize() int {
+	if rock.maxMessageSize <= 0 {
+		return defaultMaxMessageSize
+	}
+	return rock.maxMessageSize
+}
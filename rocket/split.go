@@ -0,0 +1,115 @@
+package rocket
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// numberingReserve is the room left in each part for the numbering, e.g. "\n(12/34)".
+	numberingReserve = 16
+	// fence opens and closes code blocks in markdown.
+	fence = "```"
+)
+
+// SplitText splits the text into parts of at most limit characters. It cuts at the last paragraph break, line break,
+// end of sentence or space that fits, and in the middle of a word only if there is none. A code block is never cut in
+// the middle of a line, and if it goes on in the next part, it is closed at the end of the part and opened again at
+// the start of the next one. If there are several parts, they are numbered, e.g. "(1/3)".
+func SplitText(text string, limit int) []string {
+	if limit <= 0 || utf8.RuneCountInString(text) <= limit {
+		return []string{text}
+	}
+
+	var parts []string
+	// open is the opening line of the code block the rest of the text is in, e.g. "```go", or empty.
+	var open string
+	rest := text
+	for rest != "" {
+		prefix := ""
+		if open != "" {
+			prefix = open + "\n"
+		}
+		// The closing fence is reserved even if the part does not end in a code block, it is shorter than to look ahead.
+		avail := limit - numberingReserve - utf8.RuneCountInString(prefix) - len("\n"+fence)
+		if avail < 1 {
+			avail = 1
+		}
+		if utf8.RuneCountInString(rest) <= avail {
+			parts = append(parts, prefix+rest)
+			break
+		}
+
+		cut, skip := findCut(rest[:runeOffset(rest, avail)], open != "")
+		chunk := rest[:cut]
+		rest = rest[cut+skip:]
+		inBlock, nextOpen := fenceState(chunk, open)
+		if inBlock {
+			chunk = strings.TrimRight(chunk, "\n") + "\n" + fence
+			open = nextOpen
+			// If the block ends right after the cut, its closing fence is the one added to the part.
+			if line, after, _ := strings.Cut(rest, "\n"); strings.HasPrefix(strings.TrimSpace(line), fence) {
+				rest = strings.TrimLeft(after, " \n")
+				open = ""
+			}
+		} else {
+			chunk = strings.TrimRight(chunk, " \n")
+			rest = strings.TrimLeft(rest, " \n")
+			open = ""
+		}
+		parts = append(parts, prefix+chunk)
+	}
+
+	for i := range parts {
+		parts[i] += fmt.Sprintf("\n(%d/%d)", i+1, len(parts))
+	}
+	return parts
+}
+
+// findCut returns where to cut the text, and the length of the separator to drop there. In a code block only line
+// breaks are considered, so code lines are kept intact where possible.
+func findCut(text string, inBlock bool) (int, int) {
+	separators := []string{"\n\n", "\n", ". ", "! ", "? ", " "}
+	if inBlock {
+		separators = []string{"\n"}
+	}
+	for _, sep := range separators {
+		if i := strings.LastIndex(text, sep); i > 0 {
+			if sep[0] != '\n' && sep != " " {
+				// The punctuation stays in the part, only the space is dropped.
+				return i + 1, 1
+			}
+			return i, len(sep)
+		}
+	}
+	return len(text), 0
+}
+
+// fenceState returns whether the text ends in a code block, and the opening line of that block. open is the opening
+// line of the block the text starts in, or empty.
+func fenceState(text string, open string) (bool, string) {
+	inBlock := open != ""
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, fence) {
+			continue
+		}
+		if inBlock {
+			inBlock, open = false, ""
+		} else {
+			inBlock, open = true, trimmed
+		}
+	}
+	return inBlock, open
+}
+
+// runeOffset returns the byte offset of the nth character of the text.
+func runeOffset(text string, n int) int {
+	offset := 0
+	for i := 0; i < n && offset < len(text); i++ {
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		offset += size
+	}
+	return offset
+}
@@ -0,0 +1,50 @@
+package rocket
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitText(t *testing.T) {
+	assert.Equal(t, []string{"short"}, SplitText("short", 10))
+	assert.Equal(t, []string{""}, SplitText("", 10))
+	first := strings.TrimSpace(strings.Repeat("a ", 20))
+	second := strings.TrimSpace(strings.Repeat("b ", 20))
+	assert.Equal(t, []string{first + "\n(1/2)", second + "\n(2/2)"}, SplitText(first+"\n\n"+second, 60))
+	assert.Equal(t, []string{"This is the first sentence.\n(1/2)", "And this is the second one, longer.\n(2/2)"},
+		SplitText("This is the first sentence. And this is the second one, longer.", 56))
+
+	text := strings.Repeat("Lorem ipsum dolor sit amet, ünicode.\n", 100)
+	parts := SplitText(text, 100)
+	for _, part := range parts {
+		assert.LessOrEqual(t, utf8.RuneCountInString(part), 100)
+	}
+	assert.True(t, strings.HasSuffix(parts[len(parts)-1], fmt.Sprintf("\n(%d/%d)", len(parts), len(parts))))
+}
+
+func TestSplitTextCodeBlock(t *testing.T) {
+	code := "```go\n" + strings.Repeat("    fmt.Println(\"hello world\")\n", 10) + "```"
+	parts := SplitText("Here is the code:\n\n"+code+"\n\nThat's all.", 120)
+	assert.Greater(t, len(parts), 2)
+
+	var lines []string
+	for _, part := range parts {
+		assert.LessOrEqual(t, utf8.RuneCountInString(part), 120)
+		// Each part has complete code blocks.
+		assert.Equal(t, 0, strings.Count(part, "```")%2, part)
+		for _, line := range strings.Split(part, "\n") {
+			if strings.HasPrefix(line, "    ") {
+				lines = append(lines, line)
+				// The lines of code are not cut.
+				assert.Equal(t, `    fmt.Println("hello world")`, line)
+			}
+		}
+	}
+	assert.Len(t, lines, 10)
+	assert.True(t, strings.HasPrefix(parts[1], "```go\n"))
+	assert.Contains(t, parts[len(parts)-1], "That's all.")
+}
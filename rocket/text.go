@@ -0,0 +1,120 @@
+package rocket
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// quoteLinkPattern matches the markdown links of quoted messages, e.g. [ ](https://chat.example.com/channel/general?msg=abc).
+var quoteLinkPattern = regexp.MustCompile(`\[[^\]]*\]\((https?://[^)\s]+)\)`)
+
+// quotedMessageId returns the id of the message the link points to, if it is a message on the server.
+func (rock *RocketCon) quotedMessageId(link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || !strings.EqualFold(u.Hostname(), rock.HostName) {
+		return "", false
+	}
+	id := u.Query().Get("msg")
+	return id, id != ""
+}
+
+// quotedMessageIds returns the ids of the messages quoted in the text, in order.
+func (rock *RocketCon) quotedMessageIds(text string) []string {
+	ids := make([]string, 0)
+	for _, match := range quoteLinkPattern.FindAllStringSubmatch(text, -1) {
+		if id, ok := rock.quotedMessageId(match[1]); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// StripQuotes returns the text without the links of the quoted messages. The other links are kept.
+func (msg *Message) StripQuotes(text string) string {
+	if msg.rocketCon == nil {
+		return text
+	}
+	text = quoteLinkPattern.ReplaceAllStringFunc(text, func(link string) string {
+		match := quoteLinkPattern.FindStringSubmatch(link)
+		if _, ok := msg.rocketCon.quotedMessageId(match[1]); ok {
+			return ""
+		}
+		return link
+	})
+	return strings.TrimSpace(text)
+}
+
+// RequestQuotedMessages fetches the messages quoted in the message. The ones that cannot be fetched are left out, the
+// error of the last one is returned.
+func (msg *Message) RequestQuotedMessages() ([]Message, error) {
+	var quoted []Message
+	var lastErr error
+	for _, id := range msg.QuotedMsgs {
+		q, err := msg.rocketCon.RequestMessage(id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		quoted = append(quoted, q)
+	}
+	return quoted, lastErr
+}
+
+// isUsernameChar returns true if c can be part of a username.
+func isUsernameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-'
+}
+
+// ReplaceMentions calls replace with the username of each @mention in the text, and replaces the mention with the
+// result if it returns true. The trailing dot of a mention at the end of a sentence is not part of the username.
+func ReplaceMentions(text string, replace func(username string) (string, bool)) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		if text[i] != '@' || (i > 0 && isUsernameChar(text[i-1])) {
+			b.WriteByte(text[i])
+			i++
+			continue
+		}
+		end := i + 1
+		for end < len(text) && isUsernameChar(text[end]) {
+			end++
+		}
+		for end > i+1 && text[end-1] == '.' {
+			end--
+		}
+		if end == i+1 {
+			b.WriteByte(text[i])
+			i++
+			continue
+		}
+		if replacement, ok := replace(text[i+1 : end]); ok {
+			b.WriteString(replacement)
+		} else {
+			b.WriteString(text[i:end])
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// removedMention marks the place of a removed mention, so the separators around it can be removed too.
+const removedMention = "\x00"
+
+var (
+	leadingMention = regexp.MustCompile(`^\s*` + removedMention + `[,:;]?\s*`)
+	innerMention   = regexp.MustCompile(`[ \t]?` + removedMention + `[,:;]?`)
+)
+
+// RemoveMention removes the mentions of the user from the text, with the punctuation after them, e.g. "@bot, hello"
+// becomes "hello". The rest of the text is kept as it is.
+func RemoveMention(text string, username string) string {
+	if username == "" {
+		return text
+	}
+	text = ReplaceMentions(text, func(u string) (string, bool) {
+		return removedMention, strings.EqualFold(u, username)
+	})
+	text = leadingMention.ReplaceAllString(text, "")
+	return innerMention.ReplaceAllString(text, "")
+}
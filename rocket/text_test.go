@@ -0,0 +1,44 @@
+package rocket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceMentions(t *testing.T) {
+	upper := func(username string) (string, bool) {
+		return strings.ToUpper(username), username != "keep"
+	}
+	assert.Equal(t, "JDOE and J.DOE.", ReplaceMentions("@jdoe and @j.doe.", upper))
+	assert.Equal(t, "@keep, mail@example.com @ END", ReplaceMentions("@keep, mail@example.com @ @end", upper))
+}
+
+func TestRemoveMention(t *testing.T) {
+	for text, want := range map[string]string{
+		"@bot hello":                       "hello",
+		"@Bot, What is `Foo()`?":           "What is `Foo()`?",
+		"ask @bot about @bot2":             "ask about @bot2",
+		"hello @bot.":                      "hello.",
+		"@bot\n```\n  indented  code\n```": "```\n  indented  code\n```",
+	} {
+		assert.Equal(t, want, RemoveMention(text, "bot"), text)
+	}
+	assert.Equal(t, "@bot hello", RemoveMention("@bot hello", ""))
+}
+
+func TestQuotes(t *testing.T) {
+	rock := newFrameTestCon()
+	text := "[ ](https://chat.example.com:3000/channel/general?msg=m1) [ ](https://chat.example.com/direct/x?msg=m2&x=1)" +
+		" what about [this](https://example.com/?msg=m3)?"
+	assert.Equal(t, []string{"m1", "m2"}, rock.quotedMessageIds(text))
+
+	msg := Message{Text: text, rocketCon: rock}
+	assert.Equal(t, "what about [this](https://example.com/?msg=m3)?", msg.StripQuotes(text))
+}
+
+func TestGetNotAddressedText(t *testing.T) {
+	msg := Message{Text: "@bot Why does `Foo` return NULL?", rocketCon: newFrameTestCon()}
+	assert.Equal(t, "Why does `Foo` return NULL?", msg.GetNotAddressedText())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+)
+
+type Permission string
+
+const (
+	PermissionEveryone Permission = "everyone"
+	PermissionAdmin    Permission = "admin"
+	PermissionDisabled Permission = "disabled"
+)
+
+// Command is a chat command, e.g. "!model gpt-4o".
+type Command struct {
+	Name string
+	// Usage describes the arguments in the help, e.g. "<model>".
+	Usage       string
+	Description string
+	MinArgs     int
+	// MaxArgs is the maximum number of arguments, -1 means no limit.
+	MaxArgs    int
+	Permission Permission
+	Handler    func(cmd *CommandContext) error
+}
+
+type CommandContext struct {
+	Msg     rocket.Message
+	Command *Command
+	Args    []string
+}
+
+// Reply sends a reply to the user who has issued the command.
+func (cmd *CommandContext) Reply(text string) error {
+	_, err := cmd.Msg.Reply(fmt.Sprintf("@%s %s", cmd.Msg.UserName, text))
+	if err != nil {
+		return fmt.Errorf("cannot send reply to rocketchat: %w", err)
+	}
+	return nil
+}
+
+// CommandRouter recognises commands in the messages and dispatches them to the registered handlers.
+type CommandRouter struct {
+	Prefix string
+	Admins []string
+	// Permissions override the default permissions of the commands by name.
+	Permissions map[string]Permission
+	commands    map[string]*Command
+}
+
+func NewCommandRouter(prefix string, admins []string, permissions map[string]Permission) *CommandRouter {
+	return &CommandRouter{
+		Prefix:      prefix,
+		Admins:      admins,
+		Permissions: permissions,
+		commands:    make(map[string]*Command),
+	}
+}
+
+func (r *CommandRouter) Register(cmd *Command) {
+	if p, ok := r.Permissions[cmd.Name]; ok {
+		cmd.Permission = p
+	}
+	r.commands[cmd.Name] = cmd
+}
+
+// Route runs the command in the message. It returns false if the message is not a command, so it has to be handled
+// otherwise.
+func (r *CommandRouter) Route(msg rocket.Message) (bool, error) {
+	name, args, ok := r.parse(msg.Text, msg.AmIPinged)
+	if !ok {
+		return false, nil
+	}
+
+	ctx := &CommandContext{Msg: msg, Args: args}
+	cmd, ok := r.commands[name]
+	if !ok || cmd.Permission == PermissionDisabled {
+		return true, ctx.Reply(fmt.Sprintf(":grey_question: Unknown command: %s%s. Try %shelp.", r.Prefix, name, r.Prefix))
+	}
+	ctx.Command = cmd
+
+	if !r.Allowed(cmd, msg.UserName) {
+		return true, ctx.Reply(fmt.Sprintf(":no_entry: You are not allowed to use %s%s.", r.Prefix, name))
+	}
+	if len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+		return true, ctx.Reply(fmt.Sprintf("Usage: `%s`", r.usage(cmd)))
+	}
+
+	return true, cmd.Handler(ctx)
+}
+
+func (r *CommandRouter) Allowed(cmd *Command, userName string) bool {
+	switch cmd.Permission {
+	case PermissionEveryone:
+		return true
+	case PermissionAdmin:
+		for _, admin := range r.Admins {
+			if admin == userName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Help lists the commands the user is allowed to use.
+func (r *CommandRouter) Help(userName string) string {
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		cmd := r.commands[name]
+		if r.Allowed(cmd, userName) {
+			lines = append(lines, fmt.Sprintf("`%s` %s", r.usage(cmd), cmd.Description))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *CommandRouter) usage(cmd *Command) string {
+	return strings.TrimSpace(r.Prefix + cmd.Name + " " + cmd.Usage)
+}
+
+// parse splits the text into the name of the command and the arguments. pinged tells if the text starts with a
+// mention of the bot, which is ignored before the command. A command after the mention of another user is not for
+// the bot.
+func (r *CommandRouter) parse(text string, pinged bool) (string, []string, bool) {
+	text = strings.TrimSpace(text)
+	if pinged && strings.HasPrefix(text, "@") {
+		if i := strings.IndexAny(text, " \t\n"); i != -1 {
+			text = strings.TrimSpace(text[i:])
+		}
+	}
+	if r.Prefix == "" || !strings.HasPrefix(text, r.Prefix) {
+		return "", nil, false
+	}
+
+	args, err := splitArgs(text[len(r.Prefix):])
+	if err != nil || len(args) == 0 || args[0] == "" {
+		return "", nil, false
+	}
+	return strings.ToLower(args[0]), args[1:], true
+}
+
+// splitArgs splits the text at whitespace, except within double quotes.
+func splitArgs(text string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inQuotes, hasArg := false, false
+	for _, c := range text {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case !inQuotes && (c == ' ' || c == '\t' || c == '\n'):
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		default:
+			current.WriteRune(c)
+			hasArg = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New("unterminated quote")
+	}
+	if hasArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandRouterParse(t *testing.T) {
+	r := NewCommandRouter("!", nil, nil)
+
+	name, args, ok := r.parse("!model gpt-4o", false)
+	assert.True(t, ok)
+	assert.Equal(t, "model", name)
+	assert.Equal(t, []string{"gpt-4o"}, args)
+
+	name, args, ok = r.parse("@bot  !Persona \"grumpy pirate\"  now", true)
+	assert.True(t, ok)
+	assert.Equal(t, "persona", name)
+	assert.Equal(t, []string{"grumpy pirate", "now"}, args)
+
+	_, _, ok = r.parse("@bot what does !reset do?", true)
+	assert.False(t, ok)
+	// The command is addressed to another user.
+	_, _, ok = r.parse("@alice !reset", false)
+	assert.False(t, ok)
+	_, _, ok = r.parse("!", false)
+	assert.False(t, ok)
+	_, _, ok = r.parse("!persona \"unterminated", false)
+	assert.False(t, ok)
+
+	_, _, ok = NewCommandRouter("", nil, nil).parse("!reset", false)
+	assert.False(t, ok)
+}
+
+func TestCommandRouterPermissions(t *testing.T) {
+	r := NewCommandRouter("!", []string{"boss"}, map[string]Permission{"retry": PermissionDisabled})
+	r.Register(&Command{Name: "reset", Description: "Resets.", Permission: PermissionEveryone})
+	r.Register(&Command{Name: "model", Usage: "<model>", Description: "Changes the model.", Permission: PermissionAdmin})
+	r.Register(&Command{Name: "retry", Description: "Retries.", Permission: PermissionEveryone})
+
+	assert.True(t, r.Allowed(r.commands["reset"], "joe"))
+	assert.False(t, r.Allowed(r.commands["model"], "joe"))
+	assert.True(t, r.Allowed(r.commands["model"], "boss"))
+	assert.False(t, r.Allowed(r.commands["retry"], "boss"))
+
+	assert.Equal(t, "`!reset` Resets.", r.Help("joe"))
+	assert.Equal(t, "`!model <model>` Changes the model.\n`!reset` Resets.", r.Help("boss"))
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // The timezones have to work in containers without tzdata too.
+
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tool is a Go function the model can call while it is answering a message.
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments, see https://json-schema.org/understanding-json-schema/
+	Parameters map[string]interface{}
+	Handler    func(call *ToolCall) (string, error)
+}
+
+type ToolCall struct {
+	// Msg is the message the model is answering.
+	Msg       rocket.Message
+	Arguments json.RawMessage
+}
+
+// Decode unmarshals the arguments of the call into v.
+func (call *ToolCall) Decode(v interface{}) error {
+	if len(call.Arguments) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(call.Arguments, v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+// maxToolResultLength is the maximum number of characters of a tool result, the rest is cut, so a single call cannot
+// fill the context window.
+const maxToolResultLength = 8000
+
+type ToolRegistry struct {
+	tools map[string]*Tool
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: make(map[string]*Tool)}
+}
+
+func (r *ToolRegistry) Register(tool *Tool) {
+	r.tools[tool.Name] = tool
+}
+
+// Has returns true if a tool is registered with the name.
+func (r *ToolRegistry) Has(name string) bool {
+	_, ok := r.tools[name]
+	return ok
+}
+
+// Names returns the names of the registered tools in alphabetical order.
+func (r *ToolRegistry) Names() []string {
+	names := make([]string, 0, len(r.tools))
+	for name := range r.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Definitions returns the enabled tools in the form they are sent to OpenAI. Unknown names are ignored.
+func (r *ToolRegistry) Definitions(enabled []string) []openai.Tool {
+	var definitions []openai.Tool
+	for _, name := range enabled {
+		if tool, ok := r.tools[name]; ok {
+			definitions = append(definitions, openai.NewFunctionTool(tool.Name, tool.Description, tool.Parameters))
+		}
+	}
+	return definitions
+}
+
+// Call runs a tool call of the model, and returns the result as a message for the model. Errors are returned to the
+// model as well, so it can tell the user about them, or try again with different arguments.
+func (r *ToolRegistry) Call(msg rocket.Message, enabled []string, call openai.ToolCall) openai.Message {
+	logger := log.WithField("tool", call.Function.Name).WithField("arguments", call.Function.Arguments)
+	result, err := r.call(msg, enabled, call)
+	if err != nil {
+		logger.WithError(err).Warn("Tool call failed.")
+		result = "Error: " + err.Error()
+	} else {
+		logger.WithField("result", result).Debug("Tool call.")
+	}
+
+	if r := []rune(result); len(r) > maxToolResultLength {
+		result = string(r[:maxToolResultLength]) + "\n[The rest of the result has been cut.]"
+	}
+	return openai.Message{
+		Role:       "tool",
+		Content:    result,
+		ToolCallId: call.Id,
+	}
+}
+
+func (r *ToolRegistry) call(msg rocket.Message, enabled []string, call openai.ToolCall) (string, error) {
+	tool, ok := r.tools[call.Function.Name]
+	if !ok || !contains(enabled, call.Function.Name) {
+		return "", fmt.Errorf("unknown tool: %s", call.Function.Name)
+	}
+	return tool.Handler(&ToolCall{
+		Msg:       msg,
+		Arguments: json.RawMessage(call.Function.Arguments),
+	})
+}
+
+// registerBuiltinTools registers the tools which need no access to the internet, only to Rocket.Chat.
+func registerBuiltinTools(r *ToolRegistry, rock *rocket.RocketCon) {
+	r.Register(&Tool{
+		Name:        "get_current_time",
+		Description: "Returns the current date and time.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"timezone": map[string]interface{}{
+					"type":        "string",
+					"description": "IANA timezone, e.g. Europe/Budapest. UTC by default.",
+				},
+			},
+		},
+		Handler: func(call *ToolCall) (string, error) {
+			var args struct {
+				Timezone string `json:"timezone"`
+			}
+			if err := call.Decode(&args); err != nil {
+				return "", err
+			}
+			loc := time.UTC
+			if args.Timezone != "" {
+				var err error
+				loc, err = time.LoadLocation(args.Timezone)
+				if err != nil {
+					return "", fmt.Errorf("unknown timezone: %s", args.Timezone)
+				}
+			}
+			return time.Now().In(loc).Format("Monday, 2 January 2006, 15:04:05 MST (-07:00)"), nil
+		},
+	})
+
+	r.Register(&Tool{
+		Name:        "calculate",
+		Description: "Evaluates an arithmetic expression. Supports + - * / % ^, parentheses, pi, e, and the functions abs, sqrt, cbrt, exp, ln, log (base 10), log2, sin, cos, tan, asin, acos, atan (in radians), floor, ceil and round.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"expression": map[string]interface{}{
+					"type":        "string",
+					"description": "The expression, e.g. (2 + 3) * sqrt(16)",
+				},
+			},
+			"required": []string{"expression"},
+		},
+		Handler: func(call *ToolCall) (string, error) {
+			var args struct {
+				Expression string `json:"expression"`
+			}
+			if err := call.Decode(&args); err != nil {
+				return "", err
+			}
+			v, err := Calculate(args.Expression)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatFloat(v, 'g', -1, 64), nil
+		},
+	})
+
+	r.Register(&Tool{
+		Name:        "list_room_members",
+		Description: "Lists the usernames of the members of the current chat room.",
+		Parameters: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		},
+		Handler: func(call *ToolCall) (string, error) {
+			users, err := rock.ListUsersInRoomId(call.Msg.RoomId)
+			if err != nil {
+				return "", fmt.Errorf("cannot list the members of the room: %w", err)
+			}
+			return strings.Join(users, ", "), nil
+		},
+	})
+
+	r.Register(&Tool{
+		Name:        "get_quoted_message",
+		Description: "Returns the author and the text of a message quoted by the user. Only messages of the current chat room can be fetched.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"message_id": map[string]interface{}{
+					"type":        "string",
+					"description": "The id of the message, from the msg parameter of its link. The first quoted message by default.",
+				},
+			},
+		},
+		Handler: func(call *ToolCall) (string, error) {
+			var args struct {
+				MessageId string `json:"message_id"`
+			}
+			if err := call.Decode(&args); err != nil {
+				return "", err
+			}
+			if args.MessageId == "" {
+				if len(call.Msg.QuotedMsgs) == 0 {
+					return "", fmt.Errorf("the user has not quoted any message")
+				}
+				args.MessageId = call.Msg.QuotedMsgs[0]
+			}
+			quoted, err := rock.RequestMessage(args.MessageId)
+			if err != nil {
+				return "", fmt.Errorf("cannot fetch the message: %w", err)
+			}
+			// The user may not be allowed to see the other rooms of the bot.
+			if quoted.RoomId != call.Msg.RoomId {
+				return "", fmt.Errorf("the message is not in the current room")
+			}
+			return fmt.Sprintf("%s (%s): %s", quoted.UserName, quoted.Timestamp.Format(time.RFC3339), quoted.Text), nil
+		},
+	})
+}
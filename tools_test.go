@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToolRegistry(t *testing.T) {
+	r := NewToolRegistry()
+	registerBuiltinTools(r, nil)
+	assert.Equal(t, []string{"calculate", "get_current_time", "get_quoted_message", "list_room_members"}, r.Names())
+
+	definitions := r.Definitions([]string{"calculate", "unknown"})
+	assert.Len(t, definitions, 1)
+	assert.Equal(t, "function", definitions[0].Type)
+	assert.Equal(t, "calculate", definitions[0].Function.Name)
+
+	enabled := []string{"calculate", "get_current_time"}
+	msg := rocket.Message{RoomId: "room1"}
+	result := r.Call(msg, enabled, openai.ToolCall{
+		Id:       "call1",
+		Function: openai.FunctionCall{Name: "calculate", Arguments: `{"expression": "6 * 7"}`},
+	})
+	assert.Equal(t, openai.Message{Role: "tool", Content: "42", ToolCallId: "call1"}, result)
+
+	result = r.Call(msg, enabled, openai.ToolCall{
+		Id:       "call2",
+		Function: openai.FunctionCall{Name: "calculate", Arguments: `{"expression": 6}`},
+	})
+	assert.Contains(t, result.Content, "Error: invalid arguments")
+
+	result = r.Call(msg, enabled, openai.ToolCall{
+		Id:       "call3",
+		Function: openai.FunctionCall{Name: "get_current_time", Arguments: `{"timezone": "Mars/Olympus_Mons"}`},
+	})
+	assert.Equal(t, "Error: unknown timezone: Mars/Olympus_Mons", result.Content)
+
+	result = r.Call(msg, enabled, openai.ToolCall{
+		Id:       "call4",
+		Function: openai.FunctionCall{Name: "get_current_time", Arguments: `{"timezone": "Europe/Budapest"}`},
+	})
+	assert.Regexp(t, `^\w+day, \d+ \w+ \d{4}, \d\d:\d\d:\d\d CES?T \(\+0[12]:00\)$`, result.Content)
+
+	// Disabled tools cannot be called, even if the model asks for them.
+	result = r.Call(msg, enabled, openai.ToolCall{
+		Id:       "call5",
+		Function: openai.FunctionCall{Name: "list_room_members"},
+	})
+	assert.Equal(t, "Error: unknown tool: list_room_members", result.Content)
+}